@@ -11,7 +11,7 @@ import (
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/deepch/vdk/format/aac"
 	"github.com/deepch/vdk/format/mp4"
-	"github.com/deepch/vdk/format/rtmp"
+	"github.com/general252/live/format/rtmp"
 )
 
 func init() {
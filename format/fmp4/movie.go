@@ -0,0 +1,347 @@
+package fmp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/mp4/mp4io"
+)
+
+const movieTimeScale = 1000
+
+// ErrTooLarge is returned by WriteFaststart when the file does not fit
+// into 32 bit chunk offsets or durations.
+var ErrTooLarge = errors.New("fmp4: too large for a progressive file")
+
+// WriteFaststart writes the samples that have been written to the Muxer
+// as a progressive MP4 with moov in front of mdat, so it can be played
+// while downloading. r reads the fragmented file, WriteTrailer must have
+// been called.
+func (e *Muxer) WriteFaststart(r io.ReaderAt, w io.Writer) error {
+	type placed struct {
+		t *track
+		i int
+	}
+
+	// mdat keeps the order of the fragmented file
+	var chunks []placed
+	for _, t := range e.tracks {
+		if t == nil {
+			continue
+		}
+		for i := range t.chunks {
+			chunks = append(chunks, placed{t: t, i: i})
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].t.chunks[chunks[i].i].offset < chunks[j].t.chunks[chunks[j].i].offset
+	})
+
+	offsets := map[*track][]uint32{}
+	for _, t := range e.tracks {
+		if t != nil {
+			offsets[t] = make([]uint32, len(t.chunks))
+		}
+	}
+
+	moov, err := e.movie(offsets)
+	if err != nil {
+		return err
+	}
+
+	ftyp := &mp4io.FileType{
+		MajorBrand:       fourCC("isom"),
+		MinorVersion:     512,
+		CompatibleBrands: []uint32{fourCC("isom"), fourCC("iso2"), fourCC("avc1"), fourCC("mp41")},
+	}
+
+	pos := int64(ftyp.Len() + moov.Len() + 8)
+	for _, c := range chunks {
+		offsets[c.t][c.i] = uint32(pos)
+		pos += c.t.chunks[c.i].size
+	}
+	if pos > math.MaxUint32 {
+		return ErrTooLarge
+	}
+
+	// offsets are filled now, the length of moov does not change
+	if moov, err = e.movie(offsets); err != nil {
+		return err
+	}
+
+	b := make([]byte, ftyp.Len()+moov.Len()+8)
+	n := ftyp.Marshal(b)
+	n += moov.Marshal(b[n:])
+	mdatSize := pos - int64(n)
+	copy(b[n:], appendBox(nil, int(mdatSize), "mdat"))
+
+	bw := bufio.NewWriter(w)
+	if _, err = bw.Write(b); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		ch := c.t.chunks[c.i]
+		if _, err = io.Copy(bw, io.NewSectionReader(r, ch.offset, ch.size)); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// movie builds moov. Without offsets it is the initialization of the
+// fragmented file, otherwise it describes all written chunks, offsets
+// are the chunk offsets of every track in the progressive file.
+func (e *Muxer) movie(offsets map[*track][]uint32) (*mp4io.Movie, error) {
+	moov := &mp4io.Movie{
+		Header: &mp4io.MovieHeader{
+			PreferredRate:   1,
+			PreferredVolume: 1,
+			Matrix:          [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+			TimeScale:       movieTimeScale,
+		},
+	}
+
+	mvex := &mp4io.MovieExtend{}
+	var maxDuration time.Duration
+	for _, t := range e.tracks {
+		if t == nil {
+			continue
+		}
+
+		trak, duration, err := t.trackAtom(offsets)
+		if err != nil {
+			return nil, err
+		}
+		if duration > maxDuration {
+			maxDuration = duration
+		}
+
+		moov.Tracks = append(moov.Tracks, trak)
+		moov.Header.NextTrackId = int32(t.id) + 1
+		mvex.Tracks = append(mvex.Tracks, &mp4io.TrackExtend{
+			TrackId:              t.id,
+			DefaultSampleDescIdx: 1,
+		})
+	}
+
+	if offsets == nil {
+		moov.Unknowns = []mp4io.Atom{mvex}
+	} else {
+		ts := int64(maxDuration) * movieTimeScale / int64(time.Second)
+		if ts > math.MaxInt32 {
+			return nil, ErrTooLarge
+		}
+		moov.Header.Duration = int32(ts)
+	}
+
+	return moov, nil
+}
+
+// trackAtom builds trak, the sample table is empty without offsets.
+func (t *track) trackAtom(offsets map[*track][]uint32) (*mp4io.Track, time.Duration, error) {
+	stbl := &mp4io.SampleTable{
+		SampleDesc:    &mp4io.SampleDesc{},
+		TimeToSample:  &mp4io.TimeToSample{},
+		SampleToChunk: &mp4io.SampleToChunk{},
+		SampleSize:    &mp4io.SampleSize{},
+		ChunkOffset:   &mp4io.ChunkOffset{},
+	}
+
+	var duration int64
+	if offsets != nil {
+		duration = t.fillSampleTable(stbl)
+		stbl.ChunkOffset.Entries = offsets[t]
+	}
+	if duration > math.MaxInt32 {
+		return nil, 0, ErrTooLarge
+	}
+	d := t.toTime(duration)
+
+	trak := &mp4io.Track{
+		Header: &mp4io.TrackHeader{
+			TrackId:  int32(t.id),
+			Flags:    0x0003, // enabled, in movie
+			Duration: int32(int64(d) * movieTimeScale / int64(time.Second)),
+			Matrix:   [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		},
+		Media: &mp4io.Media{
+			Header: &mp4io.MediaHeader{
+				TimeScale: int32(t.timeScale),
+				Duration:  int32(duration),
+				Language:  21956, // und
+			},
+			Info: &mp4io.MediaInfo{
+				Sample: stbl,
+				Data: &mp4io.DataInfo{
+					Refer: &mp4io.DataRefer{
+						Url: &mp4io.DataReferUrl{
+							Flags: 0x000001, // self reference
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if offsets != nil && len(t.chunks) > 0 {
+		if edts := t.editList(d); edts != nil {
+			trak.Unknowns = append(trak.Unknowns, edts)
+		}
+	}
+
+	switch codec := t.codec.(type) {
+	case h264parser.CodecData:
+		stbl.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(codec.Width()),
+			Height:               int16(codec.Height()),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.AVC1Conf{Data: codec.AVCDecoderConfRecordBytes()},
+		}
+		setVideo(trak, codec.Width(), codec.Height())
+	case h265parser.CodecData:
+		stbl.SampleDesc.HV1Desc = &mp4io.HV1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(codec.Width()),
+			Height:               int16(codec.Height()),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.HV1Conf{Data: codec.AVCDecoderConfRecordBytes()},
+		}
+		setVideo(trak, codec.Width(), codec.Height())
+	case aacparser.CodecData:
+		stbl.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:       1,
+			NumberOfChannels: int16(codec.ChannelLayout().Count()),
+			SampleSize:       16,
+			SampleRate:       float64(codec.SampleRate()),
+			Conf: &mp4io.ElemStreamDesc{
+				DecConfig: codec.MPEG4AudioConfigBytes(),
+				TrackId:   uint16(t.id),
+			},
+		}
+		trak.Header.Volume = 1
+		trak.Header.AlternateGroup = 1
+		trak.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'s', 'o', 'u', 'n'},
+			Name:    []byte("SoundHandler"),
+		}
+		trak.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+	default:
+		return nil, 0, fmt.Errorf("fmp4: codec type=%v is not supported", t.codec.Type())
+	}
+
+	return trak, d, nil
+}
+
+// editList keeps the start time of the track and skips the composition
+// offset of the first sample, since the first sample of a progressive
+// file always starts at 0.
+func (t *track) editList(duration time.Duration) mp4io.Atom {
+	first := t.chunks[0].samples[0]
+	start := int64(t.toTime(first.dts)) * movieTimeScale / int64(time.Second)
+	if start <= 0 && first.cts == 0 {
+		return nil
+	}
+
+	var entries [][3]uint32 // segment duration, media time, rate
+	if start > 0 {
+		entries = append(entries, [3]uint32{uint32(start), math.MaxUint32, 1 << 16})
+	}
+	entries = append(entries, [3]uint32{uint32(int64(duration) * movieTimeScale / int64(time.Second)), first.cts, 1 << 16})
+
+	elstSize := 16 + 12*len(entries)
+	b := appendBox(nil, 8+elstSize, "edts")
+	b = appendBox(b, elstSize, "elst")
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+	for _, entry := range entries {
+		for _, v := range entry {
+			b = binary.BigEndian.AppendUint32(b, v)
+		}
+	}
+
+	return &mp4io.Dummy{Data: b, Tag_: mp4io.Tag(fourCC("edts"))}
+}
+
+func setVideo(trak *mp4io.Track, width int, height int) {
+	trak.Header.TrackWidth = float64(width)
+	trak.Header.TrackHeight = float64(height)
+	trak.Media.Handler = &mp4io.HandlerRefer{
+		SubType: [4]byte{'v', 'i', 'd', 'e'},
+		Name:    []byte("VideoHandler"),
+	}
+	trak.Media.Info.Video = &mp4io.VideoMediaInfo{
+		Flags: 0x000001,
+	}
+}
+
+// fillSampleTable fills stts, ctts, stss, stsc and stsz from the written
+// chunks and returns the duration in the track time scale.
+func (t *track) fillSampleTable(stbl *mp4io.SampleTable) int64 {
+	video := t.codec.Type().IsVideo()
+	if video {
+		stbl.CompositionOffset = &mp4io.CompositionOffset{}
+		stbl.SyncSample = &mp4io.SyncSample{}
+	}
+
+	var (
+		duration int64
+		index    uint32
+	)
+	for i, c := range t.chunks {
+		entries := stbl.SampleToChunk.Entries
+		if n := len(entries); n == 0 || entries[n-1].SamplesPerChunk != uint32(len(c.samples)) {
+			stbl.SampleToChunk.Entries = append(entries, mp4io.SampleToChunkEntry{
+				FirstChunk:      uint32(i + 1),
+				SamplesPerChunk: uint32(len(c.samples)),
+				SampleDescId:    1,
+			})
+		}
+
+		for _, s := range c.samples {
+			index++
+			duration += int64(s.duration)
+			stbl.SampleSize.Entries = append(stbl.SampleSize.Entries, s.size)
+
+			stts := stbl.TimeToSample.Entries
+			if n := len(stts); n > 0 && stts[n-1].Duration == s.duration {
+				stts[n-1].Count++
+			} else {
+				stbl.TimeToSample.Entries = append(stts, mp4io.TimeToSampleEntry{Count: 1, Duration: s.duration})
+			}
+
+			if !video {
+				continue
+			}
+			ctts := stbl.CompositionOffset.Entries
+			if n := len(ctts); n > 0 && ctts[n-1].Offset == s.cts {
+				ctts[n-1].Count++
+			} else {
+				stbl.CompositionOffset.Entries = append(ctts, mp4io.CompositionOffsetEntry{Count: 1, Offset: s.cts})
+			}
+			if s.key {
+				stbl.SyncSample.Entries = append(stbl.SyncSample.Entries, index)
+			}
+		}
+	}
+
+	return duration
+}
@@ -0,0 +1,219 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0x20, 0xf1, 0x83, 0x19, 0x60}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+// testStreams returns a H264 and an AAC stream.
+func testStreams(t *testing.T) []av.CodecData {
+	t.Helper()
+
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(testSPS, testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		SampleRate:    44100,
+		ChannelLayout: av.CH_STEREO,
+		ObjectType:    aacparser.AOT_AAC_LC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []av.CodecData{video, audio}
+}
+
+// testPackets returns interleaved 25fps AVCC video with a key frame every
+// 25 frames and 44.1kHz audio. Every packet has different data, so
+// misplaced chunks are detected.
+func testPackets(start time.Duration, duration time.Duration, video bool, audio bool, bframes bool) []av.Packet {
+	const frame = 40 * time.Millisecond
+	audioFrame := time.Second * 1024 / 44100
+
+	var (
+		pkts      []av.Packet
+		audioTime = start
+		audioIdx  = int8(1)
+	)
+	if !video {
+		audioIdx = 0
+	}
+	for i := 0; time.Duration(i)*frame < duration; i++ {
+		videoTime := start + time.Duration(i)*frame
+		for audio && audioTime < videoTime {
+			pkts = append(pkts, av.Packet{
+				Idx:  audioIdx,
+				Time: audioTime,
+				Data: []byte{0x21, 0x10, byte(len(pkts) >> 8), byte(len(pkts))},
+			})
+			audioTime += audioFrame
+		}
+		if !video {
+			continue
+		}
+
+		nalu := []byte{0x41, 0x9a, byte(i >> 8), byte(i), 0x80}
+		if i%25 == 0 {
+			nalu[0] = 0x65
+		}
+		pkt := av.Packet{
+			Idx:        0,
+			IsKeyFrame: i%25 == 0,
+			Time:       videoTime,
+			Data:       binary.BigEndian.AppendUint32(nil, uint32(len(nalu))),
+		}
+		pkt.Data = append(pkt.Data, nalu...)
+		if bframes {
+			pkt.CompositionTime = 2 * frame
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts
+}
+
+func TestWriteFaststart(t *testing.T) {
+	streams := testStreams(t)
+
+	tests := []struct {
+		name    string
+		streams []av.CodecData
+		pkts    []av.Packet
+	}{
+		{name: "video and audio", streams: streams, pkts: testPackets(0, 3*time.Second, true, true, false)},
+		{name: "b-frames", streams: streams, pkts: testPackets(0, 3*time.Second, true, true, true)},
+		{name: "start offset", streams: streams, pkts: testPackets(5*time.Second, 2*time.Second, true, true, false)},
+		{name: "video only", streams: streams[:1], pkts: testPackets(0, 2*time.Second, true, false, false)},
+		{name: "audio only", streams: streams[1:], pkts: testPackets(0, 3*time.Second, false, true, false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fragmented bytes.Buffer
+			muxer := NewMuxer(&fragmented)
+			if err := muxer.WriteHeader(tt.streams); err != nil {
+				t.Fatal(err)
+			}
+			for _, pkt := range tt.pkts {
+				if err := muxer.WritePacket(pkt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := muxer.WriteTrailer(); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err := muxer.WriteFaststart(bytes.NewReader(fragmented.Bytes()), &out); err != nil {
+				t.Fatal(err)
+			}
+
+			checkBoxes(t, out.Bytes(), []string{"ftyp", "moov", "mdat"})
+			comparePackets(t, tt.pkts, readPackets(t, out.Bytes()))
+		})
+	}
+}
+
+// checkBoxes checks the top level boxes, the last box ends at the end of the file.
+func checkBoxes(t *testing.T, b []byte, want []string) {
+	t.Helper()
+
+	var got []string
+	for pos := 0; pos < len(b); {
+		if len(b)-pos < 8 {
+			t.Fatalf("truncated box at %v", pos)
+		}
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		if size < 8 || pos+size > len(b) {
+			t.Fatalf("box %q at %v: size %v, file %v", b[pos+4:pos+8], pos, size, len(b))
+		}
+		got = append(got, string(b[pos+4:pos+8]))
+		pos += size
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("boxes %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("boxes %v, want %v", got, want)
+		}
+	}
+}
+
+// readPackets reads the progressive file, the data of every sample is
+// read at its chunk offset.
+func readPackets(t *testing.T, b []byte) []av.Packet {
+	t.Helper()
+
+	demuxer := mp4.NewDemuxer(bytes.NewReader(b))
+	if _, err := demuxer.Streams(); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkts []av.Packet
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+// comparePackets compares the packets of every stream, the times are
+// compared to the first packet of the stream.
+func comparePackets(t *testing.T, in []av.Packet, out []av.Packet) {
+	t.Helper()
+
+	byStream := func(pkts []av.Packet) map[int8][]av.Packet {
+		m := map[int8][]av.Packet{}
+		for _, pkt := range pkts {
+			m[pkt.Idx] = append(m[pkt.Idx], pkt)
+		}
+		return m
+	}
+
+	want, got := byStream(in), byStream(out)
+	if len(got) != len(want) {
+		t.Fatalf("got %v streams, want %v", len(got), len(want))
+	}
+	for idx, pkts := range want {
+		if len(got[idx]) != len(pkts) {
+			t.Fatalf("stream %v: got %v packets, want %v", idx, len(got[idx]), len(pkts))
+		}
+
+		for i, pkt := range got[idx] {
+			if !bytes.Equal(pkt.Data, pkts[i].Data) {
+				t.Fatalf("stream %v packet %v: data %x, want %x", idx, i, pkt.Data, pkts[i].Data)
+			}
+			if d := pkt.Time - got[idx][0].Time - (pkts[i].Time - pkts[0].Time); d < -time.Millisecond || d > time.Millisecond {
+				t.Fatalf("stream %v packet %v: time %v, want %v", idx, i, pkt.Time-got[idx][0].Time, pkts[i].Time-pkts[0].Time)
+			}
+			if d := pkt.CompositionTime - pkts[i].CompositionTime; d < -time.Millisecond || d > time.Millisecond {
+				t.Fatalf("stream %v packet %v: composition time %v, want %v", idx, i, pkt.CompositionTime, pkts[i].CompositionTime)
+			}
+			if idx == 0 && pkt.IsKeyFrame != pkts[i].IsKeyFrame {
+				t.Fatalf("stream %v packet %v: key frame %v, want %v", idx, i, pkt.IsKeyFrame, pkts[i].IsKeyFrame)
+			}
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/mp4/mp4io"
+)
+
+const (
+	videoTimeScale = 90000
+
+	// audioFragment is the fragment duration of files without video,
+	// which have no key frames to cut at.
+	audioFragment = time.Second
+
+	sampleFlagsSync    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	trunDataOffset     = 0x000001
+	trunSampleDuration = 0x000100
+	trunSampleSize     = 0x000200
+	trunSampleFlags    = 0x000400
+	trunSampleCts      = 0x000800
+)
+
+// sample is an access unit. Data is only kept until the fragment is written.
+type sample struct {
+	dts      int64 // track time scale
+	duration uint32
+	cts      uint32
+	size     uint32
+	key      bool
+	data     []byte
+}
+
+// chunk is the samples of one track in one fragment, stored contiguously
+// in the file.
+type chunk struct {
+	offset  int64
+	size    int64
+	samples []sample
+}
+
+// track is a supported stream of the Muxer.
+type track struct {
+	id        uint32
+	codec     av.CodecData
+	timeScale int64
+
+	pending *sample  // last sample, its duration is known with the next one
+	samples []sample // complete samples of the current fragment
+	chunks  []chunk  // written fragments, used by WriteFaststart
+}
+
+// Muxer writes H264, H265 and AAC packets into a fragmented MP4 file,
+// one moof/mdat pair per GOP. Every fragment is written with a single
+// Write as soon as it is complete, so a file that is cut off by a crash
+// stays playable up to its last fragment.
+// It implements av.Muxer.
+type Muxer struct {
+	w      io.Writer
+	pos    int64
+	seq    uint32
+	tracks []*track // indexed by av.Packet.Idx, nil for unsupported streams
+	video  *track
+}
+
+// NewMuxer allocates a Muxer.
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w: w,
+	}
+}
+
+// WriteHeader writes ftyp and an empty moov.
+// Streams with an unsupported codec are ignored.
+func (e *Muxer) WriteHeader(streams []av.CodecData) error {
+	e.tracks = make([]*track, len(streams))
+
+	var count uint32
+	for i, codec := range streams {
+		t := &track{
+			codec: codec,
+		}
+
+		switch codec := codec.(type) {
+		case h264parser.CodecData, h265parser.CodecData:
+			if e.video != nil {
+				continue
+			}
+			t.timeScale = videoTimeScale
+			e.video = t
+		case aacparser.CodecData:
+			t.timeScale = int64(codec.SampleRate())
+		default:
+			continue
+		}
+
+		count++
+		t.id = count
+		e.tracks[i] = t
+	}
+
+	if count == 0 {
+		return fmt.Errorf("fmp4: no supported stream")
+	}
+
+	moov, err := e.movie(nil)
+	if err != nil {
+		return err
+	}
+
+	ftyp := &mp4io.FileType{
+		MajorBrand:       fourCC("iso5"),
+		MinorVersion:     512,
+		CompatibleBrands: []uint32{fourCC("iso5"), fourCC("iso6"), fourCC("mp41")},
+	}
+
+	b := make([]byte, ftyp.Len()+moov.Len())
+	n := ftyp.Marshal(b)
+	moov.Marshal(b[n:])
+
+	return e.write(b)
+}
+
+// WritePacket buffers a packet. Video packets are expected in AVCC or
+// Annex-B format, packets with the same timestamp are joined into one
+// sample; parameter sets are dropped since they are in the sample
+// description. The current fragment is written when a video key frame
+// arrives.
+func (e *Muxer) WritePacket(pkt av.Packet) error {
+	if pkt.Idx < 0 || int(pkt.Idx) >= len(e.tracks) || e.tracks[pkt.Idx] == nil {
+		return nil
+	}
+	t := e.tracks[pkt.Idx]
+
+	data := pkt.Data
+	if t == e.video {
+		if data = t.marshalVideo(pkt.Data); len(data) == 0 {
+			return nil
+		}
+	}
+
+	dts := t.toScale(pkt.Time)
+	if t == e.video && t.pending != nil && t.pending.dts == dts {
+		t.pending.data = append(t.pending.data, data...)
+		t.pending.size = uint32(len(t.pending.data))
+		t.pending.key = t.pending.key || pkt.IsKeyFrame
+		return nil
+	}
+
+	if t.pending != nil {
+		duration := dts - t.pending.dts
+		if duration < 0 {
+			duration = 0
+		}
+		t.pending.duration = uint32(duration)
+		t.samples = append(t.samples, *t.pending)
+		t.pending = nil
+	}
+
+	if e.fragmentReady(t, pkt) {
+		if err := e.writeFragment(); err != nil {
+			return err
+		}
+	}
+
+	cts := t.toScale(pkt.CompositionTime)
+	if cts < 0 {
+		cts = 0
+	}
+	t.pending = &sample{
+		dts:  dts,
+		cts:  uint32(cts),
+		size: uint32(len(data)),
+		key:  pkt.IsKeyFrame || t != e.video,
+		data: append([]byte(nil), data...),
+	}
+
+	return nil
+}
+
+// fragmentReady returns whether the buffered samples are a complete GOP.
+func (e *Muxer) fragmentReady(t *track, pkt av.Packet) bool {
+	if e.video != nil {
+		return t == e.video && pkt.IsKeyFrame && len(t.samples) > 0
+	}
+
+	if len(t.samples) == 0 {
+		return false
+	}
+	return pkt.Time-t.toTime(t.samples[0].dts) >= audioFragment
+}
+
+// WriteTrailer writes the remaining samples. The last sample of every
+// track gets the duration of the previous one.
+func (e *Muxer) WriteTrailer() error {
+	for _, t := range e.tracks {
+		if t == nil || t.pending == nil {
+			continue
+		}
+
+		if n := len(t.samples); n > 0 {
+			t.pending.duration = t.samples[n-1].duration
+		} else if n := len(t.chunks); n > 0 {
+			last := t.chunks[n-1].samples
+			t.pending.duration = last[len(last)-1].duration
+		}
+		t.samples = append(t.samples, *t.pending)
+		t.pending = nil
+	}
+
+	return e.writeFragment()
+}
+
+// writeFragment writes the complete samples of all tracks as moof and mdat.
+func (e *Muxer) writeFragment() error {
+	var (
+		tracks   []*track
+		moofSize = 8 + 16
+		dataSize = 8
+	)
+	for _, t := range e.tracks {
+		if t == nil || len(t.samples) == 0 {
+			continue
+		}
+		tracks = append(tracks, t)
+		moofSize += t.trafSize()
+		for _, s := range t.samples {
+			dataSize += len(s.data)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	e.seq++
+
+	b := make([]byte, 0, moofSize+dataSize)
+	b = appendBox(b, moofSize, "moof")
+	b = appendBox(b, 16, "mfhd")
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, e.seq)
+
+	offset := moofSize + 8
+	for _, t := range tracks {
+		b = t.appendTraf(b, offset)
+
+		size := 0
+		for _, s := range t.samples {
+			size += len(s.data)
+		}
+		offset += size
+	}
+
+	b = appendBox(b, dataSize, "mdat")
+	offset = moofSize + 8
+	for _, t := range tracks {
+		c := chunk{
+			offset: e.pos + int64(offset),
+		}
+		for _, s := range t.samples {
+			b = append(b, s.data...)
+			c.size += int64(len(s.data))
+
+			s.data = nil
+			c.samples = append(c.samples, s)
+		}
+		offset += int(c.size)
+
+		t.chunks = append(t.chunks, c)
+		t.samples = t.samples[:0]
+	}
+
+	return e.write(b)
+}
+
+func (e *Muxer) write(b []byte) error {
+	n, err := e.w.Write(b)
+	e.pos += int64(n)
+	return err
+}
+
+// trafSize is the size of the traf box of the complete samples.
+func (t *track) trafSize() int {
+	return 8 + 16 + 20 + 20 + len(t.samples)*t.entrySize()
+}
+
+func (t *track) entrySize() int {
+	if t.codec.Type().IsVideo() {
+		return 16
+	}
+	return 12
+}
+
+// appendTraf appends tfhd, tfdt and trun, dataOffset is relative to moof.
+func (t *track) appendTraf(b []byte, dataOffset int) []byte {
+	flags := trunDataOffset | trunSampleDuration | trunSampleSize | trunSampleFlags
+	if t.codec.Type().IsVideo() {
+		flags |= trunSampleCts
+	}
+
+	b = appendBox(b, t.trafSize(), "traf")
+
+	b = appendBox(b, 16, "tfhd")
+	b = binary.BigEndian.AppendUint32(b, tfhdDefaultBaseIsMoof)
+	b = binary.BigEndian.AppendUint32(b, t.id)
+
+	b = appendBox(b, 20, "tfdt")
+	b = binary.BigEndian.AppendUint32(b, 1<<24)
+	b = binary.BigEndian.AppendUint64(b, uint64(t.samples[0].dts))
+
+	b = appendBox(b, 20+len(t.samples)*t.entrySize(), "trun")
+	b = binary.BigEndian.AppendUint32(b, uint32(flags))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(t.samples)))
+	b = binary.BigEndian.AppendUint32(b, uint32(dataOffset))
+	for _, s := range t.samples {
+		b = binary.BigEndian.AppendUint32(b, s.duration)
+		b = binary.BigEndian.AppendUint32(b, s.size)
+		if s.key {
+			b = binary.BigEndian.AppendUint32(b, sampleFlagsSync)
+		} else {
+			b = binary.BigEndian.AppendUint32(b, sampleFlagsNonSync)
+		}
+		if flags&trunSampleCts != 0 {
+			b = binary.BigEndian.AppendUint32(b, s.cts)
+		}
+	}
+
+	return b
+}
+
+// marshalVideo converts a packet into AVCC, dropping parameter sets
+// and access unit delimiters.
+func (t *track) marshalVideo(data []byte) []byte {
+	nalus, _ := h264parser.SplitNALUs(data)
+
+	out := make([]byte, 0, len(data)+4)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || isParameterSet(t.codec.Type(), nalu) {
+			continue
+		}
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nalu)))
+		out = append(out, nalu...)
+	}
+
+	return out
+}
+
+func isParameterSet(codecType av.CodecType, nalu []byte) bool {
+	if codecType == av.H265 {
+		switch (nalu[0] >> 1) & 0x3f {
+		case h265parser.NAL_UNIT_VPS, h265parser.NAL_UNIT_SPS, h265parser.NAL_UNIT_PPS, h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER:
+			return true
+		}
+		return false
+	}
+
+	switch nalu[0] & 0x1f {
+	case h264parser.NALU_SPS, h264parser.NALU_PPS, h264parser.NALU_AUD:
+		return true
+	}
+	return false
+}
+
+func (t *track) toScale(d time.Duration) int64 {
+	return int64(d) * t.timeScale / int64(time.Second)
+}
+
+func (t *track) toTime(ts int64) time.Duration {
+	return time.Duration(ts * int64(time.Second) / t.timeScale)
+}
+
+func appendBox(b []byte, size int, typ string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	return append(b, typ...)
+}
+
+func fourCC(s string) uint32 {
+	return binary.BigEndian.Uint32([]byte(s))
+}
@@ -0,0 +1,431 @@
+package mpegts
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/asticode/go-astits"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+const (
+	// maxProbePES is the number of PES packets read by Streams() while
+	// waiting for the codec parameters of every track.
+	maxProbePES = 1000
+
+	timestampBits = 33
+)
+
+// demuxerTrack is an elementary stream of the Demuxer.
+type demuxerTrack struct {
+	pid        uint16
+	streamType astits.StreamType
+	idx        int
+	codec      av.CodecData
+
+	vps []byte
+	sps []byte
+	pps []byte
+
+	// last DTS of the track, audio and video wrap around at different packets
+	hasLast bool
+	lastRaw int64
+	last    int64
+}
+
+// demuxerPacket is a packet whose timestamps are still in 90kHz ticks.
+type demuxerPacket struct {
+	track *demuxerTrack
+	pkt   av.Packet
+	dts   int64
+	pts   int64
+}
+
+// Demuxer reads H264, H265 and AAC packets from a MPEG-TS stream.
+// It implements av.Demuxer. Video packets are returned in AVCC format,
+// audio packets as raw AAC frames.
+type Demuxer struct {
+	dmx *astits.Demuxer
+
+	tracks  map[uint16]*demuxerTrack
+	streams []av.CodecData
+	probed  bool
+	pending []*demuxerPacket
+
+	hasBase bool
+	base    int64
+
+	// last DTS of any track, the first timestamp of a track is unwrapped against it
+	hasLast bool
+	lastRaw int64
+	last    int64
+}
+
+// NewDemuxer allocates a Demuxer.
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		dmx: astits.NewDemuxer(context.Background(), r),
+	}
+}
+
+// Streams reads PAT/PMT and enough PES packets to know the codec
+// parameters of every supported track.
+func (d *Demuxer) Streams() ([]av.CodecData, error) {
+	if d.probed {
+		return d.streams, nil
+	}
+
+	if err := d.probe(); err != nil {
+		return nil, err
+	}
+
+	return d.streams, nil
+}
+
+// ReadPacket reads the next packet.
+func (d *Demuxer) ReadPacket() (av.Packet, error) {
+	if !d.probed {
+		if err := d.probe(); err != nil {
+			return av.Packet{}, err
+		}
+	}
+
+	for len(d.pending) == 0 {
+		if err := d.readPES(); err != nil {
+			return av.Packet{}, err
+		}
+	}
+
+	p := d.pending[0]
+	d.pending = d.pending[1:]
+
+	return d.toPacket(p), nil
+}
+
+func (d *Demuxer) probe() error {
+	// PMT
+	for d.tracks == nil {
+		data, err := d.nextData()
+		if err != nil {
+			return err
+		}
+
+		if data.PMT == nil {
+			continue
+		}
+
+		d.tracks = map[uint16]*demuxerTrack{}
+		for _, es := range data.PMT.ElementaryStreams {
+			switch es.StreamType {
+			case astits.StreamTypeH264Video, astits.StreamTypeH265Video, astits.StreamTypeAACAudio:
+				d.tracks[es.ElementaryPID] = &demuxerTrack{
+					pid:        es.ElementaryPID,
+					streamType: es.StreamType,
+					idx:        -1,
+				}
+			}
+		}
+
+		if len(d.tracks) == 0 {
+			return fmt.Errorf("mpegts: no supported stream")
+		}
+	}
+
+	// codec parameters
+	for i := 0; i < maxProbePES && !d.isAllCodecReady(); i++ {
+		if err := d.readPES(); err != nil {
+			return err
+		}
+	}
+
+	// tracks keep the PMT order, those without parameters are dropped
+	for pid, track := range d.tracks {
+		if track.codec == nil {
+			delete(d.tracks, pid)
+		}
+	}
+	if len(d.tracks) == 0 {
+		return fmt.Errorf("mpegts: codec parameters not found")
+	}
+
+	for pid := 0; pid <= 0x1fff; pid++ {
+		if track, ok := d.tracks[uint16(pid)]; ok {
+			track.idx = len(d.streams)
+			d.streams = append(d.streams, track.codec)
+		}
+	}
+
+	// the earliest buffered timestamp becomes zero
+	var pending []*demuxerPacket
+	for _, p := range d.pending {
+		if p.track.codec == nil {
+			continue
+		}
+		if !d.hasBase || p.dts < d.base {
+			d.base = p.dts
+			d.hasBase = true
+		}
+		pending = append(pending, p)
+	}
+	d.pending = pending
+	d.probed = true
+
+	return nil
+}
+
+func (d *Demuxer) isAllCodecReady() bool {
+	for _, track := range d.tracks {
+		if track.codec == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Demuxer) nextData() (*astits.DemuxerData, error) {
+	data, err := d.dmx.NextData()
+	if err != nil {
+		if errors.Is(err, astits.ErrNoMorePackets) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readPES reads the next PES of a known track and appends its packets to pending.
+func (d *Demuxer) readPES() error {
+	for {
+		data, err := d.nextData()
+		if err != nil {
+			return err
+		}
+
+		if data.PES == nil || data.PES.Header == nil || data.PES.Header.OptionalHeader == nil {
+			continue
+		}
+
+		track, ok := d.tracks[data.PID]
+		if !ok {
+			continue
+		}
+
+		oh := data.PES.Header.OptionalHeader
+		if oh.PTS == nil {
+			continue
+		}
+
+		rawDts := oh.PTS.Base
+		if oh.DTS != nil {
+			rawDts = oh.DTS.Base
+		}
+		dts := d.unwrap(track, rawDts)
+		pts := dts + wrapDelta(rawDts, oh.PTS.Base)
+
+		switch track.streamType {
+		case astits.StreamTypeH264Video:
+			d.onH264(track, data.PES.Data, dts, pts)
+		case astits.StreamTypeH265Video:
+			d.onH265(track, data.PES.Data, dts, pts)
+		case astits.StreamTypeAACAudio:
+			d.onAAC(track, data.PES.Data, pts)
+		}
+
+		return nil
+	}
+}
+
+func (d *Demuxer) onH264(track *demuxerTrack, data []byte, dts, pts int64) {
+	nalus, _ := h264parser.SplitNALUs(data)
+
+	var (
+		out        [][]byte
+		isKeyFrame bool
+	)
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			track.sps = append([]byte(nil), nalu...)
+		case h264parser.NALU_PPS:
+			track.pps = append([]byte(nil), nalu...)
+		case h264parser.NALU_AUD:
+		case 5: // IDR
+			isKeyFrame = true
+			out = append(out, nalu)
+		default:
+			out = append(out, nalu)
+		}
+	}
+
+	if track.codec == nil && track.sps != nil && track.pps != nil {
+		if codec, err := h264parser.NewCodecDataFromSPSAndPPS(track.sps, track.pps); err == nil {
+			track.codec = codec
+		}
+	}
+
+	d.appendVideo(track, out, isKeyFrame, dts, pts)
+}
+
+func (d *Demuxer) onH265(track *demuxerTrack, data []byte, dts, pts int64) {
+	nalus, _ := h265parser.SplitNALUs(data)
+
+	var (
+		out        [][]byte
+		isKeyFrame bool
+	)
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		typ := (nalu[0] >> 1) & 0x3f
+		switch {
+		case typ == h265parser.NAL_UNIT_VPS:
+			track.vps = append([]byte(nil), nalu...)
+		case typ == h265parser.NAL_UNIT_SPS:
+			track.sps = append([]byte(nil), nalu...)
+		case typ == h265parser.NAL_UNIT_PPS:
+			track.pps = append([]byte(nil), nalu...)
+		case typ == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER:
+		case typ >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && typ <= h265parser.NAL_UNIT_CODED_SLICE_CRA:
+			isKeyFrame = true
+			out = append(out, nalu)
+		default:
+			out = append(out, nalu)
+		}
+	}
+
+	if track.codec == nil && track.vps != nil && track.sps != nil && track.pps != nil {
+		if codec, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(track.vps, track.sps, track.pps); err == nil {
+			track.codec = codec
+		}
+	}
+
+	d.appendVideo(track, out, isKeyFrame, dts, pts)
+}
+
+func (d *Demuxer) appendVideo(track *demuxerTrack, nalus [][]byte, isKeyFrame bool, dts, pts int64) {
+	// nothing can be decoded before the parameters are known
+	if track.codec == nil || len(nalus) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, nalu := range nalus {
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(nalu)))
+		buf.Write(nalu)
+	}
+
+	d.pending = append(d.pending, &demuxerPacket{
+		track: track,
+		pkt: av.Packet{
+			IsKeyFrame: isKeyFrame,
+			Data:       buf.Bytes(),
+		},
+		dts: dts,
+		pts: pts,
+	})
+}
+
+func (d *Demuxer) onAAC(track *demuxerTrack, data []byte, pts int64) {
+	for i := 0; len(data) > 0; i++ {
+		config, hdrLen, frameLen, samples, err := aacparser.ParseADTSHeader(data)
+		if err != nil || frameLen > len(data) {
+			return
+		}
+
+		if track.codec == nil {
+			codec, err := aacparser.NewCodecDataFromMPEG4AudioConfig(config)
+			if err != nil {
+				return
+			}
+			track.codec = codec
+		}
+
+		sampleRate := int64(config.SampleRate)
+		if sampleRate <= 0 {
+			return
+		}
+
+		// frames of the same PES follow each other
+		ts := pts + int64(i*samples)*90000/sampleRate
+
+		d.pending = append(d.pending, &demuxerPacket{
+			track: track,
+			pkt: av.Packet{
+				Data:     append([]byte(nil), data[hdrLen:frameLen]...),
+				Duration: time.Duration(samples) * time.Second / time.Duration(sampleRate),
+			},
+			dts: ts,
+			pts: ts,
+		})
+
+		data = data[frameLen:]
+	}
+}
+
+// unwrap removes the 33 bit wrap around of the DTS of a track. Every track
+// keeps its own state, the first DTS of a track continues from the last
+// DTS of any track so that all tracks stay on the same time line.
+func (d *Demuxer) unwrap(track *demuxerTrack, raw int64) int64 {
+	if !track.hasLast {
+		track.hasLast = true
+		track.lastRaw = raw
+		track.last = raw
+		if d.hasLast {
+			track.last = d.last + wrapDelta(d.lastRaw, raw)
+		}
+	} else {
+		track.last += wrapDelta(track.lastRaw, raw)
+		track.lastRaw = raw
+	}
+
+	d.hasLast = true
+	d.lastRaw = raw
+	d.last = track.last
+
+	return track.last
+}
+
+// wrapDelta is to - from, assuming they are less than half the 33 bit range apart.
+func wrapDelta(from int64, to int64) int64 {
+	const mask = 1<<timestampBits - 1
+
+	delta := (to - from) & mask
+	if delta > mask/2 {
+		delta -= mask + 1
+	}
+	return delta
+}
+
+func (d *Demuxer) toPacket(p *demuxerPacket) av.Packet {
+	if !d.hasBase {
+		d.base = p.dts
+		d.hasBase = true
+	}
+
+	pkt := p.pkt
+	pkt.Idx = int8(p.track.idx)
+	pkt.Time = ticksToDuration(p.dts - d.base)
+	pkt.CompositionTime = ticksToDuration(p.pts - p.dts)
+
+	return pkt
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks*100/9) * time.Microsecond
+}
@@ -0,0 +1,188 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0x20, 0xf1, 0x83, 0x19, 0x60}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+// testStreams returns a H264 and an AAC stream.
+func testStreams(t *testing.T) []av.CodecData {
+	t.Helper()
+
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(testSPS, testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		SampleRate:    44100,
+		ChannelLayout: av.CH_STEREO,
+		ObjectType:    aacparser.AOT_AAC_LC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []av.CodecData{video, audio}
+}
+
+// testPackets returns interleaved 25fps video and 44.1kHz audio packets
+// of the given duration, starting at start. Every 25th video packet is a
+// key frame, the video frames are AVCC.
+func testPackets(start time.Duration, duration time.Duration, bframes bool) []av.Packet {
+	const (
+		frame      = 40 * time.Millisecond
+		audioFrame = time.Second * 1024 / 44100
+	)
+
+	var (
+		pkts      []av.Packet
+		audioTime = start
+	)
+	for i := 0; time.Duration(i)*frame < duration; i++ {
+		videoTime := start + time.Duration(i)*frame
+		for audioTime < videoTime {
+			pkts = append(pkts, av.Packet{
+				Idx:  1,
+				Time: audioTime,
+				Data: []byte{0x21, 0x10, 0x04, byte(len(pkts))},
+			})
+			audioTime += audioFrame
+		}
+
+		nalu := []byte{0x41, 0x9a, byte(i), 0x80}
+		if i%25 == 0 {
+			nalu = []byte{0x65, 0x88, byte(i), 0x80}
+		}
+		pkt := av.Packet{
+			Idx:        0,
+			IsKeyFrame: i%25 == 0,
+			Time:       videoTime,
+			Data:       append([]byte{0, 0, 0, byte(len(nalu))}, nalu...),
+		}
+		if bframes {
+			pkt.CompositionTime = 2 * frame
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts
+}
+
+// roundTrip muxes pkts and demuxes the result.
+func roundTrip(t *testing.T, streams []av.CodecData, pkts []av.Packet) []av.Packet {
+	t.Helper()
+
+	var b bytes.Buffer
+	muxer := NewMuxer(&b)
+	if err := muxer.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	demuxer := NewDemuxer(&b)
+	if _, err := demuxer.Streams(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []av.Packet
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, pkt)
+	}
+}
+
+// TestDemuxerWrap audio and video wrap around at different packets
+func TestDemuxerWrap(t *testing.T) {
+	// 33 bit of 90kHz ticks
+	wrap := time.Duration(1<<timestampBits) * time.Second / 90000
+
+	tests := []struct {
+		name  string
+		start time.Duration
+		skew  time.Duration // audio timestamps are shifted, the tracks are only compared on their own
+	}{
+		{name: "no wrap", start: time.Hour},
+		{name: "wrap", start: wrap - 500*time.Millisecond},
+		{name: "wrap between tracks", start: wrap - 41*time.Millisecond},
+		{name: "tracks far apart", start: wrap - time.Second, skew: 14 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts := testPackets(tt.start, 2*time.Second, true)
+			for i := range pkts {
+				if pkts[i].Idx == 1 {
+					pkts[i].Time += tt.skew
+				}
+			}
+
+			out := roundTrip(t, testStreams(t), pkts)
+			comparePackets(t, pkts, out, tt.skew == 0)
+		})
+	}
+}
+
+// comparePackets compares the packets of every stream, the demuxer starts
+// at 0 and may return the streams in a different order. Without aligned
+// the times are compared to the first packet of the stream.
+func comparePackets(t *testing.T, in []av.Packet, out []av.Packet, aligned bool) {
+	t.Helper()
+
+	byStream := func(pkts []av.Packet) map[int8][]av.Packet {
+		m := map[int8][]av.Packet{}
+		for _, pkt := range pkts {
+			m[pkt.Idx] = append(m[pkt.Idx], pkt)
+		}
+		return m
+	}
+
+	want, got := byStream(in), byStream(out)
+	for idx, pkts := range want {
+		if len(got[idx]) != len(pkts) {
+			t.Fatalf("stream %v: got %v packets, want %v", idx, len(got[idx]), len(pkts))
+		}
+
+		base, gotBase := in[0].Time, time.Duration(0)
+		if !aligned {
+			base, gotBase = pkts[0].Time, got[idx][0].Time
+		}
+		for i, pkt := range got[idx] {
+			if d := pkt.Time - gotBase - (pkts[i].Time - base); d < -time.Millisecond || d > time.Millisecond {
+				t.Fatalf("stream %v packet %v: time %v, want %v", idx, i, pkt.Time-gotBase, pkts[i].Time-base)
+			}
+			if d := pkt.CompositionTime - pkts[i].CompositionTime; d < -time.Millisecond || d > time.Millisecond {
+				t.Fatalf("stream %v packet %v: composition time %v, want %v", idx, i, pkt.CompositionTime, pkts[i].CompositionTime)
+			}
+			if pkt.IsKeyFrame != pkts[i].IsKeyFrame && idx == 0 {
+				t.Fatalf("stream %v packet %v: key frame %v, want %v", idx, i, pkt.IsKeyFrame, pkts[i].IsKeyFrame)
+			}
+			if !bytes.Equal(pkt.Data, pkts[i].Data) {
+				t.Fatalf("stream %v packet %v: data %x, want %x", idx, i, pkt.Data, pkts[i].Data)
+			}
+		}
+	}
+}
@@ -3,162 +3,286 @@ package mpegts
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"time"
 
-	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/asticode/go-astits"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
 )
 
-// Muxer allows to save a H264 stream into a MPEG-TS file.
+const (
+	// firstPID is the PID of the first elementary stream, the following
+	// streams get consecutive PIDs.
+	firstPID = 256
+
+	streamIDVideo = 224
+	streamIDAudio = 192
+)
+
+var (
+	h264AUD = []byte{0x09, 0xf0}
+	h265AUD = []byte{0x46, 0x01, 0x50}
+)
+
+// muxerStream is an elementary stream of the Muxer.
+type muxerStream struct {
+	pid      uint16
+	streamID uint8
+	codec    av.CodecData
+}
+
+// Muxer writes H264, H265 and AAC packets into a MPEG-TS stream.
+// It implements av.Muxer, so it can be used with avutil.CopyFile.
 type Muxer struct {
-	sps []byte
-	pps []byte
-
-	b                *bufio.Writer
-	mux              *astits.Muxer
-	dtsExtractor     *h264.DTSExtractor
-	firstIDRReceived bool
-	startDTS         time.Duration
+	b       *bufio.Writer
+	mux     *astits.Muxer
+	pcrPID  uint16
+	streams []*muxerStream
 }
 
 // NewMuxer allocates a Muxer.
-func NewMuxer(w io.Writer, sps []byte, pps []byte) *Muxer {
+func NewMuxer(w io.Writer) *Muxer {
 	b := bufio.NewWriter(w)
 
-	mux := astits.NewMuxer(context.Background(), b)
-	mux.AddElementaryStream(astits.PMTElementaryStream{
-		ElementaryPID: 256,
-		StreamType:    astits.StreamTypeH264Video,
-	})
-	mux.SetPCRPID(256)
-
 	return &Muxer{
-		sps: sps,
-		pps: pps,
 		b:   b,
-		mux: mux,
+		mux: astits.NewMuxer(context.Background(), b),
 	}
 }
 
-// Close closes all the Muxer resources.
-func (e *Muxer) Close() {
-	_ = e.b.Flush()
-}
-
-// Encode encodes H264 NALUs into MPEG-TS.
-func (e *Muxer) Encode(nalus [][]byte, pts time.Duration) error {
-	// prepend an AUD. This is required by some players
-	filteredNALUs := [][]byte{
-		{byte(h264.NALUTypeAccessUnitDelimiter), 240},
-	}
+// WriteHeader allocates one PID per stream and writes PAT/PMT.
+// Streams with an unsupported codec are ignored.
+func (e *Muxer) WriteHeader(streams []av.CodecData) error {
+	e.streams = make([]*muxerStream, len(streams))
 
-	nonIDRPresent := false
-	idrPresent := false
+	for i, codec := range streams {
+		var (
+			streamType astits.StreamType
+			streamID   uint8
+		)
 
-	for _, nalu := range nalus {
-		typ := h264.NALUType(nalu[0] & 0x1F)
-		switch typ {
-		case h264.NALUTypeSPS:
-			e.sps = append([]byte(nil), nalu...)
-			continue
-
-		case h264.NALUTypePPS:
-			e.pps = append([]byte(nil), nalu...)
+		switch codec.Type() {
+		case av.H264:
+			streamType, streamID = astits.StreamTypeH264Video, streamIDVideo
+		case av.H265:
+			streamType, streamID = astits.StreamTypeH265Video, streamIDVideo
+		case av.AAC:
+			streamType, streamID = astits.StreamTypeAACAudio, streamIDAudio
+		default:
 			continue
+		}
 
-		case h264.NALUTypeAccessUnitDelimiter:
-			continue
-
-		case h264.NALUTypeIDR:
-			idrPresent = true
-
-		case h264.NALUTypeNonIDR:
-			nonIDRPresent = true
+		stream := &muxerStream{
+			pid:      uint16(firstPID + i),
+			streamID: streamID,
+			codec:    codec,
 		}
 
-		filteredNALUs = append(filteredNALUs, nalu)
-	}
+		err := e.mux.AddElementaryStream(astits.PMTElementaryStream{
+			ElementaryPID: stream.pid,
+			StreamType:    streamType,
+		})
+		if err != nil {
+			return err
+		}
 
-	nalus = filteredNALUs
+		// prefer a video stream as PCR carrier
+		if e.pcrPID == 0 || (codec.Type().IsVideo() && !e.isVideoPID(e.pcrPID)) {
+			e.pcrPID = stream.pid
+		}
 
-	if !nonIDRPresent && !idrPresent {
-		return nil
+		e.streams[i] = stream
 	}
 
-	// add SPS and PPS before every group that contains an IDR
-	if idrPresent {
-		nalus = append([][]byte{e.sps, e.pps}, nalus...)
+	if e.pcrPID == 0 {
+		return fmt.Errorf("mpegts: no supported stream")
 	}
 
-	var dts time.Duration
+	e.mux.SetPCRPID(e.pcrPID)
 
-	if !e.firstIDRReceived {
-		// skip samples silently until we find one with a IDR
-		if !idrPresent {
-			return nil
-		}
+	if _, err := e.mux.WriteTables(); err != nil {
+		return err
+	}
 
-		e.firstIDRReceived = true
-		e.dtsExtractor = h264.NewDTSExtractor()
+	return nil
+}
 
-		var err error
-		dts, err = e.dtsExtractor.Extract(nalus, pts)
-		if err != nil {
-			return err
+func (e *Muxer) isVideoPID(pid uint16) bool {
+	for _, stream := range e.streams {
+		if stream != nil && stream.pid == pid {
+			return stream.codec.Type().IsVideo()
 		}
+	}
+	return false
+}
 
-		e.startDTS = dts
-		dts = 0
-		pts -= e.startDTS
+// WritePacket writes a packet. Video packets are expected in AVCC or
+// Annex-B format, audio packets as raw AAC frames.
+func (e *Muxer) WritePacket(pkt av.Packet) error {
+	if pkt.Idx < 0 || int(pkt.Idx) >= len(e.streams) || e.streams[pkt.Idx] == nil {
+		return nil
+	}
+	stream := e.streams[pkt.Idx]
 
-	} else {
-		var err error
-		dts, err = e.dtsExtractor.Extract(nalus, pts)
-		if err != nil {
-			return err
-		}
+	var (
+		data []byte
+		err  error
+	)
 
-		dts -= e.startDTS
-		pts -= e.startDTS
+	switch codec := stream.codec.(type) {
+	case h264parser.CodecData:
+		data = marshalH264(codec, pkt)
+	case h265parser.CodecData:
+		data = marshalH265(codec, pkt)
+	case aacparser.CodecData:
+		data = marshalADTS(codec, pkt.Data)
+	default:
+		return nil
 	}
 
+	dts := pkt.Time
+	pts := pkt.Time + pkt.CompositionTime
+
 	oh := &astits.PESOptionalHeader{
 		MarkerBits: 2,
 	}
 
-	if dts == pts {
+	if stream.codec.Type().IsAudio() || dts == pts {
 		oh.PTSDTSIndicator = astits.PTSDTSIndicatorOnlyPTS
-		oh.PTS = &astits.ClockReference{Base: int64(pts.Seconds() * 90000)}
+		oh.PTS = &astits.ClockReference{Base: durationToTicks(pts)}
 	} else {
 		oh.PTSDTSIndicator = astits.PTSDTSIndicatorBothPresent
-		oh.DTS = &astits.ClockReference{Base: int64(dts.Seconds() * 90000)}
-		oh.PTS = &astits.ClockReference{Base: int64(pts.Seconds() * 90000)}
+		oh.DTS = &astits.ClockReference{Base: durationToTicks(dts)}
+		oh.PTS = &astits.ClockReference{Base: durationToTicks(pts)}
 	}
 
-	// encode into Annex-B
-	annexb, err := h264.AnnexBMarshal(nalus)
-	if err != nil {
-		return err
+	var af *astits.PacketAdaptationField
+	if stream.pid == e.pcrPID {
+		af = &astits.PacketAdaptationField{
+			RandomAccessIndicator: pkt.IsKeyFrame || stream.codec.Type().IsAudio(),
+			HasPCR:                true,
+			PCR:                   &astits.ClockReference{Base: durationToTicks(dts)},
+		}
+	} else if pkt.IsKeyFrame {
+		af = &astits.PacketAdaptationField{
+			RandomAccessIndicator: true,
+		}
 	}
 
-	// write TS packet
 	_, err = e.mux.WriteData(&astits.MuxerData{
-		PID: 256,
-		AdaptationField: &astits.PacketAdaptationField{
-			RandomAccessIndicator: idrPresent,
-		},
+		PID:             stream.pid,
+		AdaptationField: af,
 		PES: &astits.PESData{
 			Header: &astits.PESHeader{
 				OptionalHeader: oh,
-				StreamID:       224, // video
+				StreamID:       stream.streamID,
 			},
-			Data: annexb,
+			Data: data,
 		},
 	})
-	if err != nil {
+
+	return err
+}
+
+// WriteTrailer flushes buffered data.
+func (e *Muxer) WriteTrailer() error {
+	return e.b.Flush()
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (e *Muxer) Flush() error {
+	return e.b.Flush()
+}
+
+// SetWriter flushes buffered data and redirects the following output to w.
+// Timestamps and continuity counters are kept, so it can be used to cut
+// a continuous stream into segments.
+func (e *Muxer) SetWriter(w io.Writer) error {
+	if err := e.b.Flush(); err != nil {
 		return err
 	}
 
+	e.b.Reset(w)
 	return nil
 }
+
+// marshalH264 converts a packet into Annex-B, prepending an AUD and,
+// on key frames, SPS and PPS.
+func marshalH264(codec h264parser.CodecData, pkt av.Packet) []byte {
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+
+	out := [][]byte{h264AUD}
+	if pkt.IsKeyFrame && !hasNALU(nalus, func(nalu []byte) bool { return nalu[0]&0x1f == h264parser.NALU_SPS }) {
+		out = append(out, codec.SPS(), codec.PPS())
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || nalu[0]&0x1f == h264parser.NALU_AUD {
+			continue
+		}
+		out = append(out, nalu)
+	}
+
+	return annexBMarshal(out)
+}
+
+// marshalH265 converts a packet into Annex-B, prepending an AUD and,
+// on key frames, VPS, SPS and PPS.
+func marshalH265(codec h265parser.CodecData, pkt av.Packet) []byte {
+	nalus, _ := h265parser.SplitNALUs(pkt.Data)
+
+	out := [][]byte{h265AUD}
+	if pkt.IsKeyFrame && !hasNALU(nalus, func(nalu []byte) bool { return (nalu[0]>>1)&0x3f == h265parser.NAL_UNIT_SPS }) {
+		out = append(out, codec.VPS(), codec.SPS(), codec.PPS())
+	}
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || (nalu[0]>>1)&0x3f == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER {
+			continue
+		}
+		out = append(out, nalu)
+	}
+
+	return annexBMarshal(out)
+}
+
+func hasNALU(nalus [][]byte, match func(nalu []byte) bool) bool {
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && match(nalu) {
+			return true
+		}
+	}
+	return false
+}
+
+func annexBMarshal(nalus [][]byte) []byte {
+	n := 0
+	for _, nalu := range nalus {
+		n += 4 + len(nalu)
+	}
+
+	out := make([]byte, 0, n)
+	for _, nalu := range nalus {
+		out = append(out, 0x00, 0x00, 0x00, 0x01)
+		out = append(out, nalu...)
+	}
+
+	return out
+}
+
+// marshalADTS prepends an ADTS header to a raw AAC frame.
+func marshalADTS(codec aacparser.CodecData, frame []byte) []byte {
+	out := make([]byte, aacparser.ADTSHeaderLength+len(frame))
+	aacparser.FillADTSHeader(out, codec.Config, 1024, len(frame))
+	copy(out[aacparser.ADTSHeaderLength:], frame)
+
+	return out
+}
+
+func durationToTicks(d time.Duration) int64 {
+	return int64(d/time.Microsecond) * 9 / 100
+}
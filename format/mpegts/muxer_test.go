@@ -0,0 +1,106 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// onlyStream keeps the packets of stream idx and renumbers them to 0.
+func onlyStream(pkts []av.Packet, idx int8) []av.Packet {
+	var out []av.Packet
+	for _, pkt := range pkts {
+		if pkt.Idx == idx {
+			pkt.Idx = 0
+			out = append(out, pkt)
+		}
+	}
+	return out
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	streams := testStreams(t)
+
+	tests := []struct {
+		name    string
+		streams []av.CodecData
+		pkts    []av.Packet
+	}{
+		{name: "video and audio", streams: streams, pkts: testPackets(0, 3*time.Second, false)},
+		{name: "b-frames", streams: streams, pkts: testPackets(0, 3*time.Second, true)},
+		{name: "start offset", streams: streams, pkts: testPackets(10*time.Minute, time.Second, false)},
+		{name: "video only", streams: streams[:1], pkts: onlyStream(testPackets(0, 2*time.Second, true), 0)},
+		{name: "audio only", streams: streams[1:], pkts: onlyStream(testPackets(0, 2*time.Second, false), 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := roundTrip(t, tt.streams, tt.pkts)
+			comparePackets(t, tt.pkts, out, true)
+		})
+	}
+}
+
+// TestMuxerSetWriter segments written after SetWriter continue the stream,
+// their concatenation demuxes to the input.
+func TestMuxerSetWriter(t *testing.T) {
+	streams := testStreams(t)
+	pkts := testPackets(0, 3*time.Second, true)
+
+	var (
+		segments []*bytes.Buffer
+		b        = &bytes.Buffer{}
+		muxer    = NewMuxer(b)
+	)
+	segments = append(segments, b)
+	if err := muxer.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if pkt.IsKeyFrame && pkt.Time > 0 {
+			b = &bytes.Buffer{}
+			segments = append(segments, b)
+			if err := muxer.SetWriter(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 3 {
+		t.Fatalf("got %v segments, want 3", len(segments))
+	}
+
+	var all bytes.Buffer
+	for i, segment := range segments {
+		if segment.Len() == 0 || segment.Len()%188 != 0 {
+			t.Fatalf("segment %v: %v bytes", i, segment.Len())
+		}
+		all.Write(segment.Bytes())
+	}
+
+	demuxer := NewDemuxer(&all)
+	if _, err := demuxer.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	var out []av.Packet
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, pkt)
+	}
+	comparePackets(t, pkts, out, true)
+}
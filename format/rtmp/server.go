@@ -0,0 +1,46 @@
+// Package rtmp is a fork of github.com/deepch/vdk/format/rtmp v0.0.20 (MIT,
+// see LICENSE). rtmp.go only drops two unreachable returns for go vet, this
+// file exports what a server with its own listener needs: vdk's Server can
+// not close the listener and the server side of Conn can not be created
+// outside the package.
+package rtmp
+
+import (
+	"net"
+
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+// NewServerConn wraps an accepted connection, the handshake and the
+// connect/play/publish commands are handled by Prepare.
+func NewServerConn(netconn net.Conn) *Conn {
+	conn := NewConn(netconn)
+	conn.isserver = true
+	return conn
+}
+
+// IsPlaying reports whether the client sent play, valid after Prepare.
+func (self *Conn) IsPlaying() bool {
+	return self.playing
+}
+
+// IsPublishing reports whether the client sent publish, valid after Prepare.
+func (self *Conn) IsPublishing() bool {
+	return self.publishing
+}
+
+// WriteStatus sends an onStatus command on the stream of the last play or
+// publish command, e.g. to reject it after Prepare replied with Start.
+func (self *Conn) WriteStatus(level string, code string, description string) (err error) {
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", self.commandtransid, nil,
+		flvio.AMFMap{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		},
+	); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
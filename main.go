@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/general252/live/server"
 )
@@ -14,23 +17,53 @@ func init() {
 }
 
 func main() {
-	s := server.NewServer(&server.Option{
-		RtmpPort: 1935,
-		HttpPort: 8080,
-		RtspPort: 554,
-		RtpPort:  8000,
-		RtcpPort: 8001,
-	})
+	var configFile string
+	flag.StringVar(&configFile, "c", "", "yaml配置文件, 例如 config.yaml")
+	flag.Parse()
 
-	s.Serve()
+	option := server.DefaultOption()
+	if len(configFile) > 0 {
+		var err error
+		if option, err = server.LoadOption(configFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	s := server.NewServer(option)
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
 
 	quitChan := make(chan os.Signal, 2)
 	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-quitChan
+	for sig := range quitChan {
+		if sig != syscall.SIGHUP {
+			log.Printf("shutdown: %v", sig)
+			break
+		}
+
+		// kill -HUP 重新加载配置
+		if len(configFile) == 0 {
+			continue
+		}
+		if option, err := server.LoadOption(configFile); err != nil {
+			log.Println(err)
+		} else {
+			s.Reload(option)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
 
 	// ffmpeg -re -i movie.flv -c copy -f flv rtmp://localhost/movie
 	// ffmpeg -f avfoundation -i "0:0" .... -f flv rtmp://localhost/screen
 	// ffplay http://localhost:8089/movie
 	// ffplay http://localhost:8089/screen
+	// ffplay http://localhost:8080/hls/movie/index.m3u8
 }
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+func newRequest(connPath string, query url.Values) *server_interface.StreamRequest {
+	return server_interface.NewStreamRequest("rtmp", connPath, "127.0.0.1:1234", query)
+}
+
+func TestHmacSign(t *testing.T) {
+	const secret = "secret"
+	var (
+		now    = time.Now().Unix()
+		future = now + 60
+	)
+
+	tests := []struct {
+		name     string
+		action   Action
+		connPath string
+		query    url.Values
+		wantErr  bool
+	}{
+		{name: "valid", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", future)}, "expire": {strconv.FormatInt(future, 10)},
+		}},
+		{name: "expired", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", now-1)}, "expire": {strconv.FormatInt(now-1, 10)},
+		}, wantErr: true},
+		{name: "extended expire", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", now-1)}, "expire": {strconv.FormatInt(future, 10)},
+		}, wantErr: true},
+		{name: "other path", action: ActionPlay, connPath: "/live/cam2", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", future)}, "expire": {strconv.FormatInt(future, 10)},
+		}, wantErr: true},
+		{name: "other action", action: ActionPublish, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", future)}, "expire": {strconv.FormatInt(future, 10)},
+		}, wantErr: true},
+		{name: "other secret", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign("other", ActionPlay, "/live/cam1", future)}, "expire": {strconv.FormatInt(future, 10)},
+		}, wantErr: true},
+		{name: "no sign", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"expire": {strconv.FormatInt(future, 10)},
+		}, wantErr: true},
+		{name: "invalid expire", action: ActionPlay, connPath: "/live/cam1", query: url.Values{
+			"sign": {HmacSign(secret, ActionPlay, "/live/cam1", future)}, "expire": {"tomorrow"},
+		}, wantErr: true},
+	}
+
+	m := newHmacSign(secret)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.auth(tt.action, newRequest(tt.connPath, tt.query))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJwt(t *testing.T) {
+	const secret = "secret"
+	now := time.Now().Unix()
+
+	sign := func(claims JwtClaims) string {
+		token, err := JwtSign(secret, &claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// tamper 修改签名的最后一个字符
+	tamper := func(token string) string {
+		last := "A"
+		if strings.HasSuffix(token, last) {
+			last = "B"
+		}
+		return token[:len(token)-1] + last
+	}
+
+	tests := []struct {
+		name     string
+		action   Action
+		connPath string
+		token    string
+		wantErr  bool
+	}{
+		{name: "no claims", action: ActionPlay, connPath: "/live/cam1", token: sign(JwtClaims{})},
+		{name: "all claims", action: ActionPlay, connPath: "/live/cam1", token: sign(JwtClaims{Exp: now + 60, Nbf: now - 60, Path: "/live/cam1", Action: ActionPlay})},
+		{name: "expired", action: ActionPlay, connPath: "/live/cam1", token: sign(JwtClaims{Exp: now - 1}), wantErr: true},
+		{name: "not valid yet", action: ActionPlay, connPath: "/live/cam1", token: sign(JwtClaims{Nbf: now + 60}), wantErr: true},
+		{name: "path mismatch", action: ActionPlay, connPath: "/live/cam2", token: sign(JwtClaims{Path: "/live/cam1"}), wantErr: true},
+		{name: "action mismatch", action: ActionPublish, connPath: "/live/cam1", token: sign(JwtClaims{Action: ActionPlay}), wantErr: true},
+		{name: "wrong signature", action: ActionPlay, connPath: "/live/cam1", token: tamper(sign(JwtClaims{})), wantErr: true},
+		{name: "alg none", action: ActionPlay, connPath: "/live/cam1", token: base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".", wantErr: true},
+		{name: "malformed", action: ActionPlay, connPath: "/live/cam1", token: "a.b", wantErr: true},
+		{name: "no token", action: ActionPlay, connPath: "/live/cam1", wantErr: true},
+	}
+
+	m := newJwt(secret)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			if len(tt.token) > 0 {
+				query.Set("token", tt.token)
+			}
+			err := m.auth(tt.action, newRequest(tt.connPath, query))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestJwtBearer token也可以通过 Authorization: Bearer 提供
+func TestJwtBearer(t *testing.T) {
+	token, err := JwtSign("secret", &JwtClaims{Path: "/live/cam1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newRequest("/live/cam1", url.Values{})
+	req.Token = token
+	if err = newJwt("secret").auth(ActionPlay, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	future := time.Now().Unix() + 60
+	option := Option{
+		Play:       true,
+		PlayKeys:   map[string]string{"/live/cam1": "123"},
+		HmacSecret: "secret",
+	}
+
+	tests := []struct {
+		name     string
+		option   Option
+		publish  bool
+		connPath string
+		query    url.Values
+		wantErr  bool
+	}{
+		{name: "publish not required", option: option, publish: true, connPath: "/live/cam1"},
+		{name: "static key", option: option, connPath: "/live/cam1", query: url.Values{"key": {"123"}}},
+		{name: "hmac", option: option, connPath: "/live/cam2", query: url.Values{
+			"sign": {HmacSign("secret", ActionPlay, "/live/cam2", future)}, "expire": {strconv.FormatInt(future, 10)},
+		}},
+		{name: "no credential", option: option, connPath: "/live/cam1", wantErr: true},
+		{name: "no method", option: Option{Play: true}, connPath: "/live/cam1", query: url.Values{"key": {"123"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAuthenticator(tt.option)
+			query := tt.query
+			if query == nil {
+				query = url.Values{}
+			}
+
+			var err error
+			if tt.publish {
+				err = a.AuthPublish(newRequest(tt.connPath, query))
+			} else {
+				err = a.AuthPlay(newRequest(tt.connPath, query))
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
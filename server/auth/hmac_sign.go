@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// hmacSign 签名url ?sign=...&expire=...
+// sign = hex(hmac_sha256(secret, "publish:/movie:1700000000"))
+type hmacSign struct {
+	secret []byte
+}
+
+func newHmacSign(secret string) *hmacSign {
+	return &hmacSign{
+		secret: []byte(secret),
+	}
+}
+
+// HmacSign 生成签名, expire为unix时间(秒)
+func HmacSign(secret string, action Action, connPath string, expire int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%v:%v:%v", action, connPath, expire)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (tis *hmacSign) auth(action Action, req *server_interface.StreamRequest) error {
+	sign := req.Query.Get("sign")
+	if len(sign) == 0 {
+		return fmt.Errorf("no sign")
+	}
+
+	expire, err := strconv.ParseInt(req.Query.Get("expire"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expire")
+	}
+	if time.Now().Unix() > expire {
+		return fmt.Errorf("sign expired")
+	}
+
+	want := HmacSign(string(tis.secret), action, req.ConnPath, expire)
+	if !hmac.Equal([]byte(sign), []byte(want)) {
+		return fmt.Errorf("wrong sign")
+	}
+
+	return nil
+}
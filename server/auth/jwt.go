@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// jwt HS256 token, 通过 ?token=, bearer token或basic密码提供
+type jwt struct {
+	secret []byte
+}
+
+// JwtClaims 支持的claims, path/action为空时不限制
+type JwtClaims struct {
+	Exp    int64  `json:"exp,omitempty"`
+	Nbf    int64  `json:"nbf,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Action Action `json:"action,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+func newJwt(secret string) *jwt {
+	return &jwt{
+		secret: []byte(secret),
+	}
+}
+
+// JwtSign 生成HS256 token
+func JwtSign(secret string, claims *JwtClaims) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + jwtSignature(secret, data), nil
+}
+
+func jwtSignature(secret string, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (tis *jwt) auth(action Action, req *server_interface.StreamRequest) error {
+	token := req.GetToken()
+	if len(token) == 0 {
+		return fmt.Errorf("no token")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid token")
+	}
+
+	var header jwtHeader
+	if err := jwtDecode(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "HS256" {
+		return fmt.Errorf("unsupported alg %v", header.Alg)
+	}
+
+	want := jwtSignature(string(tis.secret), parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return fmt.Errorf("wrong token signature")
+	}
+
+	var claims JwtClaims
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if claims.Exp > 0 && now > claims.Exp {
+		return fmt.Errorf("token expired")
+	}
+	if claims.Nbf > 0 && now < claims.Nbf {
+		return fmt.Errorf("token not valid yet")
+	}
+	if len(claims.Path) > 0 && claims.Path != req.ConnPath {
+		return fmt.Errorf("token path mismatch")
+	}
+	if len(claims.Action) > 0 && claims.Action != action {
+		return fmt.Errorf("token action mismatch")
+	}
+
+	return nil
+}
+
+func jwtDecode(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("invalid token. %v", err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid token. %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// staticKey 固定密钥, 通过 ?key=, basic密码或bearer token提供
+type staticKey struct {
+	publishKeys map[string]string
+	playKeys    map[string]string
+}
+
+func newStaticKey(publishKeys, playKeys map[string]string) *staticKey {
+	return &staticKey{
+		publishKeys: publishKeys,
+		playKeys:    playKeys,
+	}
+}
+
+func (tis *staticKey) auth(action Action, req *server_interface.StreamRequest) error {
+	keys := tis.publishKeys
+	if action == ActionPlay {
+		keys = tis.playKeys
+	}
+
+	key, ok := keys[req.ConnPath]
+	if !ok {
+		key, ok = keys["*"]
+	}
+	if !ok {
+		return fmt.Errorf("no key for %v", req.ConnPath)
+	}
+
+	if !req.CheckPassword(key) {
+		return fmt.Errorf("wrong key")
+	}
+
+	return nil
+}
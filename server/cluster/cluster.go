@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+const (
+	ModeOrigin = "origin" // 公布自己的流
+	ModeEdge   = "edge"   // 本地没有的流从源站拉取
+)
+
+// Option 源站/边缘集群
+type Option struct {
+	Mode        string        `yaml:"mode"`         // origin, edge, 空不启用
+	NodeURL     string        `yaml:"node_url"`     // 本机地址, 边缘通过它拉流: rtmp://ip:1935 或 http://ip:8080 (http-flv)
+	Origins     []string      `yaml:"origins"`      // 静态源站列表, 没有registry_dir时边缘逐个尝试
+	RegistryDir string        `yaml:"registry_dir"` // 共享目录, 源站写入自己的流, 边缘按流查找源站
+	Interval    time.Duration `yaml:"interval"`     // 源站公布流的间隔, 超过3倍没有更新视为下线
+}
+
+// NewRegistry 配置了共享目录时使用文件registry, 否则使用静态列表
+func NewRegistry(option Option) Registry {
+	if len(option.RegistryDir) > 0 {
+		return NewFileRegistry(option.RegistryDir, 3*option.Interval)
+	}
+	return NewStaticRegistry(option.Origins)
+}
+
+// Cluster 源站定期公布流, 边缘查询源站
+type Cluster struct {
+	parent server_interface.ServerInterface
+	option Option
+
+	mutex    sync.RWMutex
+	registry Registry
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewCluster(parent server_interface.ServerInterface, option Option) *Cluster {
+	if option.Interval <= 0 {
+		option.Interval = 2 * time.Second
+	}
+
+	return &Cluster{
+		parent:   parent,
+		option:   option,
+		registry: NewRegistry(option),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetRegistry 替换registry, 例如使用外部的服务发现
+func (tis *Cluster) SetRegistry(registry Registry) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.registry = registry
+}
+
+func (tis *Cluster) getRegistry() Registry {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+	return tis.registry
+}
+
+func (tis *Cluster) IsEdge() bool {
+	return tis.option.Mode == ModeEdge
+}
+
+// Start 源站开始公布流
+func (tis *Cluster) Start() {
+	if tis.option.Mode != ModeOrigin {
+		return
+	}
+
+	tis.wg.Add(1)
+	go func() {
+		defer tis.wg.Done()
+		tis.announce()
+	}()
+}
+
+// announce 定期公布有推流的channel, 停止时下线
+func (tis *Cluster) announce() {
+	ticker := time.NewTicker(tis.option.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := tis.getRegistry().Publish(tis.option.NodeURL, tis.streams()); err != nil {
+			log.Printf("cluster publish: %v", err)
+		}
+
+		select {
+		case <-tis.done:
+			if err := tis.getRegistry().Publish(tis.option.NodeURL, nil); err != nil {
+				log.Printf("cluster publish: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streams 本机有推流的路径, 不包括只有垫片的
+func (tis *Cluster) streams() []string {
+	var streams []string
+	for _, ch := range tis.parent.GetChannels() {
+		if ch.IsPublishing() {
+			streams = append(streams, ch.GetConnPath())
+		}
+	}
+	sort.Strings(streams)
+	return streams
+}
+
+// Lookup 边缘从源站拉流的地址, 不包括本机
+func (tis *Cluster) Lookup(connPath string) []string {
+	if !tis.IsEdge() {
+		return nil
+	}
+
+	nodes, err := tis.getRegistry().Lookup(connPath)
+	if err != nil {
+		log.Printf("cluster lookup %v: %v", connPath, err)
+		return nil
+	}
+
+	var urls []string
+	for _, node := range nodes {
+		if node != tis.option.NodeURL {
+			urls = append(urls, StreamURL(node, connPath))
+		}
+	}
+	return urls
+}
+
+// Close 停止公布, 源站下线
+func (tis *Cluster) Close() {
+	tis.stopOnce.Do(func() {
+		close(tis.done)
+	})
+	tis.wg.Wait()
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Registry 源站公布自己的流, 边缘查询流所在的源站
+type Registry interface {
+	// Publish 源站公布当前的流, 覆盖上一次. streams为空时表示下线
+	Publish(node string, streams []string) error
+	// Lookup 拥有connPath的源站地址, 可能为空
+	Lookup(connPath string) ([]string, error)
+}
+
+// StaticRegistry 静态源站列表, 不知道流在哪台源站, 边缘逐个尝试
+type StaticRegistry struct {
+	origins []string
+}
+
+func NewStaticRegistry(origins []string) *StaticRegistry {
+	return &StaticRegistry{
+		origins: append([]string(nil), origins...),
+	}
+}
+
+func (tis *StaticRegistry) Publish(node string, streams []string) error {
+	return nil
+}
+
+func (tis *StaticRegistry) Lookup(connPath string) ([]string, error) {
+	return tis.origins, nil
+}
+
+// FileRegistry 共享目录, 每台源站一个json文件, 超过ttl没有更新的文件忽略
+type FileRegistry struct {
+	dir string
+	ttl time.Duration
+}
+
+// fileRecord 源站文件的内容
+type fileRecord struct {
+	Node      string    `json:"node"`
+	Streams   []string  `json:"streams"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewFileRegistry(dir string, ttl time.Duration) *FileRegistry {
+	return &FileRegistry{
+		dir: dir,
+		ttl: ttl,
+	}
+}
+
+// filename 源站地址的hash, 避免地址中的特殊字符
+func (tis *FileRegistry) filename(node string) string {
+	sum := sha1.Sum([]byte(node))
+	return filepath.Join(tis.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// Publish 写入临时文件后重命名, 读取时不会看到一半的内容
+func (tis *FileRegistry) Publish(node string, streams []string) error {
+	filename := tis.filename(node)
+	if len(streams) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(&fileRecord{
+		Node:      node,
+		Streams:   streams,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(tis.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Lookup 最近更新的源站在前
+func (tis *FileRegistry) Lookup(connPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(tis.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []fileRecord
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+
+		var record fileRecord
+		if err = json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		if time.Since(record.UpdatedAt) > tis.ttl {
+			continue
+		}
+
+		for _, stream := range record.Streams {
+			if stream == connPath {
+				records = append(records, record)
+				break
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UpdatedAt.After(records[j].UpdatedAt)
+	})
+
+	var nodes []string
+	for _, record := range records {
+		nodes = append(nodes, record.Node)
+	}
+	return nodes, nil
+}
+
+// StreamURL 从源站拉流的地址. rtmp://host:port 或 http://host:port(http-flv)
+func StreamURL(node string, connPath string) string {
+	node = strings.TrimSuffix(node, "/")
+	if strings.HasPrefix(node, "http://") || strings.HasPrefix(node, "https://") {
+		return node + "/httpflv" + connPath
+	}
+	return node + connPath
+}
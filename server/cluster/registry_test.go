@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+func TestFileRegistry(t *testing.T) {
+	const (
+		nodeA = "rtmp://10.0.0.1:1935"
+		nodeB = "http://10.0.0.2:8080/"
+		nodeC = "rtmp://10.0.0.3:1935"
+	)
+
+	dir := t.TempDir()
+	registry := NewFileRegistry(dir+"/registry", time.Minute)
+
+	// 目录还不存在
+	if nodes, err := registry.Lookup("/live/a"); err != nil || len(nodes) != 0 {
+		t.Fatalf("lookup empty registry: %v %v", nodes, err)
+	}
+
+	if err := registry.Publish(nodeA, []string{"/live/a", "/live/b"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := registry.Publish(nodeB, []string{"/live/a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过ttl没有更新的源站
+	data, err := json.Marshal(&fileRecord{Node: nodeC, Streams: []string{"/live/a"}, UpdatedAt: time.Now().Add(-2 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(registry.filename(nodeC), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		connPath string
+		want     []string
+	}{
+		{connPath: "/live/a", want: []string{nodeB, nodeA}}, // 最近更新的在前
+		{connPath: "/live/b", want: []string{nodeA}},
+		{connPath: "/live/c"},
+		{connPath: "/live"},
+	}
+	for _, tt := range tests {
+		nodes, err := registry.Lookup(tt.connPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(nodes, tt.want) {
+			t.Errorf("lookup %v: %v, want %v", tt.connPath, nodes, tt.want)
+		}
+	}
+
+	// 覆盖上一次
+	if err = registry.Publish(nodeA, []string{"/live/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := registry.Lookup("/live/a"); !reflect.DeepEqual(nodes, []string{nodeB}) {
+		t.Errorf("lookup after republish: %v", nodes)
+	}
+
+	// 下线, 重复下线无影响
+	for i := 0; i < 2; i++ {
+		if err = registry.Publish(nodeB, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nodes, _ := registry.Lookup("/live/a"); len(nodes) != 0 {
+		t.Errorf("lookup after offline: %v", nodes)
+	}
+	if _, err = os.Stat(registry.filename(nodeB)); !os.IsNotExist(err) {
+		t.Errorf("offline file not removed: %v", err)
+	}
+}
+
+func TestStreamURL(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+	}{
+		{node: "rtmp://10.0.0.1:1935", want: "rtmp://10.0.0.1:1935/live/a"},
+		{node: "rtmp://10.0.0.1:1935/", want: "rtmp://10.0.0.1:1935/live/a"},
+		{node: "http://10.0.0.1:8080", want: "http://10.0.0.1:8080/httpflv/live/a"},
+		{node: "https://10.0.0.1/", want: "https://10.0.0.1/httpflv/live/a"},
+	}
+	for _, tt := range tests {
+		if got := StreamURL(tt.node, "/live/a"); got != tt.want {
+			t.Errorf("%v: %v, want %v", tt.node, got, tt.want)
+		}
+	}
+}
+
+// testRegistry 固定的查询结果
+type testRegistry struct {
+	nodes []string
+}
+
+func (tis *testRegistry) Publish(node string, streams []string) error {
+	return nil
+}
+
+func (tis *testRegistry) Lookup(connPath string) ([]string, error) {
+	return tis.nodes, nil
+}
+
+func TestClusterLookup(t *testing.T) {
+	const self = "rtmp://10.0.0.9:1935"
+
+	tests := []struct {
+		name  string
+		mode  string
+		nodes []string
+
+		want []string
+	}{
+		{name: "origin", mode: ModeOrigin, nodes: []string{"rtmp://10.0.0.1:1935"}},
+		{name: "disabled", nodes: []string{"rtmp://10.0.0.1:1935"}},
+		{
+			name:  "edge",
+			mode:  ModeEdge,
+			nodes: []string{"rtmp://10.0.0.1:1935", self, "http://10.0.0.2:8080"},
+			want:  []string{"rtmp://10.0.0.1:1935/live/a", "http://10.0.0.2:8080/httpflv/live/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parent server_interface.ServerInterface
+			cluster := NewCluster(parent, Option{Mode: tt.mode, NodeURL: self})
+			cluster.SetRegistry(&testRegistry{nodes: tt.nodes})
+
+			if urls := cluster.Lookup("/live/a"); !reflect.DeepEqual(urls, tt.want) {
+				t.Fatalf("urls %v, want %v", urls, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package api_server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/gin-gonic/gin"
+)
+
+// 所有请求需要 -H "Authorization: Bearer <api.token>"
+// curl http://localhost:8081/api/v1/streams
+// curl http://localhost:8081/api/v1/streams/live/movie
+// curl http://localhost:8081/api/v1/sessions
+// curl -X DELETE http://localhost:8081/api/v1/sessions/1
+// curl -X POST http://localhost:8081/api/v1/subscribers/1/live
+// curl -X POST "http://localhost:8081/api/v1/streams/live/movie/record?segment_duration=5m&segment_size=104857600"
+// curl -X POST "http://localhost:8081/api/v1/streams/live/movie/record?format=mp4&faststart=true"
+// curl -X DELETE http://localhost:8081/api/v1/streams/live/movie/record
+// curl -X DELETE "http://localhost:8081/api/v1/records?path=/live/movie"
+// curl http://localhost:8081/api/v1/records
+// curl http://localhost:8081/api/v1/records/retention
+// curl -X POST http://localhost:8081/api/v1/records/retention
+// curl http://localhost:8081/api/v1/relays/pull
+// curl -X POST -d '{"path":"/cam/{id}","url":"rtsp://10.0.0.{id}/stream"}' http://localhost:8081/api/v1/relays/pull
+// curl -X DELETE "http://localhost:8081/api/v1/relays/pull?path=/cam/{id}"
+// curl http://localhost:8081/api/v1/relays/push
+// curl -X POST -d '{"path":"/live/{name}","urls":["rtmp://a.com/app/{name}"]}' http://localhost:8081/api/v1/relays/push
+// curl -X DELETE "http://localhost:8081/api/v1/relays/push?path=/live/{name}"
+// curl http://localhost:8081/api/v1/udp/inputs
+// curl -X POST -d '{"url":"udp://239.0.0.1:1234","conn_path":"/live"}' http://localhost:8081/api/v1/udp/inputs
+// curl -X DELETE "http://localhost:8081/api/v1/udp/inputs?conn_path=/live"
+// curl http://localhost:8081/api/v1/udp/outputs
+// curl -X POST -d '{"conn_path":"/live","url":"udp://239.0.0.2:1234"}' http://localhost:8081/api/v1/udp/outputs
+// curl -X DELETE "http://localhost:8081/api/v1/udp/outputs?url=udp://239.0.0.2:1234"
+
+// Option 管理API. 可以踢出会话, 录制, 删除文件, 转发到任意地址, 不要和播放共用端口对外开放
+type Option struct {
+	Addr  string `yaml:"addr"`  // 单独监听, 默认只监听本机 "127.0.0.1:8081". 为空时使用http的端口
+	Token string `yaml:"token"` // 请求需要 Authorization: Bearer <token>, 为空时拒绝所有请求
+}
+
+type JsonResponse struct {
+	Code int         `json:"code"` // 错误码
+	Msg  string      `json:"msg"`  // 信息
+	Data interface{} `json:"data,omitempty"`
+}
+
+type ApiServer struct {
+	parent server_interface.ServerInterface
+	option Option
+}
+
+func NewApiServer(parent server_interface.ServerInterface, option Option) *ApiServer {
+	return &ApiServer{
+		parent: parent,
+		option: option,
+	}
+}
+
+// Register 注册路由
+func (tis *ApiServer) Register(r gin.IRouter) {
+	v1 := r.Group("/api/v1", tis.authorize)
+
+	v1.GET("/streams", tis.OnGetStreams)
+	v1.GET("/streams/*ConnPath", tis.OnGetStream)
+	v1.POST("/streams/*ConnPath", tis.OnStartRecord)  // /streams/*path/record
+	v1.DELETE("/streams/*ConnPath", tis.OnStopRecord) // /streams/*path/record
+	v1.GET("/records", tis.OnGetRecords)
+	v1.POST("/records", tis.OnStartRecord) // 同 /streams/*path/record, 参数 path
+	v1.DELETE("/records", tis.OnStopRecord)
+	v1.GET("/records/retention", tis.OnGetRetention)
+	v1.POST("/records/retention", tis.OnRunRetention)
+	v1.GET("/sessions", tis.OnGetSessions)
+	v1.DELETE("/sessions/:ID", tis.OnDeleteSession)
+	v1.POST("/subscribers/:ID/live", tis.OnSubscriberLive)
+	v1.GET("/relays/pull", tis.OnGetPullSources)
+	v1.POST("/relays/pull", tis.OnAddPullSource)
+	v1.DELETE("/relays/pull", tis.OnDeletePullSource)
+	v1.GET("/relays/push", tis.OnGetPushTargets)
+	v1.POST("/relays/push", tis.OnAddPushTarget)
+	v1.DELETE("/relays/push", tis.OnDeletePushTarget)
+	v1.GET("/udp/inputs", tis.OnGetUdpInputs)
+	v1.POST("/udp/inputs", tis.OnAddUdpInput)
+	v1.DELETE("/udp/inputs", tis.OnDeleteUdpInput)
+	v1.GET("/udp/outputs", tis.OnGetUdpOutputs)
+	v1.POST("/udp/outputs", tis.OnAddUdpOutput)
+	v1.DELETE("/udp/outputs", tis.OnDeleteUdpOutput)
+}
+
+// authorize 检查bearer token
+func (tis *ApiServer) authorize(c *gin.Context) {
+	if len(tis.option.Token) == 0 {
+		tis.fail(c, http.StatusForbidden, "api token is not configured")
+		c.Abort()
+		return
+	}
+
+	auth := c.GetHeader("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(tis.option.Token)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="live"`)
+		tis.fail(c, http.StatusUnauthorized, "unauthorized")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// OnGetStreams 流列表
+func (tis *ApiServer) OnGetStreams(c *gin.Context) {
+	var infos = []server_interface.ChannelInfo{}
+	for _, ch := range tis.parent.GetChannels() {
+		infos = append(infos, ch.Info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnPath < infos[j].ConnPath
+	})
+
+	tis.success(c, infos)
+}
+
+// OnGetStream 单个流详情, 路径可以有多级
+func (tis *ApiServer) OnGetStream(c *gin.Context) {
+	connPath := c.Param("ConnPath")
+
+	// 不使用GetChannel, 查询不启动垫片
+	if ch, ok := tis.parent.LookupChannel(connPath); ok {
+		tis.success(c, ch.Info())
+		return
+	}
+
+	tis.fail(c, http.StatusNotFound, "not found "+connPath)
+}
+
+// recordPath /streams/*path/record 中的路径, /records 时使用参数 path
+func recordPath(c *gin.Context) (string, bool) {
+	connPath, ok := c.Params.Get("ConnPath")
+	if !ok {
+		return c.Query("path"), true
+	}
+	if !strings.HasSuffix(connPath, "/record") {
+		return "", false
+	}
+	return strings.TrimSuffix(connPath, "/record"), true
+}
+
+// OnStartRecord 开始录制正在推流的路径, 参数 file, segment_duration, segment_size, format, faststart 为空时使用配置
+func (tis *ApiServer) OnStartRecord(c *gin.Context) {
+	connPath, ok := recordPath(c)
+	if !ok {
+		tis.fail(c, http.StatusNotFound, "not found "+c.Request.URL.Path)
+		return
+	}
+
+	rule := server_interface.RecordRule{
+		File:   c.Query("file"),
+		Format: c.Query("format"),
+	}
+	if s := c.Query("segment_duration"); len(s) > 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			tis.fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		rule.SegmentDuration = d
+	}
+	if s := c.Query("segment_size"); len(s) > 0 {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			tis.fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		rule.SegmentSize = n
+	}
+	if s := c.Query("faststart"); len(s) > 0 {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			tis.fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		rule.Faststart = b
+	}
+
+	if ch, ok := tis.parent.LookupChannel(connPath); !ok || !ch.IsPublishing() {
+		tis.fail(c, http.StatusNotFound, "not publishing "+connPath)
+		return
+	}
+
+	info, err := tis.parent.StartRecord(connPath, rule)
+	if err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tis.success(c, info)
+}
+
+// OnStopRecord 停止录制, 写完正在录制的文件
+func (tis *ApiServer) OnStopRecord(c *gin.Context) {
+	connPath, ok := recordPath(c)
+	if !ok {
+		tis.fail(c, http.StatusNotFound, "not found "+c.Request.URL.Path)
+		return
+	}
+
+	info, ok := tis.parent.StopRecord(connPath)
+	if !ok {
+		tis.fail(c, http.StatusNotFound, "not recording "+connPath)
+		return
+	}
+
+	tis.success(c, info)
+}
+
+// OnGetRecords 正在录制的路径
+func (tis *ApiServer) OnGetRecords(c *gin.Context) {
+	var infos = []server_interface.RecordInfo{}
+	infos = append(infos, tis.parent.GetRecords()...)
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnPath < infos[j].ConnPath
+	})
+
+	tis.success(c, infos)
+}
+
+// OnGetRetention 上一次清理录制文件的结果和最近删除的文件
+func (tis *ApiServer) OnGetRetention(c *gin.Context) {
+	tis.success(c, tis.parent.GetRetention())
+}
+
+// OnRunRetention 立即按保留策略清理录制文件, 返回这次删除的文件
+func (tis *ApiServer) OnRunRetention(c *gin.Context) {
+	var deleted = []server_interface.DeletedRecord{}
+	deleted = append(deleted, tis.parent.RunRetention()...)
+
+	tis.success(c, deleted)
+}
+
+// OnGetSessions 所有会话
+func (tis *ApiServer) OnGetSessions(c *gin.Context) {
+	var infos = []server_interface.SessionInfo{}
+	for _, session := range tis.parent.GetSessions() {
+		infos = append(infos, session.Info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	tis.success(c, infos)
+}
+
+// OnDeleteSession 踢出推流或拉流
+func (tis *ApiServer) OnDeleteSession(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("ID"), 10, 64)
+	if err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	session, ok := tis.parent.GetSession(id)
+	if !ok {
+		tis.fail(c, http.StatusNotFound, "not found session")
+		return
+	}
+
+	session.Close()
+	tis.parent.RemoveSession(id)
+
+	tis.success(c, session.Info())
+}
+
+// OnSubscriberLive 时移的读者回到最新, id是流详情中subscribers的id
+func (tis *ApiServer) OnSubscriberLive(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("ID"), 10, 64)
+	if err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for _, ch := range tis.parent.GetChannels() {
+		if sub, ok := ch.GetSubscriber(id); ok {
+			sub.Seek(0)
+			tis.success(c, sub.Info())
+			return
+		}
+	}
+
+	tis.fail(c, http.StatusNotFound, "not found subscriber")
+}
+
+// OnGetPullSources 拉流转发的上游
+func (tis *ApiServer) OnGetPullSources(c *gin.Context) {
+	tis.success(c, tis.parent.GetPullSources())
+}
+
+// OnAddPullSource 添加或修改上游, 不写入配置文件, Reload后以配置文件为准
+func (tis *ApiServer) OnAddPullSource(c *gin.Context) {
+	var source server_interface.PullSource
+	if err := c.ShouldBindJSON(&source); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := tis.parent.AddPullSource(source); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tis.success(c, source)
+}
+
+// OnDeletePullSource 删除上游, 停止正在拉流的路径
+func (tis *ApiServer) OnDeletePullSource(c *gin.Context) {
+	path := c.Query("path")
+	if !tis.parent.RemovePullSource(path) {
+		tis.fail(c, http.StatusNotFound, "not found "+path)
+		return
+	}
+
+	tis.success(c, nil)
+}
+
+// OnGetPushTargets 推流转发的目的地, 转发状态在流详情的pushes中
+func (tis *ApiServer) OnGetPushTargets(c *gin.Context) {
+	tis.success(c, tis.parent.GetPushTargets())
+}
+
+// OnAddPushTarget 添加或修改转发, 不写入配置文件, Reload后以配置文件为准
+func (tis *ApiServer) OnAddPushTarget(c *gin.Context) {
+	var target server_interface.PushTarget
+	if err := c.ShouldBindJSON(&target); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := tis.parent.AddPushTarget(target); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tis.success(c, target)
+}
+
+// OnDeletePushTarget 删除转发, 停止正在转发的路径
+func (tis *ApiServer) OnDeletePushTarget(c *gin.Context) {
+	path := c.Query("path")
+	if !tis.parent.RemovePushTarget(path) {
+		tis.fail(c, http.StatusNotFound, "not found "+path)
+		return
+	}
+
+	tis.success(c, nil)
+}
+
+// OnGetUdpInputs udp输入
+func (tis *ApiServer) OnGetUdpInputs(c *gin.Context) {
+	tis.success(c, tis.parent.GetUdpInputs())
+}
+
+// OnAddUdpInput 添加udp输入, 不写入配置文件, Reload后以配置文件为准
+func (tis *ApiServer) OnAddUdpInput(c *gin.Context) {
+	var input server_interface.UdpInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := tis.parent.AddUdpInput(input); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tis.success(c, input)
+}
+
+// OnDeleteUdpInput 删除udp输入
+func (tis *ApiServer) OnDeleteUdpInput(c *gin.Context) {
+	connPath := c.Query("conn_path")
+	if !tis.parent.RemoveUdpInput(connPath) {
+		tis.fail(c, http.StatusNotFound, "not found "+connPath)
+		return
+	}
+
+	tis.success(c, nil)
+}
+
+// OnGetUdpOutputs udp输出
+func (tis *ApiServer) OnGetUdpOutputs(c *gin.Context) {
+	tis.success(c, tis.parent.GetUdpOutputs())
+}
+
+// OnAddUdpOutput 添加udp输出, 不写入配置文件, Reload后以配置文件为准
+func (tis *ApiServer) OnAddUdpOutput(c *gin.Context) {
+	var output server_interface.UdpOutput
+	if err := c.ShouldBindJSON(&output); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := tis.parent.AddUdpOutput(output); err != nil {
+		tis.fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tis.success(c, output)
+}
+
+// OnDeleteUdpOutput 删除udp输出, url与添加时一致
+func (tis *ApiServer) OnDeleteUdpOutput(c *gin.Context) {
+	rawURL := c.Query("url")
+	if !tis.parent.RemoveUdpOutput(rawURL) {
+		tis.fail(c, http.StatusNotFound, "not found "+rawURL)
+		return
+	}
+
+	tis.success(c, nil)
+}
+
+func (tis *ApiServer) success(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusOK, &JsonResponse{
+		Code: 0,
+		Msg:  "success",
+		Data: data,
+	})
+}
+
+func (tis *ApiServer) fail(c *gin.Context, status int, msg string) {
+	c.JSON(status, &JsonResponse{
+		Code: 1,
+		Msg:  msg,
+	})
+}
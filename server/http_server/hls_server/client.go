@@ -0,0 +1,69 @@
+package hls_server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// client 一个hls播放器, 第一次请求index.m3u8时创建, 之后的请求带session参数
+// 没有请求超过IdleTimeout时结束, 回调on_stop
+type client struct {
+	token string
+	req   *server_interface.StreamRequest
+
+	session *server_interface.Session
+	timer   *time.Timer
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	closed  bool
+	onClose func(c *client)
+}
+
+func newClient(req *server_interface.StreamRequest, timeout time.Duration, onClose func(c *client)) *client {
+	c := &client{
+		token:   newToken(),
+		req:     req,
+		timeout: timeout,
+		onClose: onClose,
+	}
+
+	c.session = server_interface.NewSession(server_interface.SessionPlayer, "hls", req.ConnPath, req.RemoteAddr, c.close)
+	c.timer = time.AfterFunc(timeout, c.session.Close)
+
+	return c
+}
+
+// touch 有请求时延长过期时间, 已经结束时返回false
+func (tis *client) touch() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return false
+	}
+	tis.timer.Reset(tis.timeout)
+	return true
+}
+
+// close 过期或者被踢出, 由session.Close调用, 只执行一次
+func (tis *client) close() {
+	tis.mutex.Lock()
+	tis.closed = true
+	tis.timer.Stop()
+	tis.mutex.Unlock()
+
+	log.Printf("hls client stop: %v %v", tis.req.ConnPath, tis.req.RemoteAddr)
+	tis.onClose(tis)
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
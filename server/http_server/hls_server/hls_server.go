@@ -0,0 +1,223 @@
+package hls_server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+	"github.com/gin-gonic/gin"
+)
+
+// ffplay http://localhost:8080/hls/movie/index.m3u8
+// 第一次请求返回主播放列表, 媒体播放列表和分片带session参数, 没有请求超过idle_timeout时会话结束
+
+type Option struct {
+	SegmentDuration time.Duration `yaml:"segment_duration"` // 分片时长
+	PlaylistLength  int           `yaml:"playlist_length"`  // m3u8中的分片数量
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`     // 没有请求时停止切片
+}
+
+type HlsServer struct {
+	parent server_interface.ServerInterface
+	option Option
+
+	mutex     sync.Mutex
+	packagers *util.Map[string, *Packager]
+	clients   *util.Map[string, *client] // session token -> 播放器
+}
+
+func NewHlsServer(parent server_interface.ServerInterface, option Option) *HlsServer {
+	if option.SegmentDuration <= 0 {
+		option.SegmentDuration = 2 * time.Second
+	}
+	if option.PlaylistLength <= 0 {
+		option.PlaylistLength = 5
+	}
+	if option.IdleTimeout <= 0 {
+		option.IdleTimeout = 30 * time.Second
+	}
+
+	return &HlsServer{
+		parent:    parent,
+		option:    option,
+		packagers: util.NewMap[string, *Packager](),
+		clients:   util.NewMap[string, *client](),
+	}
+}
+
+// OnHls /hls/*Path, 最后一级是文件名, 前面是connPath, 例如 /hls/live/cam1/index.m3u8
+func (tis *HlsServer) OnHls(c *gin.Context) {
+	connPath, file := path.Split(c.Param("Path"))
+	connPath = strings.TrimSuffix(connPath, "/")
+
+	c.Header("Access-Control-Allow-Origin", "*")
+
+	if len(connPath) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	// 第一次请求鉴权后分配session, 之后的播放列表和分片都要带上
+	token := c.Query("session")
+	if file == "index.m3u8" && len(token) == 0 {
+		tis.onPlay(c, connPath)
+		return
+	}
+
+	client, ok := tis.clients.Load(token)
+	if !ok || client.req.ConnPath != connPath || !client.touch() {
+		c.JSON(http.StatusForbidden, gin.H{})
+		return
+	}
+
+	if file == "index.m3u8" {
+		tis.onPlaylist(c, connPath, token)
+		return
+	}
+
+	if strings.HasSuffix(file, ".ts") {
+		tis.onSegment(c, connPath, strings.TrimSuffix(file, ".ts"))
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{})
+}
+
+// onPlay 鉴权, 回调on_play, 注册会话, 返回指向带session的媒体播放列表的主播放列表
+func (tis *HlsServer) onPlay(c *gin.Context, connPath string) {
+	req := server_interface.NewHttpStreamRequest("hls", connPath, c.Request)
+	if err := tis.parent.AuthPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	packager, ok := tis.getPackager(connPath)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	// 等待第一个分片
+	if !packager.WaitReady(tis.option.SegmentDuration * 3) {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	if err := tis.parent.OnPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	client := newClient(req, tis.option.IdleTimeout, func(client *client) {
+		tis.clients.Delete(client.token)
+		tis.parent.RemoveSession(client.session.GetID())
+		tis.parent.OnStop(client.req)
+	})
+	tis.clients.Store(client.token, client)
+	tis.parent.AddSession(client.session)
+	log.Printf("hls client start: %v %v", connPath, req.RemoteAddr)
+
+	bandwidth := packager.Bandwidth()
+	if bandwidth <= 0 {
+		bandwidth = 1
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bandwidth))
+	b.WriteString(fmt.Sprintf("index.m3u8?session=%s\n", client.token))
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(b.String()))
+}
+
+func (tis *HlsServer) onPlaylist(c *gin.Context, connPath string, token string) {
+	packager, ok := tis.getPackager(connPath)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	// 等待第一个分片
+	if !packager.WaitReady(tis.option.SegmentDuration * 3) {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	playlist, ok := packager.Playlist("?session=" + token)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+}
+
+func (tis *HlsServer) onSegment(c *gin.Context, connPath string, name string) {
+	index, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{})
+		return
+	}
+
+	packager, ok := tis.packagers.Load(connPath)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	data, ok := packager.Segment(index)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	c.Data(http.StatusOK, "video/mp2t", data)
+}
+
+// getPackager 获取切片器, 不存在时创建
+// GetChannel可能需要连接上游, 不持有锁, 同时创建时使用先保存的切片器
+func (tis *HlsServer) getPackager(connPath string) (*Packager, bool) {
+	if packager, ok := tis.packagers.Load(connPath); ok && !packager.IsClosed() {
+		return packager, true
+	}
+
+	ch, ok := tis.parent.GetChannel(connPath)
+	if !ok {
+		log.Printf("GetChannel fail. %v", connPath)
+		return nil, false
+	}
+
+	tis.mutex.Lock()
+	if packager, ok := tis.packagers.Load(connPath); ok && !packager.IsClosed() {
+		tis.mutex.Unlock()
+		return packager, true
+	}
+	packager := NewPackager(connPath, ch, tis.option)
+	tis.packagers.Store(connPath, packager)
+	tis.mutex.Unlock()
+
+	go func() {
+		packager.Run()
+
+		tis.mutex.Lock()
+		if value, ok := tis.packagers.Load(connPath); ok && value == packager {
+			tis.packagers.Delete(connPath)
+		}
+		tis.mutex.Unlock()
+	}()
+
+	return packager, true
+}
@@ -0,0 +1,258 @@
+package hls_server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/general252/live/format/mpegts"
+	"github.com/general252/live/server/server_interface"
+)
+
+// segment 一个ts分片
+type segment struct {
+	index    uint64
+	duration time.Duration
+	data     []byte
+}
+
+// Packager 从channel读取packet, 按关键帧切分为ts分片
+type Packager struct {
+	connPath string
+	ch       *server_interface.Channel
+	option   Option
+
+	mutex      sync.Mutex
+	segments   []*segment
+	lastAccess time.Time
+	closed     bool
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+}
+
+func NewPackager(connPath string, ch *server_interface.Channel, option Option) *Packager {
+	return &Packager{
+		connPath:   connPath,
+		ch:         ch,
+		option:     option,
+		lastAccess: time.Now(),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (tis *Packager) Run() {
+	defer func() {
+		tis.mutex.Lock()
+		tis.closed = true
+		tis.mutex.Unlock()
+
+		close(tis.done)
+		log.Printf("hls packager stop: %v", tis.connPath)
+	}()
+
+	log.Printf("hls packager start: %v", tis.connPath)
+	if err := tis.run(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (tis *Packager) run() error {
+	cursor := tis.ch.Subscribe("hls", "")
+	defer cursor.Close()
+
+	streams, err := cursor.Streams()
+	if err != nil {
+		return err
+	}
+
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	var (
+		buf      = &bytes.Buffer{}
+		muxer    = mpegts.NewMuxer(buf)
+		started  = false
+		segStart time.Duration
+		index    uint64
+	)
+	if err = muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+	defer muxer.WriteTrailer()
+
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		if tis.isIdle() {
+			return fmt.Errorf("hls: %v idle", tis.connPath)
+		}
+
+		// 有视频时, 分片从关键帧开始
+		isBoundary := videoIdx < 0 || (int(pkt.Idx) == videoIdx && pkt.IsKeyFrame)
+
+		// 等待第一个关键帧
+		if !started {
+			if !isBoundary {
+				continue
+			}
+			started = true
+			segStart = pkt.Time
+		}
+
+		// 在关键帧处切片
+		if isBoundary && pkt.Time-segStart >= tis.option.SegmentDuration {
+			if err = muxer.Flush(); err != nil {
+				return err
+			}
+
+			tis.addSegment(&segment{
+				index:    index,
+				duration: pkt.Time - segStart,
+				data:     buf.Bytes(),
+			})
+
+			index++
+			segStart = pkt.Time
+			buf = &bytes.Buffer{}
+			if err = muxer.SetWriter(buf); err != nil {
+				return err
+			}
+		}
+
+		if err = muxer.WritePacket(pkt); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (tis *Packager) addSegment(seg *segment) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.segments = append(tis.segments, seg)
+
+	// 多保留几个分片, 给正在下载的播放器
+	if keep := tis.option.PlaylistLength + 2; len(tis.segments) > keep {
+		tis.segments = tis.segments[len(tis.segments)-keep:]
+	}
+
+	tis.readyOnce.Do(func() {
+		close(tis.ready)
+	})
+}
+
+func (tis *Packager) isIdle() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return time.Since(tis.lastAccess) > tis.option.IdleTimeout
+}
+
+func (tis *Packager) touch() {
+	tis.mutex.Lock()
+	tis.lastAccess = time.Now()
+	tis.mutex.Unlock()
+}
+
+// WaitReady 等待足够的分片
+func (tis *Packager) WaitReady(timeout time.Duration) bool {
+	select {
+	case <-tis.ready:
+		return true
+	case <-tis.done:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// IsClosed 是否已经结束
+func (tis *Packager) IsClosed() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return tis.closed
+}
+
+// Bandwidth 按已有分片估算的码率 bit/s, 用于主播放列表
+func (tis *Packager) Bandwidth() int64 {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	var (
+		size     int64
+		duration time.Duration
+	)
+	for _, seg := range tis.segments {
+		size += int64(len(seg.data))
+		duration += seg.duration
+	}
+	if duration <= 0 {
+		return 0
+	}
+	return size * 8 * int64(time.Second) / int64(duration)
+}
+
+// Playlist 生成m3u8, 分片地址加上query
+func (tis *Packager) Playlist(query string) (string, bool) {
+	tis.touch()
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	segments := tis.segments
+	if len(segments) == 0 {
+		return "", false
+	}
+	if len(segments) > tis.option.PlaylistLength {
+		segments = segments[len(segments)-tis.option.PlaylistLength:]
+	}
+
+	var targetDuration float64
+	for _, seg := range segments {
+		targetDuration = math.Max(targetDuration, math.Ceil(seg.duration.Seconds()))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(targetDuration)))
+	b.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].index))
+	for _, seg := range segments {
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.duration.Seconds()))
+		b.WriteString(fmt.Sprintf("%d.ts%s\n", seg.index, query))
+	}
+
+	return b.String(), true
+}
+
+// Segment 获取ts分片
+func (tis *Packager) Segment(index uint64) ([]byte, bool) {
+	tis.touch()
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	for _, seg := range tis.segments {
+		if seg.index == index {
+			return seg.data, true
+		}
+	}
+
+	return nil, false
+}
@@ -4,11 +4,13 @@ import (
 	"github.com/deepch/vdk/av/avutil"
 	"github.com/deepch/vdk/format/flv"
 	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
 type HttpFlvServer struct {
@@ -22,14 +24,38 @@ func NewHttpFlvServer(parent server_interface.ServerInterface) *HttpFlvServer {
 }
 
 func (tis *HttpFlvServer) OnHttpFLV(c *gin.Context) {
-	connPath := "/" + c.Param("ConnPath")
+	connPath := c.Param("ConnPath")
 	log.Println(connPath)
+
+	req := server_interface.NewHttpStreamRequest("httpflv", connPath, c.Request)
+	timeshift, err := req.GetTimeshift()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	if err := tis.parent.AuthPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
 	ch, ok := tis.parent.GetChannel(connPath)
 	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{})
 		return
 	}
 
+	if err := tis.parent.OnPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	defer tis.parent.OnStop(req)
+
 	var (
 		isWebsocket = false
 		ws          *websocketConnWrap
@@ -76,9 +102,31 @@ func (tis *HttpFlvServer) OnHttpFLV(c *gin.Context) {
 	}
 
 	muxer := flv.NewMuxerWriteFlusher(wFlusher)
-	cursor := ch.Que.Latest()
+	cursor := ch.Subscribe("httpflv", c.Request.RemoteAddr)
+	cursor.SetLagPolicy(tis.parent.GetLagPolicy(), func() {
+		if ws != nil {
+			_ = ws.conn.Close()
+		} else if conn, ok := util.ConnFromContext(c.Request.Context()); ok {
+			_ = conn.Close()
+		}
+	})
+	defer cursor.Close()
+	if timeshift > 0 {
+		cursor.Seek(timeshift)
+	}
+
+	session := server_interface.NewSession(server_interface.SessionPlayer, "httpflv", connPath, c.Request.RemoteAddr, func() {
+		cursor.Close()
+		if ws != nil {
+			_ = ws.Close()
+		}
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
 
-	_ = avutil.CopyFile(muxer, cursor)
+	if err := avutil.CopyFile(muxer, cursor); err == server_interface.ErrSlowConsumer {
+		log.Printf("拉流落后, 断开: %v %v", connPath, c.Request.RemoteAddr)
+	}
 }
 
 type websocketConnWrap struct {
@@ -95,6 +143,13 @@ func (c *websocketConnWrap) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// Close 发送close帧后关闭
+func (c *websocketConnWrap) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
 type writeFlusher struct {
 	httpFlusher http.Flusher
 	io.Writer
@@ -1,43 +1,146 @@
 package http_server
 
 import (
-	"fmt"
+	"context"
+	"github.com/general252/live/server/http_server/api_server"
+	"github.com/general252/live/server/http_server/hls_server"
 	"github.com/general252/live/server/http_server/httflv_server"
+	"github.com/general252/live/server/http_server/httpts_server"
 	"github.com/general252/live/server/http_server/webrtc_server"
 	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net"
+	"net/http"
 )
 
+type Option struct {
+	Enable    bool   `yaml:"enable"`
+	Addr      string `yaml:"addr"`       // ":8080", "[::]:8080"
+	StaticDir string `yaml:"static_dir"` // 网页目录, 为空时不提供
+}
+
 type HttpServer struct {
-	parent server_interface.ServerInterface
-	port   int
+	parent       server_interface.ServerInterface
+	option       Option
+	apiOption    api_server.Option
+	hlsOption    hls_server.Option
+	webrtcOption webrtc_server.Option
+
+	server       *http.Server
+	apiServer    *http.Server // 管理API单独监听时
+	webrtcServer *webrtc_server.WebrtcServer
 }
 
-func NewHttpServer(parent server_interface.ServerInterface, port int) *HttpServer {
+func NewHttpServer(parent server_interface.ServerInterface, option Option, apiOption api_server.Option, hlsOption hls_server.Option, webrtcOption webrtc_server.Option) *HttpServer {
 	return &HttpServer{
-		parent: parent,
-		port:   port,
+		parent:       parent,
+		option:       option,
+		apiOption:    apiOption,
+		hlsOption:    hlsOption,
+		webrtcOption: webrtcOption,
 	}
 }
 
-func (tis *HttpServer) Serve() error {
+// Start 监听, 失败时返回error
+func (tis *HttpServer) Start() error {
 	// http
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 
 	var (
 		httFlvServer = httflv_server.NewHttpFlvServer(tis.parent)
-		webrtcServer = webrtc_server.NewWebrtcServer(tis.parent)
+		httpTsServer = httpts_server.NewHttpTsServer(tis.parent)
+		hlsServer    = hls_server.NewHlsServer(tis.parent, tis.hlsOption)
+		apiServer    = api_server.NewApiServer(tis.parent, tis.apiOption)
 	)
 
-	r.StaticFS("/home", gin.Dir("./static/ui", true))
-	r.GET("/httpflv/:ConnPath", httFlvServer.OnHttpFLV)
-	r.GET("/webrtc/pusher/:ConnPath", webrtcServer.OnPusher)
-	r.GET("/webrtc/player/:ConnPath", webrtcServer.OnPlayer)
+	if len(tis.option.StaticDir) > 0 {
+		r.StaticFS("/home", gin.Dir(tis.option.StaticDir, true))
+	}
+	// 路径可以有多级, 例如 /httpflv/live/cam1
+	r.GET("/httpflv/*ConnPath", httFlvServer.OnHttpFLV)
+	r.GET("/httpts/*ConnPath", httpTsServer.OnHttpTS)
+	r.GET("/hls/*Path", hlsServer.OnHls)
+	if len(tis.apiOption.Addr) == 0 {
+		apiServer.Register(r)
+	}
+
+	if tis.webrtcOption.Enable {
+		webrtcServer, err := webrtc_server.NewWebrtcServer(tis.parent, tis.webrtcOption)
+		if err != nil {
+			return err
+		}
+		tis.webrtcServer = webrtcServer
+
+		r.GET("/webrtc/pusher/*ConnPath", webrtcServer.OnPusher)
+		r.GET("/webrtc/player/*ConnPath", webrtcServer.OnPlayer)
+	}
 
 	// 启动http服务
-	addr := fmt.Sprintf(":%v", tis.port)
-	log.Printf("http listen: %v", addr)
-	return r.Run(addr)
+	listener, err := net.Listen("tcp", tis.option.Addr)
+	if err != nil {
+		if tis.webrtcServer != nil {
+			_ = tis.webrtcServer.Close()
+		}
+		return err
+	}
+
+	// 管理API单独监听
+	var apiListener net.Listener
+	if len(tis.apiOption.Addr) > 0 {
+		if apiListener, err = net.Listen("tcp", tis.apiOption.Addr); err != nil {
+			_ = listener.Close()
+			if tis.webrtcServer != nil {
+				_ = tis.webrtcServer.Close()
+			}
+			return err
+		}
+	}
+
+	log.Printf("http listen: %v", listener.Addr())
+
+	tis.server = &http.Server{
+		Handler:     r,
+		ConnContext: util.WithConn,
+	}
+	go serve(tis.server, listener)
+
+	if apiListener != nil {
+		log.Printf("api listen: %v", apiListener.Addr())
+
+		apiRouter := gin.Default()
+		apiServer.Register(apiRouter)
+		tis.apiServer = &http.Server{
+			Handler: apiRouter,
+		}
+		go serve(tis.apiServer, apiListener)
+	}
+
+	return nil
+}
+
+func serve(server *http.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+}
+
+// Shutdown 停止监听, 等待请求结束
+func (tis *HttpServer) Shutdown(ctx context.Context) error {
+	if tis.server == nil {
+		return nil
+	}
+
+	if tis.webrtcServer != nil {
+		_ = tis.webrtcServer.Close()
+	}
+
+	if tis.apiServer != nil {
+		if err := tis.apiServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return tis.server.Shutdown(ctx)
 }
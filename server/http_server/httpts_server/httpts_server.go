@@ -0,0 +1,194 @@
+package httpts_server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/general252/live/format/mpegts"
+	"github.com/general252/live/server/server_interface"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// ffplay http://localhost:8080/httpts/movie
+
+type HttpTsServer struct {
+	parent server_interface.ServerInterface
+}
+
+func NewHttpTsServer(parent server_interface.ServerInterface) *HttpTsServer {
+	return &HttpTsServer{
+		parent: parent,
+	}
+}
+
+func (tis *HttpTsServer) OnHttpTS(c *gin.Context) {
+	connPath := c.Param("ConnPath")
+	log.Println(connPath)
+
+	req := server_interface.NewHttpStreamRequest("httpts", connPath, c.Request)
+	if err := tis.parent.AuthPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	ch, ok := tis.parent.GetChannel(connPath)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{})
+		return
+	}
+
+	if err := tis.parent.OnPlay(req); err != nil {
+		c.JSON(server_interface.RejectStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	defer tis.parent.OnStop(req)
+
+	var (
+		isWebsocket = false
+		ws          *websocketConnWrap
+	)
+	if len(c.Request.Header.Get("Sec-WebSocket-Key")) != 0 {
+		var upgrade = websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+
+		wsConn, err := upgrade.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"msg": err.Error(),
+			})
+			return
+		}
+
+		ws = &websocketConnWrap{conn: wsConn}
+		isWebsocket = true
+		defer wsConn.Close()
+	}
+
+	var (
+		w        = c.Writer
+		wFlusher = writeFlusher{
+			httpFlusher: nil,
+			Writer:      w,
+		}
+	)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if isWebsocket {
+		wFlusher.Writer = ws
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(200)
+
+		wFlusher.httpFlusher = w.(http.Flusher)
+		wFlusher.httpFlusher.Flush()
+	}
+
+	cursor := ch.Subscribe("httpts", c.Request.RemoteAddr)
+	defer cursor.Close()
+
+	session := server_interface.NewSession(server_interface.SessionPlayer, "httpts", connPath, c.Request.RemoteAddr, func() {
+		cursor.Close()
+		if ws != nil {
+			_ = ws.Close()
+		}
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
+
+	if err := copyTs(mpegts.NewMuxer(wFlusher), cursor, wFlusher); err != nil {
+		log.Printf("httpts %v: %v", connPath, err)
+	}
+}
+
+// copyTs 先发送PAT/PMT, 从关键帧开始发送
+func copyTs(muxer *mpegts.Muxer, cursor av.Demuxer, flusher writeFlusher) error {
+	streams, err := cursor.Streams()
+	if err != nil {
+		return err
+	}
+
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	if err = muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+	if err = muxer.Flush(); err != nil {
+		return err
+	}
+	_ = flusher.Flush()
+
+	started := videoIdx < 0
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		if !started {
+			if int(pkt.Idx) != videoIdx || !pkt.IsKeyFrame {
+				continue
+			}
+			started = true
+		}
+
+		if err = muxer.WritePacket(pkt); err != nil {
+			return err
+		}
+		if err = muxer.Flush(); err != nil {
+			return err
+		}
+		_ = flusher.Flush()
+	}
+}
+
+type websocketConnWrap struct {
+	io.Writer
+	conn *websocket.Conn
+}
+
+func (c *websocketConnWrap) Write(data []byte) (int, error) {
+	err := c.conn.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// Close 发送close帧后关闭
+func (c *websocketConnWrap) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+type writeFlusher struct {
+	httpFlusher http.Flusher
+	io.Writer
+}
+
+func (c writeFlusher) Flush() error {
+	if c.httpFlusher != nil {
+		c.httpFlusher.Flush()
+	}
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
 	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/av/pubsub"
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/deepch/vdk/codec/h265parser"
@@ -28,7 +27,7 @@ type Proxy struct {
 	peerConnection      *webrtc.PeerConnection
 
 	sourceChannel *server_interface.Channel
-	cursor        *pubsub.QueueCursor
+	cursor        *server_interface.Subscriber
 
 	tracksSample []*webrtc.TrackLocalStaticSample
 	tracks       []*webrtc.TrackLocalStaticRTP
@@ -39,24 +38,26 @@ func NewProxy(connPath string, conn *websocket.Conn, sourceChannel *server_inter
 		connPath:            connPath,
 		websocketConnection: conn,
 		sourceChannel:       sourceChannel,
-		cursor:              sourceChannel.Que.Latest(),
+		cursor:              sourceChannel.Subscribe("webrtc", conn.RemoteAddr().String()),
 	}
 }
 
 func (tis *Proxy) Close() error {
+	tis.cursor.Close()
+
 	if tis.peerConnection != nil {
 		_ = tis.peerConnection.Close()
 	}
 
 	if tis.websocketConnection != nil {
-		_ = tis.websocketConnection.Close()
+		_ = closeWebsocket(tis.websocketConnection)
 	}
 
 	return nil
 }
 
 // OnOfferSample 拉流请求
-func (tis *Proxy) OnOfferSample(request *JsonRequest, api *webrtc.API, tracks []*webrtc.TrackLocalStaticSample) error {
+func (tis *Proxy) OnOfferSample(request *JsonRequest, api *peerApi, tracks []*webrtc.TrackLocalStaticSample) error {
 	if request.Data.Offer == nil {
 		return fmt.Errorf("offer sdp is nil")
 	}
@@ -67,13 +68,7 @@ func (tis *Proxy) OnOfferSample(request *JsonRequest, api *webrtc.API, tracks []
 
 	var wsConnection = tis.websocketConnection
 
-	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	peerConnection, err := api.newPeerConnection()
 	if err != nil {
 		return err
 	}
@@ -133,7 +128,7 @@ func (tis *Proxy) OnOfferSample(request *JsonRequest, api *webrtc.API, tracks []
 	return nil
 }
 
-func (tis *Proxy) OnOffer(request *JsonRequest, api *webrtc.API, tracks []*webrtc.TrackLocalStaticRTP) error {
+func (tis *Proxy) OnOffer(request *JsonRequest, api *peerApi, tracks []*webrtc.TrackLocalStaticRTP) error {
 	if request.Data.Offer == nil {
 		return fmt.Errorf("offer sdp is nil")
 	}
@@ -144,13 +139,7 @@ func (tis *Proxy) OnOffer(request *JsonRequest, api *webrtc.API, tracks []*webrt
 
 	var wsConnection = tis.websocketConnection
 
-	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	peerConnection, err := api.newPeerConnection()
 	if err != nil {
 		return err
 	}
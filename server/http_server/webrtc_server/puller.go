@@ -42,7 +42,7 @@ func (tis *Puller) GetConnPath() string {
 }
 
 // OnOffer 拉流请求
-func (tis *Puller) OnOffer(request *JsonRequest, api *webrtc.API, tracks []*webrtc.TrackLocalStaticRTP) error {
+func (tis *Puller) OnOffer(request *JsonRequest, api *peerApi, tracks []*webrtc.TrackLocalStaticRTP) error {
 	if request.Data.Offer == nil {
 		return fmt.Errorf("offer sdp is nil")
 	}
@@ -53,13 +53,7 @@ func (tis *Puller) OnOffer(request *JsonRequest, api *webrtc.API, tracks []*webr
 
 	var wsConnection = tis.websocketConnection
 
-	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	peerConnection, err := api.newPeerConnection()
 	if err != nil {
 		return err
 	}
@@ -203,7 +197,7 @@ func (tis *Puller) Close() error {
 	}
 
 	if tis.websocketConnection != nil {
-		_ = tis.websocketConnection.Close()
+		_ = closeWebsocket(tis.websocketConnection)
 	}
 
 	return nil
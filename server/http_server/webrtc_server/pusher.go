@@ -49,7 +49,7 @@ func (tis *Pusher) Close() error {
 	}
 
 	if tis.websocketConnection != nil {
-		_ = tis.websocketConnection.Close()
+		_ = closeWebsocket(tis.websocketConnection)
 	}
 
 	return nil
@@ -60,7 +60,7 @@ func (tis *Pusher) OnCandidate(request *JsonRequest) error {
 }
 
 // OnOffer 推流请求
-func (tis *Pusher) OnOffer(request *JsonRequest, api *webrtc.API) error {
+func (tis *Pusher) OnOffer(request *JsonRequest, api *peerApi) error {
 	if request.Data.Offer == nil {
 		return fmt.Errorf("offer sdp is nil")
 	}
@@ -71,13 +71,7 @@ func (tis *Pusher) OnOffer(request *JsonRequest, api *webrtc.API) error {
 
 	var wsConnection = tis.websocketConnection
 
-	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	peerConnection, err := api.newPeerConnection()
 	if err != nil {
 		return err
 	}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/general252/live/server/server_interface"
 	"github.com/general252/live/util"
@@ -15,22 +16,82 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+type Option struct {
+	Enable     bool        `yaml:"enable"`
+	MuxAddr    string      `yaml:"mux_addr"`     // 所有webrtc流量共用的udp地址 ":7000"
+	IceServers []IceServer `yaml:"ice_servers"`  // stun/turn
+	Nat1To1IPs []string    `yaml:"nat_1to1_ips"` // 公网ip, 用于NAT后的服务器
+}
+
+type IceServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+// peerApi 创建PeerConnection的api和配置
+type peerApi struct {
+	*webrtc.API
+	config webrtc.Configuration
+}
+
+func (tis *peerApi) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return tis.NewPeerConnection(tis.config)
+}
+
 type WebrtcServer struct {
 	parent server_interface.ServerInterface
 
-	api     *webrtc.API
-	pushers *util.Map[string, *Pusher]
+	api         *peerApi
+	pushers     *util.Map[string, *Pusher]
+	udpListener *net.UDPConn
 }
 
-func NewWebrtcServer(parent server_interface.ServerInterface) *WebrtcServer {
+func NewWebrtcServer(parent server_interface.ServerInterface, option Option) (*WebrtcServer, error) {
 	engine := &WebrtcServer{
 		parent:  parent,
 		pushers: util.NewMap[string, *Pusher](),
 	}
 
-	muxUdpPort := 7000
-	engine.api = webrtc.NewAPI(engine.getMuxOptions(muxUdpPort)...)
-	return engine
+	options, err := engine.getMuxOptions(option)
+	if err != nil {
+		return nil, err
+	}
+
+	var config webrtc.Configuration
+	for _, server := range option.IceServers {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+
+	engine.api = &peerApi{
+		API:    webrtc.NewAPI(options...),
+		config: config,
+	}
+	return engine, nil
+}
+
+// Close 关闭所有推流和udp监听
+func (tis *WebrtcServer) Close() error {
+	tis.pushers.Range(func(key string, value *Pusher) bool {
+		_ = value.Close()
+		return true
+	})
+
+	if tis.udpListener != nil {
+		return tis.udpListener.Close()
+	}
+	return nil
+}
+
+// closeWebsocket 发送close帧后关闭
+func closeWebsocket(conn *websocket.Conn) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return conn.Close()
 }
 
 func (tis *WebrtcServer) OnPusher(c *gin.Context) {
@@ -41,7 +102,7 @@ func (tis *WebrtcServer) OnPusher(c *gin.Context) {
 	}
 
 	// 获取参数
-	connPath := "/" + c.Param("ConnPath")
+	connPath := c.Param("ConnPath")
 	log.Println(connPath)
 	defer func() {
 		log.Printf("%v 推流请求结束", connPath)
@@ -61,6 +122,20 @@ func (tis *WebrtcServer) OnPusher(c *gin.Context) {
 		return
 	}
 
+	// 推流鉴权
+	req := server_interface.NewHttpStreamRequest("webrtc", connPath, c.Request)
+	if err := tis.parent.OnPublish(req); err != nil {
+		var reply = JsonResponse{
+			Method: Answer,
+			Code:   1,
+			Msg:    err.Error(),
+			Data:   JsonResponsePayload{},
+		}
+		c.JSON(server_interface.RejectStatus(err), &reply)
+		return
+	}
+	defer tis.parent.OnUnpublish(req)
+
 	// 升级为websocket connection
 	conn, err := websocketUpGrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -78,6 +153,12 @@ func (tis *WebrtcServer) OnPusher(c *gin.Context) {
 
 	tis.pushers.Store(connPath, objectPusher)
 
+	session := server_interface.NewSession(server_interface.SessionPublisher, "webrtc", connPath, conn.RemoteAddr().String(), func() {
+		_ = objectPusher.Close()
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
+
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
@@ -118,18 +199,31 @@ func (tis *WebrtcServer) OnPlayer(c *gin.Context) {
 	}
 
 	// 获取参数
-	connPath := "/" + c.Param("ConnPath")
+	connPath := c.Param("ConnPath")
 	log.Println(connPath)
 	defer func() {
 		log.Printf("%v 拉流请求结束", connPath)
 	}()
 
+	// 拉流鉴权
+	req := server_interface.NewHttpStreamRequest("webrtc", connPath, c.Request)
+	if err := tis.parent.AuthPlay(req); err != nil {
+		tis.reject(c, err)
+		return
+	}
+
 	// 检查是否存在
 	objectPusher, ok := tis.pushers.Load(connPath)
 	if !ok {
-		tis.onProxy(c)
+		tis.onProxy(c, req)
+		return
+	}
+
+	if err := tis.parent.OnPlay(req); err != nil {
+		tis.reject(c, err)
 		return
 	}
+	defer tis.parent.OnStop(req)
 
 	tracks, ok := objectPusher.NewTrackerRTP([]webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio})
 	if !ok {
@@ -157,6 +251,12 @@ func (tis *WebrtcServer) OnPlayer(c *gin.Context) {
 		_ = conn.Close()
 	}()
 
+	session := server_interface.NewSession(server_interface.SessionPlayer, "webrtc", connPath, conn.RemoteAddr().String(), func() {
+		_ = objectPuller.Close()
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
+
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
@@ -190,7 +290,19 @@ func (tis *WebrtcServer) OnPlayer(c *gin.Context) {
 	}
 }
 
-func (tis *WebrtcServer) onProxy(c *gin.Context) {
+// reject 鉴权或OnPlay失败
+func (tis *WebrtcServer) reject(c *gin.Context, err error) {
+	var reply = JsonResponse{
+		Method: Answer,
+		Code:   1,
+		Msg:    err.Error(),
+		Data:   JsonResponsePayload{},
+	}
+	c.JSON(server_interface.RejectStatus(err), &reply)
+}
+
+// onProxy 不是webrtc推流时从channel读取, req已经鉴权
+func (tis *WebrtcServer) onProxy(c *gin.Context, req *server_interface.StreamRequest) {
 	var websocketUpGrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -198,7 +310,7 @@ func (tis *WebrtcServer) onProxy(c *gin.Context) {
 	}
 
 	// 获取参数
-	connPath := "/" + c.Param("ConnPath")
+	connPath := c.Param("ConnPath")
 	log.Println(connPath)
 
 	// 检查是否存在
@@ -214,6 +326,12 @@ func (tis *WebrtcServer) onProxy(c *gin.Context) {
 		return
 	}
 
+	if err := tis.parent.OnPlay(req); err != nil {
+		tis.reject(c, err)
+		return
+	}
+	defer tis.parent.OnStop(req)
+
 	// 升级为websocket connection
 	conn, err := websocketUpGrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -227,6 +345,12 @@ func (tis *WebrtcServer) onProxy(c *gin.Context) {
 		_ = conn.Close()
 	}()
 
+	session := server_interface.NewSession(server_interface.SessionPlayer, "webrtc", connPath, conn.RemoteAddr().String(), func() {
+		_ = objectProxy.Close()
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
+
 	tracks, ok := objectProxy.NewTrackerRTP([]webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio})
 	if !ok {
 		var reply = JsonResponse{
@@ -274,15 +398,17 @@ func (tis *WebrtcServer) onProxy(c *gin.Context) {
 	}
 }
 
-func (tis *WebrtcServer) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
-	// Listen on UDP Port 2000, will be used for all WebRTC traffic
-	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: muxUdpPort,
-	})
+func (tis *WebrtcServer) getMuxOptions(option Option) ([]func(*webrtc.API), error) {
+	// Listen on UDP Port 7000, will be used for all WebRTC traffic
+	addr, err := net.ResolveUDPAddr("udp", option.MuxAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	udpListener, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tis.udpListener = udpListener
 
 	_ = udpListener.SetWriteBuffer(512 * 1024)
 	_ = udpListener.SetReadBuffer(512 * 1024)
@@ -299,6 +425,9 @@ func (tis *WebrtcServer) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 		// no global state. The API+SettingEngine allows the user to share state between them.
 		// In this case we are sharing our listening port across many.
 		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+		if len(option.Nat1To1IPs) > 0 {
+			settingEngine.SetNAT1To1IPs(option.Nat1To1IPs, webrtc.ICECandidateTypeHost)
+		}
 
 		options = append(options, webrtc.WithSettingEngine(settingEngine))
 	}
@@ -352,13 +481,13 @@ func (tis *WebrtcServer) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 				webrtc.RTPCodecTypeVideo,
 			)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 		} else {
 			for _, param := range codecParams {
 				err = m.RegisterCodec(param, webrtc.RTPCodecTypeVideo)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 			}
 		}
@@ -377,7 +506,7 @@ func (tis *WebrtcServer) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 			webrtc.RTPCodecTypeAudio,
 		)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
@@ -389,11 +518,11 @@ func (tis *WebrtcServer) getMuxOptions(muxUdpPort int) []func(*webrtc.API) {
 
 	// Use the default set of Interceptors
 	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	options = append(options, webrtc.WithMediaEngine(m))
 	options = append(options, webrtc.WithInterceptorRegistry(i))
 
-	return options
+	return options, nil
 }
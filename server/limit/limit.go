@@ -0,0 +1,307 @@
+package limit
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// Rule 限制, 0 不限制. 全局配置对整个服务器计数, 路径配置对匹配的每个channel计数
+type Rule struct {
+	MaxPublishers         int            `yaml:"max_publishers"`           // 推流数, 包括备用推流
+	MaxViewers            int            `yaml:"max_viewers"`              // 拉流数
+	MaxViewersPerProtocol map[string]int `yaml:"max_viewers_per_protocol"` // rtmp, rtsp, httpflv, httpts, hls, webrtc -> 拉流数
+	MaxEgressBitrate      int64          `yaml:"max_egress_bitrate"`       // 输出码率 bit/s, 按推流码率乘以拉流数估算, 加上转发
+	MaxPublisherBitrate   int64          `yaml:"max_publisher_bitrate"`    // 推流码率 bit/s, 持续超过bitrate_grace踢出
+}
+
+// Option 全局限制和按路径的限制
+type Option struct {
+	Rule         `yaml:",inline"`
+	Paths        map[string]Rule `yaml:"paths"`         // connPath或通配符 -> 限制
+	BitrateGrace time.Duration   `yaml:"bitrate_grace"` // 推流码率超过限制多久后踢出
+}
+
+// Limiter 推流/拉流开始时检查数量和带宽, 定期检查推流码率
+type Limiter struct {
+	parent server_interface.ServerInterface
+
+	mutex  sync.RWMutex
+	option Option
+
+	overSince map[string]time.Time // connPath generation -> 码率开始超过限制的时间, 只在monitor中使用
+
+	countMutex sync.Mutex // 检查和占用在同一个锁中, 并发的请求不会同时通过
+	publishers *counter
+	viewers    *counter
+	reserved   map[*server_interface.StreamRequest]*counter // 已占用名额的请求 -> 计数
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewLimiter(parent server_interface.ServerInterface, option Option) *Limiter {
+	return &Limiter{
+		parent:     parent,
+		option:     option,
+		overSince:  map[string]time.Time{},
+		publishers: newCounter(),
+		viewers:    newCounter(),
+		reserved:   map[*server_interface.StreamRequest]*counter{},
+		done:       make(chan struct{}),
+	}
+}
+
+// counter 推流或拉流数量, 全局/路径/协议
+type counter struct {
+	total         int
+	paths         map[string]int // connPath -> 数量
+	protocols     map[string]int // protocol -> 数量
+	pathProtocols map[string]int // connPath protocol -> 数量
+}
+
+func newCounter() *counter {
+	return &counter{
+		paths:         map[string]int{},
+		protocols:     map[string]int{},
+		pathProtocols: map[string]int{},
+	}
+}
+
+func (tis *counter) add(req *server_interface.StreamRequest, n int) {
+	key := req.ConnPath + " " + req.Protocol
+
+	tis.total += n
+	tis.paths[req.ConnPath] += n
+	tis.protocols[req.Protocol] += n
+	tis.pathProtocols[key] += n
+
+	if tis.paths[req.ConnPath] <= 0 {
+		delete(tis.paths, req.ConnPath)
+	}
+	if tis.protocols[req.Protocol] <= 0 {
+		delete(tis.protocols, req.Protocol)
+	}
+	if tis.pathProtocols[key] <= 0 {
+		delete(tis.pathProtocols, key)
+	}
+}
+
+// reserve 占用一个名额, 同一个请求只占用一次
+func (tis *Limiter) reserve(req *server_interface.StreamRequest, c *counter) {
+	if _, ok := tis.reserved[req]; ok {
+		return
+	}
+	tis.reserved[req] = c
+	c.add(req, 1)
+}
+
+// Release 释放CheckPublish/CheckPlay占用的名额, 在OnUnpublish/OnStop或者后续检查失败时调用, 重复调用无影响
+func (tis *Limiter) Release(req *server_interface.StreamRequest) {
+	tis.countMutex.Lock()
+	defer tis.countMutex.Unlock()
+
+	if c, ok := tis.reserved[req]; ok {
+		delete(tis.reserved, req)
+		c.add(req, -1)
+	}
+}
+
+// Reload 替换限制, 已有的连接不断开
+func (tis *Limiter) Reload(option Option) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.option = option
+}
+
+// rules 全局限制和路径的限制
+func (tis *Limiter) rules(connPath string) (Option, Rule, bool) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	rule, ok := util.MatchPath(tis.option.Paths, connPath)
+	return tis.option, rule, ok
+}
+
+// CheckPublish 超过推流数量时返回ErrLimitExceeded, 通过时占用一个名额, 结束时调用Release
+func (tis *Limiter) CheckPublish(req *server_interface.StreamRequest) error {
+	global, rule, ok := tis.rules(req.ConnPath)
+
+	tis.countMutex.Lock()
+	defer tis.countMutex.Unlock()
+
+	total, onPath := tis.publishers.total, tis.publishers.paths[req.ConnPath]
+	if exceeded(global.MaxPublishers, total) {
+		return fmt.Errorf("publishers %v: %w", total, server_interface.ErrLimitExceeded)
+	}
+	if ok && exceeded(rule.MaxPublishers, onPath) {
+		return fmt.Errorf("%v publishers %v: %w", req.ConnPath, onPath, server_interface.ErrLimitExceeded)
+	}
+
+	tis.reserve(req, tis.publishers)
+	return nil
+}
+
+// CheckPlay 超过拉流数量时返回ErrLimitExceeded, 超过输出码率时返回ErrBandwidthExceeded,
+// 通过时占用一个名额, 结束时调用Release
+func (tis *Limiter) CheckPlay(req *server_interface.StreamRequest) error {
+	global, rule, ok := tis.rules(req.ConnPath)
+
+	checkEgress := global.MaxEgressBitrate > 0 || (ok && rule.MaxEgressBitrate > 0)
+
+	var infos []server_interface.ChannelInfo
+	if checkEgress {
+		for _, ch := range tis.parent.GetChannels() {
+			infos = append(infos, ch.Info())
+		}
+	}
+
+	tis.countMutex.Lock()
+	defer tis.countMutex.Unlock()
+
+	var (
+		total          = tis.viewers.total
+		totalProtocol  = tis.viewers.protocols[req.Protocol]
+		onPath         = tis.viewers.paths[req.ConnPath]
+		onPathProtocol = tis.viewers.pathProtocols[req.ConnPath+" "+req.Protocol]
+	)
+
+	if exceeded(global.MaxViewers, total) {
+		return fmt.Errorf("viewers %v: %w", total, server_interface.ErrLimitExceeded)
+	}
+	if exceeded(global.MaxViewersPerProtocol[req.Protocol], totalProtocol) {
+		return fmt.Errorf("%v viewers %v: %w", req.Protocol, totalProtocol, server_interface.ErrLimitExceeded)
+	}
+	if ok && exceeded(rule.MaxViewers, onPath) {
+		return fmt.Errorf("%v viewers %v: %w", req.ConnPath, onPath, server_interface.ErrLimitExceeded)
+	}
+	if ok && exceeded(rule.MaxViewersPerProtocol[req.Protocol], onPathProtocol) {
+		return fmt.Errorf("%v %v viewers %v: %w", req.ConnPath, req.Protocol, onPathProtocol, server_interface.ErrLimitExceeded)
+	}
+
+	if checkEgress {
+		if err := tis.checkEgress(req, global, rule, ok, infos); err != nil {
+			return err
+		}
+	}
+
+	tis.reserve(req, tis.viewers)
+	return nil
+}
+
+// checkEgress 新的读者增加一路推流的码率, 按需拉流的channel还不存在时为0. 在countMutex中调用
+func (tis *Limiter) checkEgress(req *server_interface.StreamRequest, global Option, rule Rule, ok bool, infos []server_interface.ChannelInfo) error {
+	var totalEgress, pathEgress, bitrate int64
+	for _, info := range infos {
+		egress := info.Bitrate * int64(tis.viewers.paths[info.ConnPath])
+		for _, push := range info.Pushes {
+			egress += push.Bitrate
+		}
+
+		totalEgress += egress
+		if info.ConnPath == req.ConnPath {
+			pathEgress = egress
+			bitrate = info.Bitrate
+		}
+	}
+
+	if global.MaxEgressBitrate > 0 && totalEgress+bitrate > global.MaxEgressBitrate {
+		return fmt.Errorf("egress %v bit/s: %w", totalEgress, server_interface.ErrBandwidthExceeded)
+	}
+	if ok && rule.MaxEgressBitrate > 0 && pathEgress+bitrate > rule.MaxEgressBitrate {
+		return fmt.Errorf("%v egress %v bit/s: %w", req.ConnPath, pathEgress, server_interface.ErrBandwidthExceeded)
+	}
+	return nil
+}
+
+// exceeded 已有count个时是否还能再加一个
+func exceeded(max int, count int) bool {
+	return max > 0 && count >= max
+}
+
+// Start 开始检查推流码率
+func (tis *Limiter) Start() {
+	tis.wg.Add(1)
+	go func() {
+		defer tis.wg.Done()
+		tis.monitor()
+	}()
+}
+
+func (tis *Limiter) monitor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tis.done:
+			return
+		case <-ticker.C:
+		}
+
+		tis.checkBitrate()
+	}
+}
+
+// checkBitrate 当前推流的码率持续超过限制时踢出, 换了推流重新计时
+func (tis *Limiter) checkBitrate() {
+	tis.mutex.RLock()
+	option := tis.option
+	tis.mutex.RUnlock()
+
+	over := map[string]time.Time{}
+	for _, ch := range tis.parent.GetChannels() {
+		info := ch.Info()
+
+		max := option.MaxPublisherBitrate
+		if rule, ok := util.MatchPath(option.Paths, info.ConnPath); ok && rule.MaxPublisherBitrate > 0 {
+			max = rule.MaxPublisherBitrate
+		}
+		if max <= 0 || info.Bitrate <= max {
+			continue
+		}
+
+		key := fmt.Sprintf("%v %v", info.ConnPath, info.Generation)
+		since, ok := tis.overSince[key]
+		if !ok {
+			since = time.Now()
+		}
+		if time.Since(since) < option.BitrateGrace {
+			over[key] = since
+			continue
+		}
+
+		if tis.kick(info) {
+			log.Printf("publisher bitrate exceeded: %v %v %v bit/s > %v bit/s", info.ConnPath, info.RemoteAddr, info.Bitrate, max)
+		}
+	}
+	tis.overSince = over
+}
+
+// kick 断开当前推流的会话, 垫片和拉流转发没有会话
+func (tis *Limiter) kick(info server_interface.ChannelInfo) bool {
+	for _, session := range tis.parent.GetSessions() {
+		if session.GetType() == server_interface.SessionPublisher &&
+			session.GetConnPath() == info.ConnPath &&
+			session.GetProtocol() == info.Protocol &&
+			session.GetRemoteAddr() == info.RemoteAddr {
+			session.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Close 停止检查
+func (tis *Limiter) Close() {
+	tis.stopOnce.Do(func() {
+		close(tis.done)
+	})
+	tis.wg.Wait()
+}
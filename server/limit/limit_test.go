@@ -0,0 +1,267 @@
+package limit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/general252/live/server/server_interface"
+)
+
+// testServer 只实现GetChannels
+type testServer struct {
+	server_interface.ServerInterface
+	channels []*server_interface.Channel
+}
+
+func (tis *testServer) GetChannels() []*server_interface.Channel {
+	return tis.channels
+}
+
+// testChannel 推流码率约为bitrate
+func testChannel(t *testing.T, connPath string, bitrate int) *server_interface.Channel {
+	t.Helper()
+
+	ch := server_interface.NewChannel(connPath, nil)
+	handle, err := ch.Acquire(server_interface.ChannelPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = handle.WritePacket(av.Packet{Data: make([]byte, bitrate/8)})
+	time.Sleep(time.Second)
+	_ = handle.WritePacket(av.Packet{})
+
+	if info := ch.Info(); info.Bitrate <= 0 || info.Bitrate > int64(bitrate) {
+		t.Fatalf("bitrate %v, want about %v", info.Bitrate, bitrate)
+	}
+	return ch
+}
+
+func request(protocol string, connPath string) *server_interface.StreamRequest {
+	return server_interface.NewStreamRequest(protocol, connPath, "127.0.0.1:1000", nil)
+}
+
+func TestLimiterCheckPublish(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Option
+		before []*server_interface.StreamRequest // 已通过的推流
+		req    *server_interface.StreamRequest
+
+		wantErr error
+	}{
+		{name: "no limit", before: []*server_interface.StreamRequest{request("rtmp", "/live/a")}, req: request("rtmp", "/live/a")},
+		{
+			name:    "global",
+			option:  Option{Rule: Rule{MaxPublishers: 1}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtsp", "/live/b"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:    "path",
+			option:  Option{Paths: map[string]Rule{"/live/*": {MaxPublishers: 1}}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtsp", "/live/a"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:   "path counted per channel",
+			option: Option{Paths: map[string]Rule{"/live/*": {MaxPublishers: 1}}},
+			before: []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:    request("rtmp", "/live/b"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewLimiter(&testServer{}, tt.option)
+			for _, req := range tt.before {
+				if err := limiter.CheckPublish(req); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := limiter.CheckPublish(tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+
+			// 拒绝时不占用名额, 通过时占用一个
+			want := len(tt.before)
+			if err == nil {
+				want++
+			}
+			if limiter.publishers.total != want || len(limiter.reserved) != want {
+				t.Fatalf("publishers %v reserved %v, want %v", limiter.publishers.total, len(limiter.reserved), want)
+			}
+
+			for _, req := range append(tt.before, tt.req) {
+				limiter.Release(req)
+			}
+			checkEmpty(t, limiter)
+		})
+	}
+}
+
+func TestLimiterCheckPlay(t *testing.T) {
+	ch := testChannel(t, "/live/a", 8000)
+
+	tests := []struct {
+		name   string
+		option Option
+		before []*server_interface.StreamRequest // 已通过的拉流
+		req    *server_interface.StreamRequest
+
+		wantErr error
+	}{
+		{name: "no limit", before: []*server_interface.StreamRequest{request("rtmp", "/live/a")}, req: request("rtmp", "/live/a")},
+		{
+			name:    "global",
+			option:  Option{Rule: Rule{MaxViewers: 1}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtsp", "/live/b"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:    "global protocol",
+			option:  Option{Rule: Rule{MaxViewersPerProtocol: map[string]int{"rtmp": 1}}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtmp", "/live/b"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:   "global other protocol",
+			option: Option{Rule: Rule{MaxViewersPerProtocol: map[string]int{"rtmp": 1}}},
+			before: []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:    request("hls", "/live/a"),
+		},
+		{
+			name:    "path",
+			option:  Option{Paths: map[string]Rule{"/live/*": {MaxViewers: 1}}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtsp", "/live/a"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:    "path protocol",
+			option:  Option{Paths: map[string]Rule{"/live/*": {MaxViewersPerProtocol: map[string]int{"rtmp": 1}}}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtmp", "/live/a"),
+			wantErr: server_interface.ErrLimitExceeded,
+		},
+		{
+			name:   "global egress",
+			option: Option{Rule: Rule{MaxEgressBitrate: 10000}},
+			req:    request("rtmp", "/live/a"),
+		},
+		{
+			name:    "global egress exceeded",
+			option:  Option{Rule: Rule{MaxEgressBitrate: 10000}},
+			before:  []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:     request("rtmp", "/live/a"),
+			wantErr: server_interface.ErrBandwidthExceeded,
+		},
+		{
+			name:    "path egress exceeded",
+			option:  Option{Paths: map[string]Rule{"/live/a": {MaxEgressBitrate: 10000}}},
+			before:  []*server_interface.StreamRequest{request("hls", "/live/a")},
+			req:     request("rtmp", "/live/a"),
+			wantErr: server_interface.ErrBandwidthExceeded,
+		},
+		{
+			name:   "egress of a channel not started",
+			option: Option{Rule: Rule{MaxEgressBitrate: 10000}},
+			before: []*server_interface.StreamRequest{request("rtmp", "/live/a")},
+			req:    request("rtmp", "/live/b"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewLimiter(&testServer{channels: []*server_interface.Channel{ch}}, tt.option)
+			for _, req := range tt.before {
+				if err := limiter.CheckPlay(req); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := limiter.CheckPlay(tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+
+			want := len(tt.before)
+			if err == nil {
+				want++
+			}
+			if limiter.viewers.total != want || len(limiter.reserved) != want {
+				t.Fatalf("viewers %v reserved %v, want %v", limiter.viewers.total, len(limiter.reserved), want)
+			}
+
+			for _, req := range append(tt.before, tt.req) {
+				limiter.Release(req)
+			}
+			checkEmpty(t, limiter)
+		})
+	}
+}
+
+func TestLimiterRelease(t *testing.T) {
+	limiter := NewLimiter(&testServer{}, Option{Rule: Rule{MaxPublishers: 2, MaxViewers: 1}})
+	publisher, player := request("rtmp", "/live/a"), request("rtmp", "/live/a")
+
+	// 同一个请求重复检查只占用一次
+	for i := 0; i < 2; i++ {
+		if err := limiter.CheckPublish(publisher); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if limiter.publishers.total != 1 {
+		t.Fatalf("publishers %v, want 1", limiter.publishers.total)
+	}
+	if err := limiter.CheckPublish(request("rtmp", "/live/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.CheckPublish(request("rtmp", "/live/c")); !errors.Is(err, server_interface.ErrLimitExceeded) {
+		t.Fatalf("err %v, want %v", err, server_interface.ErrLimitExceeded)
+	}
+	if err := limiter.CheckPlay(player); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重复释放和释放未通过的请求无影响
+	limiter.Release(request("rtmp", "/live/a"))
+	limiter.Release(publisher)
+	limiter.Release(publisher)
+	if limiter.publishers.total != 1 || limiter.viewers.total != 1 {
+		t.Fatalf("publishers %v viewers %v, want 1 1", limiter.publishers.total, limiter.viewers.total)
+	}
+	if err := limiter.CheckPublish(request("rtmp", "/live/c")); err != nil {
+		t.Fatalf("publisher not released: %v", err)
+	}
+	if err := limiter.CheckPlay(request("rtmp", "/live/b")); !errors.Is(err, server_interface.ErrLimitExceeded) {
+		t.Fatalf("err %v, want %v", err, server_interface.ErrLimitExceeded)
+	}
+
+	limiter.Release(player)
+	if err := limiter.CheckPlay(request("rtmp", "/live/b")); err != nil {
+		t.Fatalf("player not released: %v", err)
+	}
+}
+
+// checkEmpty 所有名额都已释放
+func checkEmpty(t *testing.T, limiter *Limiter) {
+	t.Helper()
+
+	for _, c := range []*counter{limiter.publishers, limiter.viewers} {
+		if c.total != 0 || len(c.paths) != 0 || len(c.protocols) != 0 || len(c.pathProtocols) != 0 {
+			t.Fatalf("counter not empty: %+v", c)
+		}
+	}
+	if len(limiter.reserved) != 0 {
+		t.Fatalf("%v requests still reserved", len(limiter.reserved))
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"os"
+	"time"
+
+	"github.com/general252/live/server/auth"
+	"github.com/general252/live/server/cluster"
+	"github.com/general252/live/server/http_server"
+	"github.com/general252/live/server/http_server/api_server"
+	"github.com/general252/live/server/http_server/hls_server"
+	"github.com/general252/live/server/http_server/webrtc_server"
+	"github.com/general252/live/server/limit"
+	"github.com/general252/live/server/record"
+	"github.com/general252/live/server/relay"
+	"github.com/general252/live/server/rtmp_server"
+	"github.com/general252/live/server/rtsp_server"
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/server/slate"
+	"github.com/general252/live/server/udp_server"
+	"github.com/general252/live/server/web_hook"
+	"github.com/general252/live/util"
+	"gopkg.in/yaml.v3"
+)
+
+type Option struct {
+	Rtmp   rtmp_server.Option   `yaml:"rtmp"`
+	Http   http_server.Option   `yaml:"http"`
+	Api    api_server.Option    `yaml:"api"` // 管理API, 随http启动
+	Rtsp   rtsp_server.Option   `yaml:"rtsp"`
+	Webrtc webrtc_server.Option `yaml:"webrtc"` // 信令使用http端口
+	Hls    hls_server.Option    `yaml:"hls"`
+	Udp    udp_server.Option    `yaml:"udp"` // udp ts 输入输出
+
+	Cluster cluster.Option `yaml:"cluster"` // 源站/边缘
+
+	// 以下配置在Reload时生效
+	WebHook web_hook.Option  `yaml:"web_hook"` // http回调
+	Auth    auth.Option      `yaml:"auth"`     // 推流/拉流鉴权
+	Channel ChannelOption    `yaml:"channel"`  // 同一路径多个推流
+	Slate   slate.Option     `yaml:"slate"`    // 没有推流时循环播放文件
+	Pull    relay.PullOption `yaml:"pull"`     // 有读者时从上游拉流
+	Push    relay.PushOption `yaml:"push"`     // 有推流时转发到其他服务器
+	Limits  limit.Option     `yaml:"limits"`   // 连接数和带宽限制
+	Record  record.Option    `yaml:"record"`   // 录制为flv文件
+
+	SlowConsumer server_interface.LagPolicy `yaml:"slow_consumer"` // rtmp/http-flv拉流落后时的处理
+}
+
+// ChannelOption 同一路径已有推流时的处理
+type ChannelOption struct {
+	Conflict server_interface.ConflictPolicy            `yaml:"conflict"` // reject, replace, backup
+	Paths    map[string]server_interface.ConflictPolicy `yaml:"paths"`    // connPath或通配符 -> policy
+	Grace    time.Duration                              `yaml:"grace"`    // 推流断开后保留channel的时间, 期间重连读者不断开
+
+	// backup时, 当前推流超过这个时间没有数据切换到备用推流, 主推流恢复后切回, 0 只在断开时切换
+	FailoverTimeout time.Duration `yaml:"failover_timeout"`
+
+	GopCache      server_interface.GopCacheOption            `yaml:"gop_cache"`       // 新的读者从缓存的关键帧开始
+	GopCachePaths map[string]server_interface.GopCacheOption `yaml:"gop_cache_paths"` // connPath或通配符 -> gop缓存, 替换gop_cache
+
+	Timeshift      server_interface.TimeshiftOption            `yaml:"timeshift"`       // 读者可以从最新数据往前开始
+	TimeshiftPaths map[string]server_interface.TimeshiftOption `yaml:"timeshift_paths"` // connPath或通配符 -> 时移, 替换timeshift
+}
+
+// getConflict 路径的冲突处理
+func (tis ChannelOption) getConflict(connPath string) server_interface.ConflictPolicy {
+	if policy, ok := util.MatchPath(tis.Paths, connPath); ok {
+		return policy
+	}
+	return tis.Conflict
+}
+
+// getGopCache 路径的gop缓存, 精确匹配优先, 然后按通配符匹配
+func (tis ChannelOption) getGopCache(connPath string) server_interface.GopCacheOption {
+	if option, ok := util.MatchPath(tis.GopCachePaths, connPath); ok {
+		return option
+	}
+	return tis.GopCache
+}
+
+// getTimeshift 路径的时移, 精确匹配优先, 然后按通配符匹配
+func (tis ChannelOption) getTimeshift(connPath string) server_interface.TimeshiftOption {
+	if option, ok := util.MatchPath(tis.TimeshiftPaths, connPath); ok {
+		return option
+	}
+	return tis.Timeshift
+}
+
+// DefaultOption 默认配置, 配置文件中没有的项使用默认值
+func DefaultOption() *Option {
+	return &Option{
+		Rtmp: rtmp_server.Option{
+			Enable: true,
+			Addr:   ":1935",
+		},
+		Http: http_server.Option{
+			Enable:    true,
+			Addr:      ":8080",
+			StaticDir: "./static/ui",
+		},
+		Rtsp: rtsp_server.Option{
+			Enable:            true,
+			Addr:              ":554",
+			UdpRtpAddr:        ":8000",
+			UdpRtcpAddr:       ":8001",
+			MulticastIPRange:  "224.1.0.0/16",
+			MulticastRtpPort:  8002,
+			MulticastRtcpPort: 8003,
+		},
+		Api: api_server.Option{
+			Addr: "127.0.0.1:8081",
+		},
+		Webrtc: webrtc_server.Option{
+			Enable:  true,
+			MuxAddr: ":7000",
+			IceServers: []webrtc_server.IceServer{
+				{
+					URLs: []string{"stun:stun.l.google.com:19302"},
+				},
+			},
+		},
+		Channel: ChannelOption{
+			Conflict:        server_interface.ConflictReject,
+			Grace:           3 * time.Second,
+			FailoverTimeout: 3 * time.Second,
+			GopCache: server_interface.GopCacheOption{
+				Gops:     1,
+				MaxBytes: 16 << 20,
+			},
+			Timeshift: server_interface.TimeshiftOption{
+				MaxBytes: 256 << 20,
+			},
+		},
+		Slate: slate.Option{
+			IdleTimeout: 10 * time.Second,
+		},
+		Pull: relay.PullOption{
+			IdleTimeout: 10 * time.Second,
+		},
+		SlowConsumer: server_interface.LagPolicy{
+			DropLag:    time.Second,
+			SkipLag:    2 * time.Second,
+			MaxLagTime: 30 * time.Second,
+		},
+		Limits: limit.Option{
+			BitrateGrace: 10 * time.Second,
+		},
+		Cluster: cluster.Option{
+			Interval: 2 * time.Second,
+		},
+		Record: record.Option{
+			RecordRule: server_interface.RecordRule{
+				File:            "./record/{path}/{date}/{time}_{seq}.flv",
+				SegmentDuration: 10 * time.Minute,
+			},
+			Retention: record.RetentionOption{
+				Interval: time.Minute,
+			},
+		},
+		Hls: hls_server.Option{
+			SegmentDuration: 2 * time.Second,
+			PlaylistLength:  5,
+		},
+	}
+}
+
+// LoadOption 读取yaml配置文件
+func LoadOption(filename string) (*Option, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	option := DefaultOption()
+	if err = yaml.Unmarshal(data, option); err != nil {
+		return nil, err
+	}
+
+	return option, nil
+}
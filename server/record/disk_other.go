@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package record
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// diskFree 不支持的系统, 不按剩余空间清理
+func diskFree(dir string) (int64, error) {
+	return 0, fmt.Errorf("record: disk free space is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package record
+
+import "syscall"
+
+// diskFree 目录所在磁盘的可用空间, 字节
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package record
+
+import "golang.org/x/sys/windows"
+
+// diskFree 目录所在磁盘的可用空间, 字节
+func diskFree(dir string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	if err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(free), nil
+}
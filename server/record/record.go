@@ -0,0 +1,578 @@
+package record
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+	"github.com/general252/live/format/fmp4"
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// Option 录制为flv或mp4文件. Paths中的路径推流时自动录制, 也可以通过API开始和停止
+type Option struct {
+	server_interface.RecordRule `yaml:",inline"`
+	Paths                       map[string]server_interface.RecordRule `yaml:"paths"` // connPath或通配符 -> 录制配置, 为空的项使用默认配置
+
+	Retention RetentionOption `yaml:"retention"` // 定期删除旧的录制文件
+}
+
+// merge 为空的项使用默认配置
+func merge(rule server_interface.RecordRule, def server_interface.RecordRule) server_interface.RecordRule {
+	if len(rule.File) == 0 {
+		rule.File = def.File
+	}
+	if rule.SegmentDuration <= 0 {
+		rule.SegmentDuration = def.SegmentDuration
+	}
+	if rule.SegmentSize <= 0 {
+		rule.SegmentSize = def.SegmentSize
+	}
+	if len(rule.Format) == 0 {
+		rule.Format = def.Format
+	}
+	rule.Faststart = rule.Faststart || def.Faststart
+	return rule
+}
+
+// recordFormat 没有配置时按文件扩展名
+func recordFormat(rule server_interface.RecordRule) string {
+	if len(rule.Format) > 0 {
+		return strings.ToLower(rule.Format)
+	}
+	if strings.EqualFold(filepath.Ext(rule.File), ".mp4") {
+		return server_interface.RecordMp4
+	}
+	return server_interface.RecordFlv
+}
+
+// RecordManager 管理正在录制的channel, 每个路径最多一个录制
+type RecordManager struct {
+	parent server_interface.ServerInterface
+
+	mutex  sync.RWMutex
+	option Option
+
+	startMutex sync.Mutex                   // Start和sync互斥
+	recorders  *util.Map[string, *Recorder] // connPath -> recorder
+	wg         sync.WaitGroup
+
+	retention *retention
+}
+
+func NewRecordManager(parent server_interface.ServerInterface, option Option) *RecordManager {
+	tis := &RecordManager{
+		parent:    parent,
+		option:    option,
+		recorders: util.NewMap[string, *Recorder](),
+	}
+	tis.retention = newRetention(tis)
+	return tis
+}
+
+// StartRetention 开始定期清理录制文件
+func (tis *RecordManager) StartRetention() {
+	tis.retention.start()
+}
+
+func (tis *RecordManager) getOption() Option {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	return tis.option
+}
+
+// Reload 替换配置, 停止不再匹配的自动录制, 开始新匹配的. 通过API开始的录制不受影响
+func (tis *RecordManager) Reload(option Option) {
+	tis.mutex.Lock()
+	tis.option = option
+	tis.mutex.Unlock()
+
+	tis.startMutex.Lock()
+	defer tis.startMutex.Unlock()
+
+	tis.recorders.Range(func(connPath string, recorder *Recorder) bool {
+		if _, ok := tis.autoRule(connPath); !ok && !recorder.manual {
+			recorder.Stop()
+		}
+		return true
+	})
+
+	for _, ch := range tis.parent.GetChannels() {
+		if rule, ok := tis.autoRule(ch.GetConnPath()); ok {
+			tis.start(ch, rule, false)
+		}
+	}
+}
+
+// autoRule 路径匹配的自动录制配置
+func (tis *RecordManager) autoRule(connPath string) (server_interface.RecordRule, bool) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	rule, ok := util.MatchPath(tis.option.Paths, connPath)
+	return merge(rule, tis.option.RecordRule), ok
+}
+
+// Start 推流开始时调用, 路径匹配时开始录制
+func (tis *RecordManager) Start(ch *server_interface.Channel) {
+	rule, ok := tis.autoRule(ch.GetConnPath())
+	if !ok {
+		return
+	}
+
+	tis.startMutex.Lock()
+	defer tis.startMutex.Unlock()
+
+	tis.start(ch, rule, false)
+}
+
+// StartRecord 通过API开始录制, 已经在录制时返回当前的状态
+func (tis *RecordManager) StartRecord(ch *server_interface.Channel, rule server_interface.RecordRule) (server_interface.RecordInfo, error) {
+	tis.mutex.RLock()
+	rule = merge(rule, tis.option.RecordRule)
+	tis.mutex.RUnlock()
+
+	if len(rule.File) == 0 {
+		return server_interface.RecordInfo{}, fmt.Errorf("record: empty file for %v", ch.GetConnPath())
+	}
+	if format := recordFormat(rule); format != server_interface.RecordFlv && format != server_interface.RecordMp4 {
+		return server_interface.RecordInfo{}, fmt.Errorf("record: unsupported format %v", format)
+	}
+	if _, err := expand(rule.File, ch.GetConnPath(), time.Now(), 0); err != nil {
+		return server_interface.RecordInfo{}, err
+	}
+
+	tis.startMutex.Lock()
+	defer tis.startMutex.Unlock()
+
+	recorder, ok := tis.start(ch, rule, true)
+	if !ok {
+		return server_interface.RecordInfo{}, fmt.Errorf("record: %v is not publishing", ch.GetConnPath())
+	}
+	return recorder.Info(), nil
+}
+
+// start 调用者持有startMutex
+func (tis *RecordManager) start(ch *server_interface.Channel, rule server_interface.RecordRule, manual bool) (*Recorder, bool) {
+	if !ch.IsPublishing() {
+		return nil, false
+	}
+
+	connPath := ch.GetConnPath()
+	if cur, ok := tis.recorders.Load(connPath); ok {
+		if cur.ch == ch && !cur.isStopped() {
+			return cur, true
+		}
+		// 旧的channel
+		cur.Stop()
+	}
+
+	recorder := newRecorder(tis.parent, ch, rule, manual)
+	tis.recorders.Store(connPath, recorder)
+
+	tis.wg.Add(1)
+	go func() {
+		defer tis.wg.Done()
+
+		recorder.Run()
+		if cur, ok := tis.recorders.Load(connPath); ok && cur == recorder {
+			tis.recorders.Delete(connPath)
+		}
+	}()
+	return recorder, true
+}
+
+// StopRecord 停止录制, 自动录制的路径下次推流时重新开始
+func (tis *RecordManager) StopRecord(connPath string) (server_interface.RecordInfo, bool) {
+	recorder, ok := tis.recorders.Load(connPath)
+	if !ok {
+		return server_interface.RecordInfo{}, false
+	}
+
+	recorder.Stop()
+	return recorder.Info(), true
+}
+
+// Records 正在录制的状态
+func (tis *RecordManager) Records() []server_interface.RecordInfo {
+	var infos []server_interface.RecordInfo
+	tis.recorders.Range(func(connPath string, recorder *Recorder) bool {
+		infos = append(infos, recorder.Info())
+		return true
+	})
+	return infos
+}
+
+// isRecording 文件是否正在写入
+func (tis *RecordManager) isRecording(name string) bool {
+	name = filepath.Clean(name)
+
+	recording := false
+	tis.recorders.Range(func(connPath string, recorder *Recorder) bool {
+		if file := recorder.Info().File; len(file) > 0 && filepath.Clean(file) == name {
+			recording = true
+		}
+		return !recording
+	})
+	return recording
+}
+
+// RunRetention 立即按保留策略清理, 返回删除的文件
+func (tis *RecordManager) RunRetention() []server_interface.DeletedRecord {
+	return tis.retention.run()
+}
+
+// RetentionInfo 上一次清理的结果
+func (tis *RecordManager) RetentionInfo() server_interface.RetentionInfo {
+	return tis.retention.info()
+}
+
+// Close 停止所有录制, 等待文件写完. 在channel关闭之后调用, 否则要等到下一个包
+func (tis *RecordManager) Close() {
+	tis.retention.close()
+
+	tis.recorders.Range(func(connPath string, recorder *Recorder) bool {
+		recorder.Stop()
+		return true
+	})
+	tis.wg.Wait()
+}
+
+// Recorder 读取channel的队列写入flv或mp4文件, 在关键帧按时长或大小分段
+type Recorder struct {
+	parent server_interface.ServerInterface
+	ch     *server_interface.Channel
+	rule   server_interface.RecordRule
+	manual bool
+
+	mutex     sync.Mutex
+	closed    bool
+	done      chan struct{}
+	startTime time.Time
+	file      string
+	segments  int
+	bytes     int64
+	lastError string
+}
+
+func newRecorder(parent server_interface.ServerInterface, ch *server_interface.Channel, rule server_interface.RecordRule, manual bool) *Recorder {
+	return &Recorder{
+		parent:    parent,
+		ch:        ch,
+		rule:      rule,
+		manual:    manual,
+		done:      make(chan struct{}),
+		startTime: time.Now(),
+	}
+}
+
+// Run 录制直到停止, 推流离开或channel关闭
+func (tis *Recorder) Run() {
+	connPath := tis.ch.GetConnPath()
+	log.Printf("record start: %v", connPath)
+	defer log.Printf("record stop: %v", connPath)
+
+	go tis.watch()
+
+	if err := tis.record(); err != nil && err != io.EOF {
+		log.Printf("record %v: %v", connPath, err)
+
+		tis.mutex.Lock()
+		tis.lastError = err.Error()
+		tis.mutex.Unlock()
+	}
+	tis.Stop()
+}
+
+// record 从缓存的关键帧开始, 每个分段的时间戳从0开始
+func (tis *Recorder) record() error {
+	cursor := tis.ch.Que.Cursor()
+
+	streams, err := cursor.Streams()
+	if err != nil {
+		return err
+	}
+
+	var seg *segment
+	defer func() {
+		if seg != nil {
+			tis.closeSegment(seg)
+		}
+	}()
+
+	videoIdx := videoIndex(streams)
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if tis.isStopped() {
+			return nil
+		}
+
+		// 只在关键帧切分, 没有视频时任意包都可以
+		if videoIdx < 0 || int(pkt.Idx) == videoIdx && pkt.IsKeyFrame {
+			// 推流重连后编码参数改变, 开始新的分段
+			if cur, err := cursor.Streams(); err == nil && !reflect.DeepEqual(cur, streams) {
+				streams, videoIdx = cur, videoIndex(cur)
+				if seg != nil {
+					tis.closeSegment(seg)
+					seg = nil
+				}
+			}
+
+			if seg != nil && seg.full(tis.rule, pkt.Time) {
+				tis.closeSegment(seg)
+				seg = nil
+			}
+			if seg == nil {
+				if seg, err = tis.openSegment(streams, pkt.Time); err != nil {
+					return err
+				}
+			}
+		} else if seg == nil {
+			continue
+		}
+
+		if pkt.Time -= seg.base; pkt.Time < 0 {
+			pkt.Time = 0
+		}
+		if err = seg.muxer.WritePacket(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func videoIndex(streams []av.CodecData) int {
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			return i
+		}
+	}
+	return -1
+}
+
+// segment 正在写入的文件
+type segment struct {
+	name  string
+	fp    *os.File
+	w     *countWriter
+	muxer av.Muxer
+	mp4   *fmp4.Muxer   // mp4时和muxer相同, 用于faststart
+	base  time.Duration // 第一个包的时间戳
+}
+
+// full 超过分段的时长或大小
+func (tis *segment) full(rule server_interface.RecordRule, t time.Duration) bool {
+	if rule.SegmentDuration > 0 && t-tis.base >= rule.SegmentDuration {
+		return true
+	}
+	return rule.SegmentSize > 0 && tis.w.n >= rule.SegmentSize
+}
+
+func (tis *Recorder) openSegment(streams []av.CodecData, base time.Duration) (*segment, error) {
+	tis.mutex.Lock()
+	tis.segments++
+	seq := tis.segments
+	tis.mutex.Unlock()
+
+	name, err := expand(tis.rule.File, tis.ch.GetConnPath(), time.Now(), seq)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{
+		name: name,
+		fp:   fp,
+		base: base,
+	}
+	seg.w = &countWriter{w: fp, onWrite: tis.addBytes}
+	switch format := recordFormat(tis.rule); format {
+	case server_interface.RecordFlv:
+		seg.muxer = flv.NewMuxer(seg.w)
+	case server_interface.RecordMp4:
+		seg.mp4 = fmp4.NewMuxer(seg.w)
+		seg.muxer = seg.mp4
+	default:
+		err = fmt.Errorf("unsupported format %v", format)
+	}
+	if err == nil {
+		err = seg.muxer.WriteHeader(streams)
+	}
+	if err != nil {
+		_ = fp.Close()
+		_ = os.Remove(name)
+		return nil, err
+	}
+
+	tis.mutex.Lock()
+	tis.file = name
+	tis.mutex.Unlock()
+
+	return seg, nil
+}
+
+// closeSegment 写完文件后回调on_record_done
+func (tis *Recorder) closeSegment(seg *segment) {
+	err := seg.muxer.WriteTrailer()
+	if closeErr := seg.fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && seg.mp4 != nil && tis.rule.Faststart {
+		err = faststart(seg)
+	}
+	if err != nil {
+		log.Printf("record %v: %v", seg.name, err)
+	}
+
+	info := tis.ch.Info()
+	req := server_interface.NewStreamRequest(info.Protocol, info.ConnPath, info.RemoteAddr, nil)
+	tis.parent.OnRecordDone(req, seg.name)
+}
+
+// faststart 改写为moov在前的mp4, 失败时保留fragmented mp4
+func faststart(seg *segment) error {
+	src, err := os.Open(seg.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := seg.name + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = seg.mp4.WriteFaststart(src, dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_ = src.Close()
+		err = os.Rename(tmp, seg.name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (tis *Recorder) addBytes(n int) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.bytes += int64(n)
+}
+
+// watch channel关闭或推流离开(只剩垫片)后停止
+func (tis *Recorder) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tis.done:
+			return
+		case <-tis.ch.Done():
+			tis.Stop()
+			return
+		case <-ticker.C:
+		}
+
+		if !tis.ch.IsPublishing() {
+			tis.Stop()
+			return
+		}
+	}
+}
+
+func (tis *Recorder) isStopped() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+	return tis.closed
+}
+
+// Stop 停止录制, 收到下一个包或channel关闭时写完文件
+func (tis *Recorder) Stop() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return
+	}
+	tis.closed = true
+	close(tis.done)
+}
+
+func (tis *Recorder) Info() server_interface.RecordInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return server_interface.RecordInfo{
+		ConnPath:  tis.ch.GetConnPath(),
+		File:      tis.file,
+		Segments:  tis.segments,
+		Bytes:     tis.bytes,
+		StartTime: tis.startTime,
+		Manual:    tis.manual,
+		LastError: tis.lastError,
+	}
+}
+
+// expand 替换文件名模板中的 {path} {date} {time} {seq}.
+// connPath来自客户端, 含有 .. 时拒绝, 替换后的文件必须在模板的目录下
+func expand(file string, connPath string, now time.Time, seq int) (string, error) {
+	for _, elem := range strings.Split(connPath, "/") {
+		if elem == ".." || strings.Contains(elem, `\`) {
+			return "", fmt.Errorf("record: invalid path %v", connPath)
+		}
+	}
+
+	name := filepath.Clean(strings.NewReplacer(
+		"{path}", strings.TrimPrefix(path.Clean("/"+connPath), "/"),
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("150405"),
+		"{seq}", strconv.Itoa(seq),
+	).Replace(file))
+
+	root, _ := parseTemplate(file)
+	if rel, err := filepath.Rel(root, name); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("record: %v is outside of %v", name, root)
+	}
+	return name, nil
+}
+
+// countWriter 统计写入文件的字节数
+type countWriter struct {
+	w       io.Writer
+	n       int64
+	onWrite func(n int)
+}
+
+func (tis *countWriter) Write(p []byte) (int, error) {
+	n, err := tis.w.Write(p)
+	tis.n += int64(n)
+	tis.onWrite(n)
+	return n, err
+}
@@ -0,0 +1,45 @@
+package record
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		file     string
+		connPath string
+		want     string // 为空时返回error
+	}{
+		{name: "path", file: "./record/{path}/{date}/{time}_{seq}.flv", connPath: "/live/cam1", want: "record/live/cam1/2024-05-06/070809_3.flv"},
+		{name: "absolute root", file: "/data/{path}_{seq}.mp4", connPath: "/cam1", want: "/data/cam1_3.mp4"},
+		{name: "no path", file: "./record/{time}.flv", connPath: "/live/cam1", want: "record/070809.flv"},
+		{name: "clean", file: "./record/{path}.flv", connPath: "//live/./cam1", want: "record/live/cam1.flv"},
+		{name: "parent", file: "./record/{path}.flv", connPath: "/../../etc/cron.d/x", want: ""},
+		{name: "parent inside", file: "./record/{path}.flv", connPath: "/live/../cam1", want: ""},
+		{name: "backslash", file: "./record/{path}.flv", connPath: `/live/..\..\x`, want: ""},
+		{name: "empty path", file: "./record/{path}", connPath: "/", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expand(tt.file, tt.connPath, now, 3)
+			if len(tt.want) == 0 {
+				if err == nil {
+					t.Fatalf("got %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.FromSlash(tt.want); got != want {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package record
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// RetentionPolicy 录制文件的保留策略, 0 不限制
+type RetentionPolicy struct {
+	MaxAge  time.Duration `yaml:"max_age"`  // 文件写完后保留的时间
+	MaxSize int64         `yaml:"max_size"` // 文件总大小, 字节
+}
+
+// RetentionOption 定期从最早的文件开始删除, 正在写入的文件不删除
+// 只处理和录制配置中文件名模板匹配的文件, 不启用录制时也会清理之前的录制
+type RetentionOption struct {
+	RetentionPolicy `yaml:",inline"`           // 所有录制文件
+	MinFree         int64                      `yaml:"min_free"` // 录制目录所在磁盘的最小剩余空间, 字节
+	Interval        time.Duration              `yaml:"interval"` // 检查间隔
+	Paths           map[string]RetentionPolicy `yaml:"paths"`    // connPath或通配符 -> 对匹配的每个路径, max_age为0时使用全局的
+}
+
+// 保留最近删除的文件数量
+const maxDeleted = 100
+
+// recordFile 录制目录中的一个文件
+type recordFile struct {
+	name     string
+	connPath string // 文件名模板中没有{path}时为空
+	root     string
+	size     int64
+	modTime  time.Time
+	deleted  bool
+}
+
+// retention 按保留策略删除录制文件
+type retention struct {
+	manager *RecordManager
+
+	runMutex sync.Mutex // 定期检查和API互斥
+
+	mutex   sync.Mutex
+	lastRun time.Time
+	files   int
+	bytes   int64
+	deleted []server_interface.DeletedRecord
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newRetention(manager *RecordManager) *retention {
+	return &retention{
+		manager: manager,
+		done:    make(chan struct{}),
+	}
+}
+
+func (tis *retention) start() {
+	tis.wg.Add(1)
+	go func() {
+		defer tis.wg.Done()
+		tis.monitor()
+	}()
+}
+
+func (tis *retention) monitor() {
+	for {
+		interval := tis.manager.getOption().Retention.Interval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+
+		select {
+		case <-tis.done:
+			return
+		case <-time.After(interval):
+		}
+
+		tis.run()
+	}
+}
+
+func (tis *retention) close() {
+	tis.stopOnce.Do(func() {
+		close(tis.done)
+	})
+	tis.wg.Wait()
+}
+
+// run 检查一次, 返回这次删除的文件
+func (tis *retention) run() []server_interface.DeletedRecord {
+	tis.runMutex.Lock()
+	defer tis.runMutex.Unlock()
+
+	option := tis.manager.getOption()
+	policy := option.Retention
+
+	files := scanRecords(option)
+	now := time.Now()
+
+	var deleted []server_interface.DeletedRecord
+	remove := func(file *recordFile, reason string) bool {
+		if file.deleted || tis.manager.isRecording(file.name) {
+			return false
+		}
+		if err := os.Remove(file.name); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("record retention: %v", err)
+				return false
+			}
+		}
+		removeEmptyDirs(filepath.Dir(file.name), file.root)
+
+		file.deleted = true
+		log.Printf("record retention: delete %v %v bytes, %v", file.name, file.size, reason)
+		deleted = append(deleted, server_interface.DeletedRecord{
+			File:     file.name,
+			ConnPath: file.connPath,
+			Size:     file.size,
+			ModTime:  file.modTime,
+			Reason:   reason,
+			Time:     now,
+		})
+		return true
+	}
+
+	// 超过保留时间
+	for _, file := range files {
+		maxAge := policy.MaxAge
+		if rule, ok := util.MatchPath(policy.Paths, file.connPath); ok && rule.MaxAge > 0 {
+			maxAge = rule.MaxAge
+		}
+		if maxAge > 0 && now.Sub(file.modTime) > maxAge {
+			remove(file, "max_age")
+		}
+	}
+
+	// 每个路径的总大小
+	byPath := map[string][]*recordFile{}
+	for _, file := range files {
+		byPath[file.connPath] = append(byPath[file.connPath], file)
+	}
+	for connPath, pathFiles := range byPath {
+		if rule, ok := util.MatchPath(policy.Paths, connPath); ok && rule.MaxSize > 0 {
+			trimSize(pathFiles, rule.MaxSize, "path max_size", remove)
+		}
+	}
+
+	// 所有文件的总大小
+	if policy.MaxSize > 0 {
+		trimSize(files, policy.MaxSize, "max_size", remove)
+	}
+
+	// 磁盘剩余空间, 每个录制目录分别检查
+	if policy.MinFree > 0 {
+		byRoot := map[string][]*recordFile{}
+		for _, file := range files {
+			byRoot[file.root] = append(byRoot[file.root], file)
+		}
+		for root, rootFiles := range byRoot {
+			for _, file := range rootFiles {
+				free, err := diskFree(root)
+				if err != nil {
+					log.Printf("record retention: %v", err)
+					break
+				}
+				if free >= policy.MinFree {
+					break
+				}
+				remove(file, "min_free")
+			}
+		}
+	}
+
+	var (
+		count int
+		bytes int64
+	)
+	for _, file := range files {
+		if !file.deleted {
+			count++
+			bytes += file.size
+		}
+	}
+
+	tis.mutex.Lock()
+	tis.lastRun = now
+	tis.files = count
+	tis.bytes = bytes
+	tis.deleted = append(tis.deleted, deleted...)
+	if n := len(tis.deleted); n > maxDeleted {
+		tis.deleted = append([]server_interface.DeletedRecord(nil), tis.deleted[n-maxDeleted:]...)
+	}
+	tis.mutex.Unlock()
+
+	return deleted
+}
+
+// trimSize 从最早的文件开始删除, 直到总大小不超过max
+func trimSize(files []*recordFile, max int64, reason string, remove func(file *recordFile, reason string) bool) {
+	var total int64
+	for _, file := range files {
+		if !file.deleted {
+			total += file.size
+		}
+	}
+
+	for _, file := range files {
+		if total <= max {
+			return
+		}
+		if !file.deleted && remove(file, reason) {
+			total -= file.size
+		}
+	}
+}
+
+// info 上一次检查的结果和最近删除的文件
+func (tis *retention) info() server_interface.RetentionInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return server_interface.RetentionInfo{
+		LastRun: tis.lastRun,
+		Files:   tis.files,
+		Bytes:   tis.bytes,
+		Deleted: append([]server_interface.DeletedRecord{}, tis.deleted...),
+	}
+}
+
+// scanRecords 找到和文件名模板匹配的文件, 按修改时间从早到晚
+func scanRecords(option Option) []*recordFile {
+	// 文件名模板 -> 模板中没有{path}时文件对应的connPath
+	templates := map[string]string{option.File: ""}
+	for connPath, rule := range option.Paths {
+		file := merge(rule, option.RecordRule).File
+		if _, ok := templates[file]; ok {
+			continue
+		}
+		if strings.ContainsAny(connPath, "*?[") {
+			connPath = ""
+		}
+		templates[file] = connPath
+	}
+
+	found := map[string]*recordFile{}
+	for file, connPath := range templates {
+		if len(file) == 0 {
+			continue
+		}
+
+		root, re := parseTemplate(file)
+		_ = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || found[name] != nil {
+				return nil
+			}
+
+			match := re.FindStringSubmatch(filepath.ToSlash(name))
+			if match == nil {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+
+			f := &recordFile{
+				name:     name,
+				connPath: connPath,
+				root:     root,
+				size:     info.Size(),
+				modTime:  info.ModTime(),
+			}
+			if i := re.SubexpIndex("path"); i > 0 {
+				f.connPath = "/" + match[i]
+			}
+			found[name] = f
+			return nil
+		})
+	}
+
+	files := make([]*recordFile, 0, len(found))
+	for _, file := range found {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files
+}
+
+// parseTemplate 文件名模板中第一个占位符之前的目录, 和匹配文件名的正则
+func parseTemplate(file string) (string, *regexp.Regexp) {
+	file = filepath.Clean(file)
+
+	root := filepath.Dir(file)
+	if i := strings.Index(file, "{"); i >= 0 {
+		root = filepath.Dir(file[:i] + "x")
+	}
+
+	expr := regexp.QuoteMeta(filepath.ToSlash(file))
+	expr = strings.Replace(expr, regexp.QuoteMeta("{path}"), "(?P<path>.+)", 1)
+	expr = strings.NewReplacer(
+		regexp.QuoteMeta("{path}"), ".+",
+		regexp.QuoteMeta("{date}"), `\d{4}-\d{2}-\d{2}`,
+		regexp.QuoteMeta("{time}"), `\d{6}`,
+		regexp.QuoteMeta("{seq}"), `\d+`,
+	).Replace(expr)
+
+	return root, regexp.MustCompile("^" + expr + "$")
+}
+
+// removeEmptyDirs 删除文件后删除空的目录, 不删除录制目录本身
+func removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) && len(dir) > len(root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
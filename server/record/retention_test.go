@@ -0,0 +1,154 @@
+package record
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// testRecord 录制目录中的一个文件, name相对于录制目录
+type testRecord struct {
+	name string
+	age  time.Duration
+	size int
+}
+
+func TestRetentionRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention RetentionOption
+		files     []testRecord
+		recording string // 正在写入的文件
+
+		want       []string // 按删除的顺序
+		wantReason []string
+	}{
+		{
+			name:      "max_age",
+			retention: RetentionOption{RetentionPolicy: RetentionPolicy{MaxAge: time.Hour}},
+			files:     []testRecord{{"a/1.flv", 3 * time.Hour, 10}, {"a/2.flv", 2 * time.Hour, 10}, {"a/3.flv", 10 * time.Minute, 10}},
+			want:      []string{"a/1.flv", "a/2.flv"}, wantReason: []string{"max_age", "max_age"},
+		},
+		{
+			name: "path max_age",
+			retention: RetentionOption{
+				RetentionPolicy: RetentionPolicy{MaxAge: time.Hour},
+				Paths:           map[string]RetentionPolicy{"/b": {MaxAge: 30 * time.Minute}},
+			},
+			files: []testRecord{{"a/1.flv", 3 * time.Hour, 10}, {"b/1.flv", 40 * time.Minute, 10}, {"a/2.flv", 20 * time.Minute, 10}},
+			want:  []string{"a/1.flv", "b/1.flv"}, wantReason: []string{"max_age", "max_age"},
+		},
+		{
+			name:      "max_size oldest first",
+			retention: RetentionOption{RetentionPolicy: RetentionPolicy{MaxSize: 150}},
+			files:     []testRecord{{"b/1.flv", 30 * time.Minute, 100}, {"a/1.flv", 20 * time.Minute, 100}, {"b/2.flv", 10 * time.Minute, 100}},
+			want:      []string{"b/1.flv", "a/1.flv"}, wantReason: []string{"max_size", "max_size"},
+		},
+		{
+			name:      "path max_size",
+			retention: RetentionOption{Paths: map[string]RetentionPolicy{"/a": {MaxSize: 100}}},
+			files:     []testRecord{{"b/1.flv", 30 * time.Minute, 100}, {"a/1.flv", 20 * time.Minute, 100}, {"a/2.flv", 10 * time.Minute, 100}},
+			want:      []string{"a/1.flv"}, wantReason: []string{"path max_size"},
+		},
+		{
+			name: "max_age then path max_size then max_size",
+			retention: RetentionOption{
+				RetentionPolicy: RetentionPolicy{MaxAge: time.Hour, MaxSize: 150},
+				Paths:           map[string]RetentionPolicy{"/a": {MaxSize: 100}},
+			},
+			files: []testRecord{
+				{"a/1.flv", 3 * time.Hour, 100},
+				{"b/1.flv", 30 * time.Minute, 100},
+				{"a/2.flv", 20 * time.Minute, 100},
+				{"a/3.flv", 10 * time.Minute, 100},
+				{"b/2.flv", 5 * time.Minute, 100},
+			},
+			want:       []string{"a/1.flv", "a/2.flv", "b/1.flv", "a/3.flv"},
+			wantReason: []string{"max_age", "path max_size", "max_size", "max_size"},
+		},
+		{
+			name:      "min_free",
+			retention: RetentionOption{MinFree: math.MaxInt64},
+			files:     []testRecord{{"b/1.flv", 30 * time.Minute, 10}, {"a/1.flv", 20 * time.Minute, 10}},
+			want:      []string{"b/1.flv", "a/1.flv"}, wantReason: []string{"min_free", "min_free"},
+		},
+		{
+			name:      "recording max_age",
+			retention: RetentionOption{RetentionPolicy: RetentionPolicy{MaxAge: time.Hour}},
+			files:     []testRecord{{"a/1.flv", 3 * time.Hour, 10}, {"a/2.flv", 2 * time.Hour, 10}},
+			recording: "a/1.flv",
+			want:      []string{"a/2.flv"}, wantReason: []string{"max_age"},
+		},
+		{
+			name:      "recording max_size",
+			retention: RetentionOption{RetentionPolicy: RetentionPolicy{MaxSize: 100}},
+			files:     []testRecord{{"a/1.flv", 30 * time.Minute, 100}, {"a/2.flv", 20 * time.Minute, 100}, {"a/3.flv", 10 * time.Minute, 100}},
+			recording: "a/1.flv",
+			want:      []string{"a/2.flv", "a/3.flv"}, wantReason: []string{"max_size", "max_size"},
+		},
+		{
+			name:      "recording min_free",
+			retention: RetentionOption{MinFree: math.MaxInt64},
+			files:     []testRecord{{"a/1.flv", 30 * time.Minute, 10}, {"b/1.flv", 20 * time.Minute, 10}},
+			recording: "a/1.flv",
+			want:      []string{"b/1.flv"}, wantReason: []string{"min_free"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			now := time.Now()
+			for _, file := range tt.files {
+				name := filepath.Join(dir, file.name)
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, make([]byte, file.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(name, now.Add(-file.age), now.Add(-file.age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			manager := NewRecordManager(nil, Option{
+				RecordRule: server_interface.RecordRule{File: filepath.Join(dir, "{path}/{seq}.flv")},
+				Retention:  tt.retention,
+			})
+			if len(tt.recording) > 0 {
+				manager.recorders.Store("/a", &Recorder{
+					ch:   server_interface.NewChannel("/a", nil),
+					file: filepath.Join(dir, tt.recording),
+				})
+			}
+
+			deleted := manager.RunRetention()
+			if len(deleted) != len(tt.want) {
+				t.Fatalf("deleted %v files, want %v: %v", len(deleted), tt.want, deleted)
+			}
+			for i, record := range deleted {
+				if record.File != filepath.Join(dir, tt.want[i]) || record.Reason != tt.wantReason[i] {
+					t.Fatalf("deleted %v: %v %v, want %v %v", i, record.File, record.Reason, tt.want[i], tt.wantReason[i])
+				}
+				if _, err := os.Stat(record.File); !os.IsNotExist(err) {
+					t.Fatalf("%v not removed: %v", record.File, err)
+				}
+			}
+			if len(tt.recording) > 0 {
+				if _, err := os.Stat(filepath.Join(dir, tt.recording)); err != nil {
+					t.Fatalf("recording file removed: %v", err)
+				}
+			}
+
+			info := manager.RetentionInfo()
+			if want := len(tt.files) - len(tt.want); info.Files != want {
+				t.Fatalf("%v files left, want %v", info.Files, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	patternParam = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+	paramValue   = `[A-Za-z0-9_-]+`
+	paramValueRe = regexp.MustCompile("^" + paramValue + "$")
+)
+
+// pathPattern 路径模板, {name}匹配一段路径中的字母, 数字, _ 和 -
+// 参数会替换到上游地址中, 不能含有 @ : . ? # % 等改变地址的字符
+type pathPattern struct {
+	path string
+	re   *regexp.Regexp
+}
+
+func newPathPattern(path string) (*pathPattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("relay: path must start with /: %v", path)
+	}
+
+	var (
+		expr = "^"
+		last = 0
+	)
+	for _, loc := range patternParam.FindAllStringSubmatchIndex(path, -1) {
+		expr += regexp.QuoteMeta(path[last:loc[0]])
+		expr += "(?P<" + path[loc[2]:loc[3]] + ">" + paramValue + ")"
+		last = loc[1]
+	}
+	expr += regexp.QuoteMeta(path[last:]) + "$"
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pathPattern{
+		path: path,
+		re:   re,
+	}, nil
+}
+
+// match 匹配时返回参数
+func (tis *pathPattern) match(connPath string) (map[string]string, bool) {
+	values := tis.re.FindStringSubmatch(connPath)
+	if values == nil {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, name := range tis.re.SubexpNames() {
+		if i > 0 && len(name) > 0 {
+			params[name] = values[i]
+		}
+	}
+	return params, true
+}
+
+// expand 替换url中的{name}, 替换后的scheme和host必须和模板一致
+func expand(rawURL string, params map[string]string) (string, error) {
+	for name, value := range params {
+		if !paramValueRe.MatchString(value) {
+			return "", fmt.Errorf("relay: invalid value of {%v}: %q", name, value)
+		}
+	}
+
+	replace := func(s string) string {
+		for name, value := range params {
+			s = strings.ReplaceAll(s, "{"+name+"}", value)
+		}
+		return s
+	}
+
+	expanded := replace(rawURL)
+	u, err := url.Parse(expanded)
+	if err != nil {
+		return "", fmt.Errorf("relay: invalid url %v: %w", expanded, err)
+	}
+
+	scheme, host := splitHost(rawURL)
+	if !strings.EqualFold(u.Scheme, scheme) || u.Host != replace(host) {
+		return "", fmt.Errorf("relay: url %v does not match %v", expanded, rawURL)
+	}
+	return expanded, nil
+}
+
+// splitHost 模板中的scheme和host, 模板含有{name}时不能用url.Parse
+func splitHost(rawURL string) (string, string) {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return "", ""
+	}
+
+	scheme, rest := rawURL[:i], rawURL[i+3:]
+	if j := strings.IndexAny(rest, "/?#"); j >= 0 {
+		rest = rest[:j]
+	}
+	if j := strings.LastIndex(rest, "@"); j >= 0 {
+		rest = rest[j+1:]
+	}
+	return scheme, rest
+}
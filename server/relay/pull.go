@@ -0,0 +1,483 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// PullOption 读者请求不存在的channel时, 按路径从上游拉流, 没有读者后停止
+type PullOption struct {
+	Sources     []server_interface.PullSource `yaml:"sources"`
+	IdleTimeout time.Duration                 `yaml:"idle_timeout"` // 没有读者超过这个时间停止拉流
+}
+
+// 断开后重连的间隔
+const retryInterval = 2 * time.Second
+
+// PullManager 管理拉流的上游和正在拉流的任务
+type PullManager struct {
+	parent server_interface.ServerInterface
+
+	mutex       sync.RWMutex
+	sources     []*pullSource
+	idleTimeout time.Duration
+
+	pullers *util.Map[string, *Puller]
+}
+
+// pullSource 编译后的上游配置
+type pullSource struct {
+	pattern *pathPattern
+	url     string
+}
+
+func newPullSource(source server_interface.PullSource) (*pullSource, error) {
+	if len(source.URL) == 0 {
+		return nil, fmt.Errorf("relay: empty url for %v", source.Path)
+	}
+
+	pattern, err := newPathPattern(source.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pullSource{
+		pattern: pattern,
+		url:     source.URL,
+	}, nil
+}
+
+func NewPullManager(parent server_interface.ServerInterface, option PullOption) *PullManager {
+	tis := &PullManager{
+		parent:  parent,
+		pullers: util.NewMap[string, *Puller](),
+	}
+	tis.Reload(option)
+	return tis
+}
+
+// Reload 替换上游配置, 正在拉流的路径不再匹配时停止
+func (tis *PullManager) Reload(option PullOption) {
+	var sources []*pullSource
+	for _, s := range option.Sources {
+		p, err := newPullSource(s)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sources = append(sources, p)
+	}
+
+	tis.mutex.Lock()
+	tis.sources = sources
+	tis.idleTimeout = option.IdleTimeout
+	tis.mutex.Unlock()
+
+	tis.stopUnmatched()
+}
+
+// Sources 当前的上游配置
+func (tis *PullManager) Sources() []server_interface.PullSource {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	sources := make([]server_interface.PullSource, 0, len(tis.sources))
+	for _, p := range tis.sources {
+		sources = append(sources, server_interface.PullSource{Path: p.pattern.path, URL: p.url})
+	}
+	return sources
+}
+
+// Add 添加上游, 路径已存在时替换
+func (tis *PullManager) Add(source server_interface.PullSource) error {
+	p, err := newPullSource(source)
+	if err != nil {
+		return err
+	}
+
+	tis.mutex.Lock()
+	replaced := false
+	for i, s := range tis.sources {
+		if s.pattern.path == p.pattern.path {
+			tis.sources[i] = p
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		tis.sources = append(tis.sources, p)
+	}
+	tis.mutex.Unlock()
+
+	if replaced {
+		tis.stopUnmatched()
+	}
+	return nil
+}
+
+// Remove 删除上游并停止使用它的拉流
+func (tis *PullManager) Remove(path string) bool {
+	tis.mutex.Lock()
+	removed := false
+	for i, s := range tis.sources {
+		if s.pattern.path == path {
+			tis.sources = append(tis.sources[:i:i], tis.sources[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	tis.mutex.Unlock()
+
+	if removed {
+		tis.stopUnmatched()
+	}
+	return removed
+}
+
+// match 按配置顺序, 第一个匹配的上游
+func (tis *PullManager) match(connPath string) (string, bool) {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	for _, p := range tis.sources {
+		if params, ok := p.pattern.match(connPath); ok {
+			url, err := expand(p.url, params)
+			if err != nil {
+				log.Println(err)
+				return "", false
+			}
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// stopUnmatched 停止上游被删除或修改的拉流, StartFrom的拉流不受配置影响
+func (tis *PullManager) stopUnmatched() {
+	tis.pullers.Range(func(connPath string, puller *Puller) bool {
+		if puller.external {
+			return true
+		}
+		if url, ok := tis.match(connPath); !ok || url != puller.getURL() {
+			puller.Stop()
+		}
+		return true
+	})
+}
+
+// Start 路径匹配上游时开始拉流, 连接上游并写入头后返回channel. 已经在拉流时直接返回
+func (tis *PullManager) Start(connPath string) (*server_interface.Channel, bool) {
+	url, ok := tis.match(connPath)
+	if !ok {
+		return nil, false
+	}
+	return tis.start(connPath, []string{url}, false)
+}
+
+// StartFrom 从指定的上游拉流, 按顺序尝试直到连接成功, 例如边缘从源站拉流
+func (tis *PullManager) StartFrom(connPath string, urls []string) (*server_interface.Channel, bool) {
+	if len(urls) == 0 {
+		return nil, false
+	}
+	return tis.start(connPath, urls, true)
+}
+
+func (tis *PullManager) start(connPath string, urls []string, external bool) (*server_interface.Channel, bool) {
+	tis.mutex.RLock()
+	idleTimeout := tis.idleTimeout
+	tis.mutex.RUnlock()
+
+	for {
+		puller, ok := tis.pullers.Load(connPath)
+		if !ok {
+			var loaded bool
+			puller, loaded = tis.pullers.LoadOrStore(connPath, newPuller(connPath, urls[0], idleTimeout, external))
+			if !loaded {
+				return tis.open(puller, urls)
+			}
+		}
+
+		// 等待其他读者发起的连接
+		<-puller.ready
+		if puller.handle == nil {
+			return nil, false
+		}
+		if puller.isStopped() {
+			// 正在停止, 等待从map中删除后重新拉流
+			<-puller.finished
+			continue
+		}
+		return puller.handle.GetChannel(), true
+	}
+}
+
+// open 按顺序连接上游, 成功后开始转发
+func (tis *PullManager) open(puller *Puller, urls []string) (*server_interface.Channel, bool) {
+	connPath := puller.connPath
+
+	var err error
+	for _, url := range urls {
+		if err = puller.open(tis.parent, url); err == nil {
+			break
+		}
+		log.Printf("relay %v -> %v: %v", url, connPath, err)
+	}
+	close(puller.ready)
+	if err != nil {
+		tis.pullers.Delete(connPath)
+		return nil, false
+	}
+
+	// 关闭channel前从map中删除, 新的读者不会拿到正在关闭的拉流
+	puller.onStop = func() {
+		if cur, ok := tis.pullers.Load(connPath); ok && cur == puller {
+			tis.pullers.Delete(connPath)
+		}
+	}
+	go puller.Run()
+
+	return puller.handle.GetChannel(), true
+}
+
+// Close 停止所有拉流
+func (tis *PullManager) Close() {
+	tis.pullers.Range(func(connPath string, puller *Puller) bool {
+		puller.Stop()
+		return true
+	})
+}
+
+// Puller 从上游拉流写入channel, 断开后重连, 没有读者后停止
+type Puller struct {
+	connPath    string
+	url         string
+	idleTimeout time.Duration
+	external    bool // 不是按配置启动的
+
+	ready    chan struct{} // open结束
+	handle   *server_interface.ChannelHandle
+	src      source
+	onStop   func()        // Run结束, 关闭channel之前
+	finished chan struct{} // Run结束, channel已关闭
+
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newPuller(connPath string, url string, idleTimeout time.Duration, external bool) *Puller {
+	return &Puller{
+		connPath:    connPath,
+		url:         url,
+		idleTimeout: idleTimeout,
+		external:    external,
+		ready:       make(chan struct{}),
+		finished:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// open 连接上游, 获取channel并写入头
+func (tis *Puller) open(parent server_interface.ServerInterface, url string) error {
+	src, err := openSource(url)
+	if err != nil {
+		return err
+	}
+
+	streams, err := src.Streams()
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+
+	handle, err := parent.CreateChannel(tis.connPath)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+
+	handle.SetPublisher("relay", url)
+	_ = handle.WriteHeader(streams)
+
+	tis.mutex.Lock()
+	tis.url = url
+	tis.handle = handle
+	tis.src = src
+	tis.mutex.Unlock()
+	return nil
+}
+
+// getURL 正在使用的上游
+func (tis *Puller) getURL() string {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+	return tis.url
+}
+
+func (tis *Puller) isStopped() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+	return tis.closed
+}
+
+// reconnect 重新连接上游, 停止或超过idleTimeout连接不上时返回error
+// 上游断开后读者收不到数据, 可能检测不到读者断开, 不能只依赖读者数量停止
+func (tis *Puller) reconnect() error {
+	start := time.Now()
+	for {
+		select {
+		case <-tis.done:
+			return errors.New("relay: stopped")
+		case <-time.After(retryInterval):
+		}
+
+		src, err := openSource(tis.url)
+		if err == nil {
+			var streams []av.CodecData
+			if streams, err = src.Streams(); err == nil {
+				if !tis.setSource(src) {
+					_ = src.Close()
+					return errors.New("relay: stopped")
+				}
+				_ = tis.handle.WriteHeader(streams)
+				return nil
+			}
+			_ = src.Close()
+		}
+
+		log.Printf("relay %v -> %v: %v", tis.url, tis.connPath, err)
+		if time.Since(start) > tis.idleTimeout {
+			return err
+		}
+	}
+}
+
+// setSource 停止后不再替换
+func (tis *Puller) setSource(src source) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return false
+	}
+	tis.src = src
+	return true
+}
+
+func (tis *Puller) getSource() source {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+	return tis.src
+}
+
+// Run 转发上游的包, 停止或channel关闭后返回
+func (tis *Puller) Run() {
+	defer close(tis.finished)
+	defer tis.handle.Close()
+	defer func() {
+		if tis.onStop != nil {
+			tis.onStop()
+		}
+	}()
+	defer tis.Stop()
+
+	log.Printf("relay start: %v -> %v", tis.url, tis.connPath)
+	defer log.Printf("relay stop: %v", tis.connPath)
+
+	go tis.watchIdle()
+
+	var (
+		offset time.Duration // 重连后时间戳接在上次之后
+		last   time.Duration
+		lastAt time.Time
+		reset  bool
+		src    = tis.getSource()
+	)
+
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			_ = src.Close()
+
+			select {
+			case <-tis.done:
+				return
+			default:
+			}
+
+			log.Printf("relay %v -> %v: %v", tis.url, tis.connPath, err)
+			if err = tis.reconnect(); err != nil {
+				return
+			}
+			src = tis.getSource()
+			reset = true
+			continue
+		}
+
+		if reset {
+			reset = false
+			offset = last + time.Since(lastAt) - pkt.Time
+		}
+		pkt.Time += offset
+		if pkt.Time > last {
+			last = pkt.Time
+		}
+		lastAt = time.Now()
+
+		// 被推流替换或channel关闭
+		err = tis.handle.WritePacket(pkt)
+		if err == server_interface.ErrNotOwner || err == server_interface.ErrChannelClosed {
+			return
+		}
+	}
+}
+
+// watchIdle 没有读者超过idleTimeout或channel关闭后停止
+func (tis *Puller) watchIdle() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	ch := tis.handle.GetChannel()
+	idleFrom := time.Now()
+
+	for {
+		select {
+		case <-tis.done:
+			return
+		case <-ch.Done():
+			tis.Stop()
+			return
+		case <-ticker.C:
+		}
+
+		if ch.SubscriberCount() > 0 {
+			idleFrom = time.Now()
+		} else if time.Since(idleFrom) > tis.idleTimeout {
+			log.Printf("relay idle: %v", tis.connPath)
+			tis.Stop()
+			return
+		}
+	}
+}
+
+// Stop 关闭上游, Run随后返回
+func (tis *Puller) Stop() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return
+	}
+	tis.closed = true
+	close(tis.done)
+	if tis.src != nil {
+		_ = tis.src.Close()
+	}
+}
@@ -0,0 +1,422 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// PushOption 有推流时转发到其他服务器, 推流断开后停止
+type PushOption struct {
+	Targets []server_interface.PushTarget `yaml:"targets"`
+}
+
+// 重连间隔, 每次失败加倍
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+var errPushStopped = errors.New("relay: push stopped")
+
+// pushTarget 编译后的转发配置
+type pushTarget struct {
+	pattern *pathPattern
+	urls    []string
+}
+
+func newPushTarget(target server_interface.PushTarget) (*pushTarget, error) {
+	if len(target.URLs) == 0 {
+		return nil, fmt.Errorf("relay: empty urls for %v", target.Path)
+	}
+
+	pattern, err := newPathPattern(target.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pushTarget{
+		pattern: pattern,
+		urls:    append([]string(nil), target.URLs...),
+	}, nil
+}
+
+// PushManager 管理转发配置和正在转发的任务
+type PushManager struct {
+	parent server_interface.ServerInterface
+
+	mutex   sync.RWMutex
+	targets []*pushTarget
+
+	startMutex sync.Mutex                 // Start和sync互斥
+	pushers    *util.Map[string, *Pusher] // connPath url -> pusher
+}
+
+func NewPushManager(parent server_interface.ServerInterface, option PushOption) *PushManager {
+	tis := &PushManager{
+		parent:  parent,
+		pushers: util.NewMap[string, *Pusher](),
+	}
+	tis.setTargets(option.Targets)
+	return tis
+}
+
+func (tis *PushManager) setTargets(targets []server_interface.PushTarget) {
+	var compiled []*pushTarget
+	for _, t := range targets {
+		p, err := newPushTarget(t)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		compiled = append(compiled, p)
+	}
+
+	tis.mutex.Lock()
+	tis.targets = compiled
+	tis.mutex.Unlock()
+}
+
+// Reload 替换转发配置, 按新的配置启动或停止转发
+func (tis *PushManager) Reload(option PushOption) {
+	tis.setTargets(option.Targets)
+	tis.sync()
+}
+
+// Targets 当前的转发配置
+func (tis *PushManager) Targets() []server_interface.PushTarget {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	targets := make([]server_interface.PushTarget, 0, len(tis.targets))
+	for _, t := range tis.targets {
+		targets = append(targets, server_interface.PushTarget{
+			Path: t.pattern.path,
+			URLs: append([]string(nil), t.urls...),
+		})
+	}
+	return targets
+}
+
+// Add 添加转发, 路径已存在时替换. 正在推流的路径立即开始转发
+func (tis *PushManager) Add(target server_interface.PushTarget) error {
+	p, err := newPushTarget(target)
+	if err != nil {
+		return err
+	}
+
+	tis.mutex.Lock()
+	replaced := false
+	for i, t := range tis.targets {
+		if t.pattern.path == p.pattern.path {
+			tis.targets[i] = p
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		tis.targets = append(tis.targets, p)
+	}
+	tis.mutex.Unlock()
+
+	tis.sync()
+	return nil
+}
+
+// Remove 删除转发并停止
+func (tis *PushManager) Remove(path string) bool {
+	tis.mutex.Lock()
+	removed := false
+	for i, t := range tis.targets {
+		if t.pattern.path == path {
+			tis.targets = append(tis.targets[:i:i], tis.targets[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	tis.mutex.Unlock()
+
+	if removed {
+		tis.sync()
+	}
+	return removed
+}
+
+// urls 路径需要转发的目的地, 所有匹配的配置合并
+func (tis *PushManager) urls(connPath string) []string {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	var (
+		urls []string
+		seen = map[string]bool{}
+	)
+	for _, t := range tis.targets {
+		params, ok := t.pattern.match(connPath)
+		if !ok {
+			continue
+		}
+		for _, u := range t.urls {
+			u, err := expand(u, params)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// Start 推流开始时调用, 按配置开始转发. 已经在转发的目的地不重复
+func (tis *PushManager) Start(ch *server_interface.Channel) {
+	tis.startMutex.Lock()
+	defer tis.startMutex.Unlock()
+
+	tis.start(ch)
+}
+
+// start 调用者持有startMutex
+func (tis *PushManager) start(ch *server_interface.Channel) {
+	if !ch.IsPublishing() {
+		return
+	}
+
+	connPath := ch.GetConnPath()
+	for _, u := range tis.urls(connPath) {
+		key := connPath + " " + u
+		if cur, ok := tis.pushers.Load(key); ok {
+			if cur.ch == ch && !cur.isStopped() {
+				continue
+			}
+			// 旧的channel
+			cur.Stop()
+		}
+
+		pusher := newPusher(ch, u)
+		tis.pushers.Store(key, pusher)
+
+		go func(key string) {
+			pusher.Run()
+			if cur, ok := tis.pushers.Load(key); ok && cur == pusher {
+				tis.pushers.Delete(key)
+			}
+		}(key)
+	}
+}
+
+// sync 配置改变后, 停止不再需要的转发, 开始新的转发
+func (tis *PushManager) sync() {
+	tis.startMutex.Lock()
+	defer tis.startMutex.Unlock()
+
+	tis.pushers.Range(func(key string, pusher *Pusher) bool {
+		wanted := false
+		for _, u := range tis.urls(pusher.ch.GetConnPath()) {
+			if u == pusher.url {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			pusher.Stop()
+		}
+		return true
+	})
+
+	for _, ch := range tis.parent.GetChannels() {
+		tis.start(ch)
+	}
+}
+
+// Close 停止所有转发
+func (tis *PushManager) Close() {
+	tis.pushers.Range(func(key string, pusher *Pusher) bool {
+		pusher.Stop()
+		return true
+	})
+}
+
+// Pusher 读取channel的队列转发到一个目的地, 断开后重连
+type Pusher struct {
+	ch     *server_interface.Channel
+	url    string
+	status *server_interface.PushStatus
+
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+	sink   sink
+}
+
+func newPusher(ch *server_interface.Channel, url string) *Pusher {
+	return &Pusher{
+		ch:     ch,
+		url:    url,
+		status: ch.AddPush(url),
+		done:   make(chan struct{}),
+	}
+}
+
+// Run 转发直到停止, 失败后按退避间隔重连
+func (tis *Pusher) Run() {
+	defer tis.status.Close()
+
+	connPath := tis.ch.GetConnPath()
+	log.Printf("push start: %v -> %v", connPath, tis.url)
+	defer log.Printf("push stop: %v -> %v", connPath, tis.url)
+
+	go tis.watch()
+
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := tis.push()
+		if tis.isStopped() {
+			return
+		}
+
+		log.Printf("push %v -> %v: %v", connPath, tis.url, err)
+		tis.status.SetError(err)
+
+		// 稳定运行一段时间后重新计算
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-tis.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// push 连接目的地, 从缓存的关键帧开始转发, 时间戳从0开始
+func (tis *Pusher) push() error {
+	cursor := tis.ch.Que.Cursor()
+
+	streams, err := cursor.Streams()
+	if err != nil {
+		return err
+	}
+
+	s, err := openSink(tis.url)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if !tis.setSink(s) {
+		return errPushStopped
+	}
+	if err = s.WriteHeader(streams); err != nil {
+		return err
+	}
+	tis.status.SetConnected()
+
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	var (
+		started bool
+		base    time.Duration
+	)
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if tis.isStopped() {
+			return errPushStopped
+		}
+
+		if !started {
+			if videoIdx >= 0 && (int(pkt.Idx) != videoIdx || !pkt.IsKeyFrame) {
+				continue
+			}
+			started = true
+			base = pkt.Time
+		}
+
+		if pkt.Time -= base; pkt.Time < 0 {
+			pkt.Time = 0
+		}
+
+		if err = s.WritePacket(pkt); err != nil {
+			return err
+		}
+		tis.status.AddPacket(len(pkt.Data))
+	}
+}
+
+// watch channel关闭或推流离开(只剩垫片)后停止
+func (tis *Pusher) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tis.done:
+			return
+		case <-tis.ch.Done():
+			tis.Stop()
+			return
+		case <-ticker.C:
+		}
+
+		if !tis.ch.IsPublishing() {
+			tis.Stop()
+			return
+		}
+	}
+}
+
+func (tis *Pusher) setSink(s sink) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return false
+	}
+	tis.sink = s
+	return true
+}
+
+func (tis *Pusher) isStopped() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+	return tis.closed
+}
+
+// Stop 断开目的地, Run随后返回
+func (tis *Pusher) Stop() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return
+	}
+	tis.closed = true
+	close(tis.done)
+	if tis.sink != nil {
+		_ = tis.sink.Close()
+	}
+}
@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtpmpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/media"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/general252/live/format/rtmp"
+	"github.com/pion/rtp"
+)
+
+const writeTimeout = 10 * time.Second
+
+// sink 转发的目的地
+type sink interface {
+	WriteHeader(streams []av.CodecData) error
+	WritePacket(pkt av.Packet) error
+	Close() error
+}
+
+// openSink 按scheme连接目的地
+func openSink(rawURL string) (sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "rtmp", "rtmps":
+		return newRtmpSink(u)
+	case "rtsp", "rtsps":
+		return newRtspSink(rawURL), nil
+	default:
+		return nil, fmt.Errorf("relay: unsupported url %v", rawURL)
+	}
+}
+
+// rtmpSink rtmp publish
+type rtmpSink struct {
+	conn *rtmp.Conn
+}
+
+func newRtmpSink(u *url.URL) (*rtmpSink, error) {
+	if u.Scheme == "rtmp" {
+		conn, err := rtmp.DialTimeout(u.String(), dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &rtmpSink{conn: conn}, nil
+	}
+
+	// rtmps 默认443端口
+	if len(u.Port()) == 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	netConn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", u.Host, &tls.Config{
+		ServerName: u.Hostname(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn := rtmp.NewConn(netConn)
+	conn.URL = u
+	return &rtmpSink{conn: conn}, nil
+}
+
+func (tis *rtmpSink) WriteHeader(streams []av.CodecData) error {
+	_ = tis.conn.NetConn().SetDeadline(time.Now().Add(writeTimeout))
+	if err := tis.conn.WriteHeader(streams); err != nil {
+		return err
+	}
+	return tis.conn.WriteTrailer()
+}
+
+// WritePacket 每个包都发送, 不等缓冲区满
+func (tis *rtmpSink) WritePacket(pkt av.Packet) error {
+	_ = tis.conn.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := tis.conn.WritePacket(pkt); err != nil {
+		return err
+	}
+	return tis.conn.WriteTrailer()
+}
+
+func (tis *rtmpSink) Close() error {
+	return tis.conn.Close()
+}
+
+// rtspSink rtsp record, 支持h264和aac
+type rtspSink struct {
+	url    string
+	client *gortsplib.Client
+
+	h264Media *media.Media
+	h264Enc   *rtph264.Encoder
+	h264Idx   int
+	aacMedia  *media.Media
+	aacEnc    *rtpmpeg4audio.Encoder
+	aacIdx    int
+
+	started bool
+	done    chan struct{} // 连接断开
+	err     error
+}
+
+func newRtspSink(rawURL string) *rtspSink {
+	return &rtspSink{
+		url:     rawURL,
+		client:  &gortsplib.Client{},
+		h264Idx: -1,
+		aacIdx:  -1,
+		done:    make(chan struct{}),
+	}
+}
+
+func (tis *rtspSink) WriteHeader(streams []av.CodecData) error {
+	var medias media.Medias
+
+	for i, stream := range streams {
+		switch stream := stream.(type) {
+		case h264parser.CodecData:
+			if tis.h264Idx >= 0 {
+				continue
+			}
+			f := &format.H264{
+				PayloadTyp:        96,
+				SPS:               stream.SPS(),
+				PPS:               stream.PPS(),
+				PacketizationMode: 1,
+			}
+			tis.h264Media = &media.Media{
+				Type:    media.TypeVideo,
+				Formats: []format.Format{f},
+			}
+			medias = append(medias, tis.h264Media)
+			tis.h264Enc = f.CreateEncoder()
+			tis.h264Idx = i
+
+		case aacparser.CodecData:
+			if tis.aacIdx >= 0 {
+				continue
+			}
+			f := &format.MPEG4Audio{
+				PayloadTyp: 97,
+				Config: &mpeg4audio.Config{
+					Type:         mpeg4audio.ObjectType(stream.Config.ObjectType),
+					SampleRate:   stream.SampleRate(),
+					ChannelCount: stream.ChannelLayout().Count(),
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			}
+			tis.aacMedia = &media.Media{
+				Type:    media.TypeAudio,
+				Formats: []format.Format{f},
+			}
+			medias = append(medias, tis.aacMedia)
+			tis.aacEnc = f.CreateEncoder()
+			tis.aacIdx = i
+		}
+	}
+
+	if len(medias) == 0 {
+		return errNoSupportedMedia
+	}
+
+	if err := tis.client.StartRecording(tis.url, medias); err != nil {
+		return err
+	}
+	tis.started = true
+
+	go func() {
+		tis.err = tis.client.Wait()
+		close(tis.done)
+	}()
+	return nil
+}
+
+func (tis *rtspSink) WritePacket(pkt av.Packet) error {
+	// 写入是异步的, 断开后才返回error
+	select {
+	case <-tis.done:
+		return tis.err
+	default:
+	}
+
+	var (
+		medi    *media.Media
+		packets []*rtp.Packet
+		err     error
+	)
+
+	switch int(pkt.Idx) {
+	case tis.h264Idx:
+		nalus, _ := h264parser.SplitNALUs(pkt.Data)
+		medi = tis.h264Media
+		packets, err = tis.h264Enc.Encode(nalus, pkt.Time)
+	case tis.aacIdx:
+		medi = tis.aacMedia
+		packets, err = tis.aacEnc.Encode([][]byte{pkt.Data}, pkt.Time)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, packet := range packets {
+		if err = tis.client.WritePacketRTP(medi, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tis *rtspSink) Close() error {
+	if !tis.started {
+		return nil
+	}
+	return tis.client.Close()
+}
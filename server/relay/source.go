@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+	"github.com/general252/live/format/rtmp"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	readTimeout = 10 * time.Second
+)
+
+// source 上游流
+type source interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+	Close() error
+}
+
+// openSource 按scheme连接上游
+func openSource(rawURL string) (source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "rtmp":
+		return newRtmpSource(rawURL)
+	case "http", "https":
+		return newFlvSource(rawURL)
+	case "rtsp", "rtsps":
+		return newRtspSource(rawURL)
+	default:
+		return nil, fmt.Errorf("relay: unsupported url %v", rawURL)
+	}
+}
+
+// rtmpSource rtmp play
+type rtmpSource struct {
+	conn *rtmp.Conn
+}
+
+func newRtmpSource(rawURL string) (*rtmpSource, error) {
+	conn, err := rtmp.DialTimeout(rawURL, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &rtmpSource{conn: conn}, nil
+}
+
+func (tis *rtmpSource) Streams() ([]av.CodecData, error) {
+	_ = tis.conn.NetConn().SetReadDeadline(time.Now().Add(readTimeout))
+	return tis.conn.Streams()
+}
+
+func (tis *rtmpSource) ReadPacket() (av.Packet, error) {
+	_ = tis.conn.NetConn().SetReadDeadline(time.Now().Add(readTimeout))
+	return tis.conn.ReadPacket()
+}
+
+func (tis *rtmpSource) Close() error {
+	return tis.conn.Close()
+}
+
+// flvSource http-flv
+type flvSource struct {
+	cancel  context.CancelFunc
+	resp    *http.Response
+	demuxer *flv.Demuxer
+	timer   *time.Timer
+}
+
+func newFlvSource(rawURL string) (*flvSource, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// 超时后取消请求, 每次读取后重置
+	timer := time.AfterFunc(dialTimeout+readTimeout, cancel)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		timer.Stop()
+		cancel()
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("relay: %v %v", rawURL, resp.Status)
+	}
+
+	return &flvSource{
+		cancel:  cancel,
+		resp:    resp,
+		demuxer: flv.NewDemuxer(bufio.NewReader(resp.Body)),
+		timer:   timer,
+	}, nil
+}
+
+func (tis *flvSource) Streams() ([]av.CodecData, error) {
+	tis.timer.Reset(readTimeout)
+	return tis.demuxer.Streams()
+}
+
+func (tis *flvSource) ReadPacket() (av.Packet, error) {
+	tis.timer.Reset(readTimeout)
+	return tis.demuxer.ReadPacket()
+}
+
+func (tis *flvSource) Close() error {
+	tis.timer.Stop()
+	tis.cancel()
+	return tis.resp.Body.Close()
+}
@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/url"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+)
+
+var errNoSupportedMedia = errors.New("relay: no supported media (h264, aac)")
+
+// rtspSource rtsp play, 支持h264和aac
+type rtspSource struct {
+	client  *gortsplib.Client
+	streams []av.CodecData
+
+	pkts    chan av.Packet
+	done    chan struct{} // 连接断开
+	closing chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newRtspSource(rawURL string) (*rtspSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tis := &rtspSource{
+		client: &gortsplib.Client{
+			ReadTimeout: readTimeout,
+		},
+		pkts:    make(chan av.Packet, 256),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+
+	if err = tis.client.Start(u.Scheme, u.Host); err != nil {
+		return nil, err
+	}
+
+	if err = tis.setup(u); err != nil {
+		_ = tis.client.Close()
+		return nil, err
+	}
+
+	go func() {
+		tis.err = tis.client.Wait()
+		close(tis.done)
+	}()
+
+	return tis, nil
+}
+
+// setup 选择第一个h264和aac媒体
+func (tis *rtspSource) setup(u *url.URL) error {
+	medias, baseURL, _, err := tis.client.Describe(u)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range medias {
+		for _, f := range m.Formats {
+			var (
+				idx    = len(tis.streams)
+				stream av.CodecData
+				cb     func(*rtp.Packet)
+			)
+
+			switch f := f.(type) {
+			case *format.H264:
+				if stream, err = h264parser.NewCodecDataFromSPSAndPPS(f.SafeSPS(), f.SafePPS()); err != nil {
+					continue
+				}
+				cb = tis.onH264(f, idx)
+			case *format.MPEG4Audio:
+				config := aacparser.MPEG4AudioConfig{
+					SampleRate:    f.Config.SampleRate,
+					ChannelLayout: av.CH_FRONT_CENTER,
+					ObjectType:    uint(f.Config.Type),
+				}
+				if f.Config.ChannelCount == 2 {
+					config.ChannelLayout = av.CH_STEREO
+				}
+				if stream, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+					continue
+				}
+				cb = tis.onMPEG4Audio(f, idx)
+			default:
+				continue
+			}
+
+			if _, err = tis.client.Setup(m, baseURL, 0, 0); err != nil {
+				return err
+			}
+			tis.client.OnPacketRTP(m, f, cb)
+			tis.streams = append(tis.streams, stream)
+			break
+		}
+	}
+
+	if len(tis.streams) == 0 {
+		return errNoSupportedMedia
+	}
+
+	_, err = tis.client.Play(nil)
+	return err
+}
+
+// onH264 一帧的nalu合并为一个avcc包
+func (tis *rtspSource) onH264(f *format.H264, idx int) func(*rtp.Packet) {
+	decoder := f.CreateDecoder()
+
+	return func(pkt *rtp.Packet) {
+		nalus, pts, err := decoder.DecodeUntilMarker(pkt)
+		if err != nil {
+			return
+		}
+
+		var (
+			buf = &bytes.Buffer{}
+			key bool
+		)
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+				// 参数在头中
+				continue
+			case h264.NALUTypeIDR:
+				key = true
+			}
+			_ = binary.Write(buf, binary.BigEndian, uint32(len(nalu)))
+			buf.Write(nalu)
+		}
+		if buf.Len() == 0 {
+			return
+		}
+
+		tis.push(av.Packet{
+			IsKeyFrame: key,
+			Idx:        int8(idx),
+			Time:       pts,
+			Data:       buf.Bytes(),
+		})
+	}
+}
+
+func (tis *rtspSource) onMPEG4Audio(f *format.MPEG4Audio, idx int) func(*rtp.Packet) {
+	decoder := f.CreateDecoder()
+
+	return func(pkt *rtp.Packet) {
+		aus, pts, err := decoder.Decode(pkt)
+		if err != nil {
+			return
+		}
+
+		for i, au := range aus {
+			tis.push(av.Packet{
+				Idx:  int8(idx),
+				Time: pts + time.Duration(i)*1024*time.Second/time.Duration(f.Config.SampleRate),
+				Data: au,
+			})
+		}
+	}
+}
+
+// push 在gortsplib的回调中, 关闭后不阻塞
+func (tis *rtspSource) push(pkt av.Packet) {
+	select {
+	case tis.pkts <- pkt:
+	case <-tis.closing:
+	}
+}
+
+func (tis *rtspSource) Streams() ([]av.CodecData, error) {
+	return tis.streams, nil
+}
+
+func (tis *rtspSource) ReadPacket() (av.Packet, error) {
+	select {
+	case pkt := <-tis.pkts:
+		return pkt, nil
+	case <-tis.done:
+		return av.Packet{}, tis.err
+	}
+}
+
+func (tis *rtspSource) Close() error {
+	tis.once.Do(func() {
+		close(tis.closing)
+	})
+	return tis.client.Close()
+}
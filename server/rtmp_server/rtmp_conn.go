@@ -0,0 +1,35 @@
+package rtmp_server
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/general252/live/format/rtmp"
+)
+
+// vdk的rtmp.Server不能关闭监听, 所以自己accept, 用format/rtmp创建服务端连接
+
+// flushConn 拉流时每个包都发送, vdk只在缓冲区满时发送, 新的读者要等几秒才能收到数据
+type flushConn struct {
+	*rtmp.Conn
+}
+
+func (tis flushConn) WritePacket(pkt av.Packet) error {
+	if err := tis.Conn.WritePacket(pkt); err != nil {
+		return err
+	}
+	return tis.Conn.WriteTrailer()
+}
+
+// onStatus状态码
+const (
+	statusPlayFailed         = "NetStream.Play.Failed"
+	statusPlayStreamNotFound = "NetStream.Play.StreamNotFound"
+	statusPublishDenied      = "NetStream.Publish.Denied"
+)
+
+// writeStatus 发送error级别的onStatus, Prepare中已经回复了Start
+func writeStatus(conn *rtmp.Conn, code string, description string) error {
+	_ = conn.NetConn().SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return conn.WriteStatus("error", code, description)
+}
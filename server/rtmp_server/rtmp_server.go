@@ -1,19 +1,17 @@
 package rtmp_server
 
 import (
-	"fmt"
+	"context"
 	"log"
-	"os"
-	"time"
+	"net"
+	"sync"
 
-	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
-	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/av/avutil"
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
-	"github.com/deepch/vdk/format/aac"
-	"github.com/deepch/vdk/format/rtmp"
+	"github.com/general252/live/format/rtmp"
 	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
 )
 
 // ffmpeg -re -i demo.flv -c copy -f flv rtmp://localhost/movie
@@ -21,144 +19,201 @@ import (
 // ffplay http://localhost:8080/movie
 // ffplay http://localhost:8080/screen
 
+type Option struct {
+	Enable bool   `yaml:"enable"`
+	Addr   string `yaml:"addr"` // ":1935", "[::]:1935"
+}
+
 type RtmpServer struct {
-	server *rtmp.Server
+	option Option
 	parent server_interface.ServerInterface
+
+	listener net.Listener
+	conns    *util.Map[string, *rtmp.Conn]
+	wg       sync.WaitGroup
 }
 
-func NewRtmpServer(parent server_interface.ServerInterface, port int) *RtmpServer {
-	tis := &RtmpServer{
+func NewRtmpServer(parent server_interface.ServerInterface, option Option) *RtmpServer {
+	return &RtmpServer{
+		option: option,
 		parent: parent,
+		conns:  util.NewMap[string, *rtmp.Conn](),
+	}
+}
+
+// Start 监听, 失败时返回error
+func (tis *RtmpServer) Start() error {
+	listener, err := net.Listen("tcp", tis.option.Addr)
+	if err != nil {
+		return err
 	}
+	tis.listener = listener
 
-	addr := fmt.Sprintf(":%d", port)
+	log.Printf("rtmp listen: %v", listener.Addr())
 
-	tis.server = &rtmp.Server{
-		Addr:          addr,
-		HandlePublish: tis.handleRtmpPublish,
-		HandlePlay:    tis.handleRtmpPlay,
-		HandleConn:    nil,
+	tis.wg.Add(1)
+	go tis.serve()
+
+	return nil
+}
+
+// Shutdown 停止监听, 关闭所有连接, 等待处理结束
+func (tis *RtmpServer) Shutdown(ctx context.Context) error {
+	if tis.listener == nil {
+		return nil
 	}
 
-	return tis
+	_ = tis.listener.Close()
+	tis.conns.Range(func(key string, value *rtmp.Conn) bool {
+		_ = value.Close()
+		return true
+	})
+
+	return util.Wait(ctx, &tis.wg)
 }
 
-func (tis *RtmpServer) Serve() error {
-	log.Printf("rtmp listen: %v", tis.server.Addr)
-	return tis.server.ListenAndServe()
+func (tis *RtmpServer) serve() {
+	defer tis.wg.Done()
+
+	for {
+		netConn, err := tis.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		key := netConn.RemoteAddr().String()
+		conn := rtmp.NewServerConn(netConn)
+		tis.conns.Store(key, conn)
+
+		tis.wg.Add(1)
+		go func() {
+			defer tis.wg.Done()
+			defer tis.conns.Delete(key)
+
+			tis.handleConn(conn)
+		}()
+	}
+}
+
+func (tis *RtmpServer) handleConn(conn *rtmp.Conn) {
+	// 握手, 读取connect/play/publish命令
+	if err := conn.Prepare(); err != nil {
+		log.Println(err)
+		_ = conn.Close()
+		return
+	}
+
+	if conn.IsPlaying() {
+		tis.handleRtmpPlay(conn)
+	} else if conn.IsPublishing() {
+		tis.handleRtmpPublish(conn)
+	} else {
+		_ = conn.Close()
+	}
 }
 
 // handleRtmpPlay rtmp play 拉流
 func (tis *RtmpServer) handleRtmpPlay(conn *rtmp.Conn) {
+	defer conn.Close()
+
 	connPath := conn.URL.Path
+	remoteAddr := conn.NetConn().RemoteAddr().String()
 	log.Printf("拉流: %v", connPath)
 
+	req := server_interface.NewStreamRequest("rtmp", connPath, remoteAddr, conn.URL.Query())
+	timeshift, err := req.GetTimeshift()
+	if err != nil {
+		log.Println(err)
+		_ = writeStatus(conn, statusPlayFailed, err.Error())
+		return
+	}
+	if err = tis.parent.AuthPlay(req); err != nil {
+		log.Println(err)
+		_ = writeStatus(conn, statusPlayFailed, err.Error())
+		return
+	}
+
 	ch, ok := tis.parent.GetChannel(connPath)
 	if !ok {
 		log.Printf("GetChannel fail. %v", connPath)
+		_ = writeStatus(conn, statusPlayStreamNotFound, "not found "+connPath)
+		return
+	}
+
+	if err = tis.parent.OnPlay(req); err != nil {
+		log.Println(err)
+		_ = writeStatus(conn, statusPlayFailed, err.Error())
 		return
 	}
+	defer tis.parent.OnStop(req)
+
+	sub := ch.Subscribe("rtmp", remoteAddr)
+	sub.SetLagPolicy(tis.parent.GetLagPolicy(), func() {
+		_ = conn.Close()
+	})
+	defer sub.Close()
+	if timeshift > 0 {
+		sub.Seek(timeshift)
+	}
 
-	cursor := ch.Que.Latest()
-	_ = avutil.CopyFile(conn, cursor)
+	session := server_interface.NewSession(server_interface.SessionPlayer, "rtmp", connPath, remoteAddr, func() {
+		_ = conn.Close()
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
 
+	if err := avutil.CopyFile(flushConn{conn}, sub); err == server_interface.ErrSlowConsumer {
+		log.Printf("拉流落后, 断开: %v %v", connPath, remoteAddr)
+	}
 }
 
 // handleRtmpPublish rtmp publish 推流
 func (tis *RtmpServer) handleRtmpPublish(conn *rtmp.Conn) {
+	defer conn.Close()
+
 	streams, _ := conn.Streams()
 	connPath := conn.URL.Path
+	remoteAddr := conn.NetConn().RemoteAddr().String()
 	log.Printf("推流: %v", connPath)
 	defer log.Printf("推流关闭: %v", connPath)
 
-	ch, ok := tis.parent.CreateChannel(connPath)
-	if !ok {
-		log.Printf("CreateChannel fail. %v", connPath)
+	req := server_interface.NewStreamRequest("rtmp", connPath, remoteAddr, conn.URL.Query())
+	if err := tis.parent.OnPublish(req); err != nil {
+		log.Println(err)
+		_ = writeStatus(conn, statusPublishDenied, err.Error())
 		return
 	}
-	defer tis.parent.RemoteChannel(connPath)
+	defer tis.parent.OnUnpublish(req)
 
-	for _, stream := range streams {
-		switch stream := stream.(type) {
-		case h264parser.CodecData:
-			log.Printf("%#v", stream.Record)
-		case aacparser.CodecData:
-			log.Printf("%#v", stream.ConfigBytes)
-		}
-	}
-	_ = ch.Que.WriteHeader(streams)
-
-	go func() {
-		cursor := ch.Que.Latest()
-		_ = copyPackets(cursor, streams)
-	}()
-
-	time.Sleep(time.Second)
-	_ = avutil.CopyPackets(ch.Que, conn)
-}
-
-// copyPackets 测试服务器保存的数据是否正确
-func copyPackets(src av.PacketReader, streams []av.CodecData) (err error) {
-	fpH264, err := os.Create("out_server.h264")
+	// 已有推流时按冲突策略拒绝
+	handle, err := tis.parent.CreateChannel(connPath)
 	if err != nil {
 		log.Println(err)
+		_ = writeStatus(conn, statusPublishDenied, err.Error())
 		return
 	}
+	defer handle.Close()
 
-	defer fpH264.Close()
+	handle.SetPublisher("rtmp", remoteAddr)
 
-	fpAAC, err := os.Create("out_server.aac")
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer fpAAC.Close()
-	writerAAC := aac.NewMuxer(fpAAC)
+	session := server_interface.NewSession(server_interface.SessionPublisher, "rtmp", connPath, remoteAddr, func() {
+		_ = conn.Close()
+	})
+	tis.parent.AddSession(session)
+	defer tis.parent.RemoveSession(session.GetID())
 
 	for _, stream := range streams {
-		if stream.Type() == av.AAC {
-			_ = writerAAC.WriteHeader([]av.CodecData{stream})
-			break
+		switch stream := stream.(type) {
+		case h264parser.CodecData:
+			log.Printf("%#v", stream.Record)
+		case aacparser.CodecData:
+			log.Printf("%#v", stream.ConfigBytes)
 		}
 	}
+	_ = handle.WriteHeader(streams)
 
-	var annexBNALUStartCode = []byte{0x00, 0x00, 0x00, 0x01}
-
-	for {
-		var pkt av.Packet
-		if pkt, err = src.ReadPacket(); err != nil {
-			log.Println(err)
-			break
-		}
-
-		// 输出到文件
-		{
-			stream := streams[pkt.Idx]
-			switch stream := stream.(type) {
-			case h264parser.CodecData:
-
-				nalUtils, _ := h264parser.SplitNALUs(pkt.Data)
-				for _, nal := range nalUtils {
-					typ := h264.NALUType(nal[0] & 0x1F)
-					if typ == h264.NALUTypeIDR {
-						_, _ = fpH264.Write(annexBNALUStartCode)
-						_, _ = fpH264.Write(stream.SPS())
-						_, _ = fpH264.Write(annexBNALUStartCode)
-						_, _ = fpH264.Write(stream.PPS())
-					}
-
-					_, _ = fpH264.Write(annexBNALUStartCode)
-					_, _ = fpH264.Write(nal)
-				}
-
-			case aacparser.CodecData:
-				_ = stream
-				writerAAC.WritePacket(pkt)
-			}
-		}
-
-		// dst.WritePacket(pkt)
+	// 被替换后返回ErrNotOwner, 结束推流
+	if err = avutil.CopyPackets(handle, conn); err == server_interface.ErrNotOwner {
+		log.Printf("推流被替换: %v", connPath)
 	}
-
-	return nil
 }
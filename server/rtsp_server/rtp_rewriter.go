@@ -0,0 +1,79 @@
+package rtsp_server
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/media"
+	"github.com/pion/rtp"
+)
+
+// rtpRewriter 更换推流后保持ssrc不变, 序号和时间戳连续, rtsp读者不需要重新协商
+type rtpRewriter struct {
+	clockRate int
+	ssrc      uint32
+
+	seqOffset uint16
+	tsOffset  uint32
+
+	started bool
+	reset   bool
+	lastSeq uint16
+	lastTs  uint32
+	lastAt  time.Time
+}
+
+func newRtpRewriter(clockRate int) *rtpRewriter {
+	return &rtpRewriter{
+		clockRate: clockRate,
+		ssrc:      rand.Uint32(),
+	}
+}
+
+// Reset 下一个包来自新的推流
+func (tis *rtpRewriter) Reset() {
+	tis.reset = true
+}
+
+// Rewrite 修改pkt的ssrc, 序号, 时间戳
+func (tis *rtpRewriter) Rewrite(pkt *rtp.Packet) {
+	if !tis.started {
+		tis.started = true
+	} else if tis.reset {
+		// 接在上一个包之后, 时间戳加上断开的时间
+		elapsed := time.Since(tis.lastAt).Seconds() * float64(tis.clockRate)
+		tis.seqOffset = tis.lastSeq + 1 - pkt.SequenceNumber
+		tis.tsOffset = tis.lastTs + uint32(elapsed) - pkt.Timestamp
+	}
+	tis.reset = false
+
+	pkt.SSRC = tis.ssrc
+	pkt.SequenceNumber += tis.seqOffset
+	pkt.Timestamp += tis.tsOffset
+
+	tis.lastSeq = pkt.SequenceNumber
+	tis.lastTs = pkt.Timestamp
+	tis.lastAt = time.Now()
+}
+
+// sameMedias 两次推流的媒体相同时可以复用stream
+func sameMedias(a media.Medias, b media.Medias) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Type != b[i].Type || len(a[i].Formats) != len(b[i].Formats) {
+			return false
+		}
+
+		for j := range a[i].Formats {
+			fa, fb := a[i].Formats[j], b[i].Formats[j]
+			if fa.String() != fb.String() || fa.PayloadType() != fb.PayloadType() || fa.ClockRate() != fb.ClockRate() {
+				return false
+			}
+		}
+	}
+
+	return true
+}
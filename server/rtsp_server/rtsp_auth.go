@@ -0,0 +1,148 @@
+package rtsp_server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/base"
+	"github.com/aler9/gortsplib/v2/pkg/headers"
+	"github.com/general252/live/server/server_interface"
+)
+
+const (
+	authRealm = "live"
+
+	// Digest nonce的有效期, 足够客户端完成DESCRIBE/SETUP/PLAY
+	nonceTimeout = time.Minute
+)
+
+// rtspAuth 解析 Basic/Digest 凭证, 每次要求凭证时生成新的nonce
+type rtspAuth struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time // nonce -> 过期时间
+}
+
+func newRtspAuth() *rtspAuth {
+	return &rtspAuth{
+		nonces: map[string]time.Time{},
+	}
+}
+
+// newNonce 生成nonce, 同时删除过期的
+func (tis *rtspAuth) newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	nonce := hex.EncodeToString(b)
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	now := time.Now()
+	for n, expire := range tis.nonces {
+		if now.After(expire) {
+			delete(tis.nonces, n)
+		}
+	}
+	tis.nonces[nonce] = now.Add(nonceTimeout)
+	return nonce
+}
+
+// validNonce nonce是否由这里生成且没有过期
+func (tis *rtspAuth) validNonce(nonce string) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	expire, ok := tis.nonces[nonce]
+	return ok && time.Now().Before(expire)
+}
+
+// setCredential 将请求中的凭证填入req, 返回是否携带了凭证
+func (tis *rtspAuth) setCredential(req *server_interface.StreamRequest, request *base.Request) bool {
+	values, ok := request.Header["Authorization"]
+	if !ok {
+		return false
+	}
+
+	var auth headers.Authorization
+	if err := auth.Unmarshal(values); err != nil {
+		return false
+	}
+
+	switch auth.Method {
+	case headers.AuthBasic:
+		req.User = auth.BasicUser
+		req.Password = auth.BasicPass
+
+	case headers.AuthDigest:
+		digest := auth.DigestValues
+		if digest.Username == nil || digest.Nonce == nil || digest.URI == nil || digest.Response == nil {
+			return false
+		}
+		if (digest.Realm != nil && *digest.Realm != authRealm) || !tis.validNonce(*digest.Nonce) || !matchURI(*digest.URI, request) {
+			return false
+		}
+
+		nonce := *digest.Nonce
+		req.User = *digest.Username
+		req.SetDigest(func(password string) bool {
+			response := md5Hex(md5Hex(*digest.Username+":"+authRealm+":"+password) +
+				":" + nonce + ":" + md5Hex(string(request.Method)+":"+*digest.URI))
+			return subtle.ConstantTimeCompare([]byte(*digest.Response), []byte(response)) == 1
+		})
+	}
+
+	return true
+}
+
+// matchURI Digest中的uri必须是这次请求的url, SETUP时也可以是不带track的url
+func matchURI(uri string, request *base.Request) bool {
+	u := request.URL.CloneWithoutCredentials()
+	if uri == u.String() {
+		return true
+	}
+	if request.Method != base.Setup {
+		return false
+	}
+
+	u.Path = path.Dir(u.Path)
+	u.RawPath = ""
+	if uri == u.String() {
+		return true
+	}
+	u.Path += "/"
+	return uri == u.String()
+}
+
+// unauthorized 要求客户端提供凭证
+func (tis *rtspAuth) unauthorized() *base.Response {
+	realm := authRealm
+	nonce := tis.newNonce()
+
+	var value base.HeaderValue
+	value = append(value, (&headers.Authenticate{
+		Method: headers.AuthBasic,
+		Realm:  &realm,
+	}).Marshal()...)
+	value = append(value, (&headers.Authenticate{
+		Method: headers.AuthDigest,
+		Realm:  &realm,
+		Nonce:  &nonce,
+	}).Marshal()...)
+
+	return &base.Response{
+		StatusCode: base.StatusUnauthorized,
+		Header: base.Header{
+			"WWW-Authenticate": value,
+		},
+	}
+}
+
+func md5Hex(in string) string {
+	h := md5.Sum([]byte(in))
+	return hex.EncodeToString(h[:])
+}
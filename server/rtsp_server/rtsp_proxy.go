@@ -2,10 +2,18 @@ package rtsp_server
 
 import (
 	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/base"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtpmpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/headers"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/aacparser"
@@ -13,31 +21,35 @@ import (
 	"github.com/general252/live/server/server_interface"
 )
 
+// RtspSessionProxy 每个rtsp读者一个代理, 从channel的缓存中最近的关键帧开始
 type RtspSessionProxy struct {
-	parent   server_interface.ServerInterface
 	ctx      *gortsplib.ServerHandlerOnDescribeCtx
 	ch       *server_interface.Channel
 	connPath string
 
-	stream *gortsplib.ServerStream
+	stream     *gortsplib.ServerStream
+	sub        *server_interface.Subscriber
+	copyPacket func()
+
+	playing   bool // 收到PLAY, 在发送响应后开始复制
+	startOnce sync.Once
 }
 
-func NewRtspSessionProxy(parent server_interface.ServerInterface, ctx *gortsplib.ServerHandlerOnDescribeCtx) *RtspSessionProxy {
-	tis := &RtspSessionProxy{
-		parent:   parent,
+// NewRtspSessionProxy ch是DESCRIBE时查找到的channel
+func NewRtspSessionProxy(ch *server_interface.Channel, ctx *gortsplib.ServerHandlerOnDescribeCtx) *RtspSessionProxy {
+	return &RtspSessionProxy{
 		ctx:      ctx,
+		ch:       ch,
 		connPath: ctx.Path,
 	}
-
-	tis.ch, _ = parent.GetChannel(tis.connPath)
-
-	return tis
 }
 
 func (tis *RtspSessionProxy) Init() error {
 	ch := tis.ch
 
-	streams, err := ch.Que.Latest().Streams()
+	tis.sub = ch.Subscribe("rtsp", tis.ctx.Conn.NetConn().RemoteAddr().String())
+
+	streams, err := tis.sub.Streams()
 	if err != nil {
 		return err
 	}
@@ -113,11 +125,19 @@ func (tis *RtspSessionProxy) Init() error {
 	var copyPacket = func() {
 
 		var (
-			h264RtpEncoder = formatH264.CreateEncoder()
-			aacRtpEncoder  = formatAAC.CreateEncoder()
-			packetReader   = ch.Que.Latest()
+			h264RtpEncoder *rtph264.Encoder
+			aacRtpEncoder  *rtpmpeg4audio.Encoder
+			packetReader   = tis.sub
 		)
 
+		// 只有视频或只有音频时, 另一个format为nil
+		if formatH264 != nil {
+			h264RtpEncoder = formatH264.CreateEncoder()
+		}
+		if formatAAC != nil {
+			aacRtpEncoder = formatAAC.CreateEncoder()
+		}
+
 		for {
 			pkt, err := packetReader.ReadPacket()
 			if err != nil {
@@ -160,17 +180,47 @@ func (tis *RtspSessionProxy) Init() error {
 		}
 	}
 
-	go copyPacket()
-
+	tis.copyPacket = copyPacket
 	tis.stream = serverStream
 
 	return nil
 }
 
+// Start 读者开始播放后复制packet, 之前写入stream的包会被丢弃
+func (tis *RtspSessionProxy) Start() {
+	tis.startOnce.Do(func() {
+		go tis.copyPacket()
+	})
+}
+
+// playOffset PLAY请求的时移. Range: npt=now- 回到最新, npt=120- 从最新往前120秒, 否则使用query中的timeshift
+func playOffset(req *base.Request, query string) (time.Duration, error) {
+	if v, ok := req.Header["Range"]; ok && len(v) == 1 {
+		if strings.HasPrefix(v[0], "npt=now") {
+			return 0, nil
+		}
+
+		var r headers.Range
+		if err := r.Unmarshal(v); err != nil {
+			return 0, err
+		}
+		if npt, ok := r.Value.(*headers.RangeNPT); ok && npt.Start > 0 {
+			return npt.Start, nil
+		}
+	}
+
+	values, _ := url.ParseQuery(query)
+	return server_interface.ParseTimeshift(values.Get("timeshift"))
+}
+
 func (tis *RtspSessionProxy) Close() {
 	log.Printf("RtspSessionProxy Close %v", tis.connPath)
 
 	if tis.stream != nil {
 		_ = tis.stream.Close()
 	}
+
+	if tis.sub != nil {
+		tis.sub.Close()
+	}
 }
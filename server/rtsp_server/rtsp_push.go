@@ -5,19 +5,22 @@ import (
 	"encoding/binary"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib/v2"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph265"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
 	"github.com/deepch/vdk/codec/opusparser"
 	"github.com/deepch/vdk/format/aac"
-	"github.com/general252/live/format/mpegts"
 	"github.com/general252/live/server/server_interface"
 	"github.com/pion/rtp"
 )
@@ -27,25 +30,32 @@ import (
 
 type RtspSessionPusher struct {
 	parent   server_interface.ServerInterface
-	ch       *server_interface.Channel
+	handle   *server_interface.ChannelHandle
 	connPath string
+	replaced int32
 
 	ctx       *gortsplib.ServerHandlerOnAnnounceCtx
-	stream    *gortsplib.ServerStream
+	session   *RtspSession
 	publisher *gortsplib.ServerSession
 
 	multiDecoders  map[format.Format]MultiDecoder
 	singleDecoders map[format.Format]SingleDecoder
 }
 
-func NewRtspSessionPusher(parent server_interface.ServerInterface, ctx *gortsplib.ServerHandlerOnAnnounceCtx) *RtspSessionPusher {
+func NewRtspSessionPusher(parent server_interface.ServerInterface, ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*RtspSessionPusher, error) {
 	connPath := ctx.Path
 	log.Printf("推流: %v", connPath)
+
+	handle, err := parent.CreateChannel(connPath)
+	if err != nil {
+		return nil, err
+	}
+
 	tis := &RtspSessionPusher{
 		parent:         parent,
+		handle:         handle,
 		connPath:       connPath,
 		ctx:            ctx,
-		stream:         gortsplib.NewServerStream(ctx.Medias),
 		publisher:      ctx.Session,
 		multiDecoders:  map[format.Format]MultiDecoder{},
 		singleDecoders: map[format.Format]SingleDecoder{},
@@ -74,10 +84,7 @@ func NewRtspSessionPusher(parent server_interface.ServerInterface, ctx *gortspli
 		}
 	}
 
-	ch, ok := tis.parent.CreateChannel(connPath)
-	if !ok {
-		log.Printf("CreateChannel fail. %v", connPath)
-	} else {
+	{
 		var streams []av.CodecData
 
 		for _, m := range ctx.Medias {
@@ -89,6 +96,12 @@ func NewRtspSessionPusher(parent server_interface.ServerInterface, ctx *gortspli
 					} else {
 						log.Println(err)
 					}
+				case *format.H265:
+					if codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(f.SafeVPS(), f.SafeSPS(), f.SafePPS()); err == nil {
+						streams = append(streams, codecData)
+					} else {
+						log.Println(err)
+					}
 				case *format.Opus:
 					streams = append(streams, opusparser.NewCodecData(f.ChannelCount))
 				case *format.MPEG4Audio:
@@ -113,11 +126,27 @@ func NewRtspSessionPusher(parent server_interface.ServerInterface, ctx *gortspli
 			}
 		}
 
-		ch.Que.WriteHeader(streams)
-		tis.ch = ch
+		handle.SetPublisher("rtsp", ctx.Conn.NetConn().RemoteAddr().String())
+		_ = handle.WriteHeader(streams)
 	}
 
-	return tis
+	return tis, nil
+}
+
+// IsActive 是否是当前写入channel的推流
+func (tis *RtspSessionPusher) IsActive() bool {
+	return tis.handle.IsActive()
+}
+
+// writePacket 被替换后关闭推流
+func (tis *RtspSessionPusher) writePacket(pkt av.Packet) error {
+	err := tis.handle.WritePacket(pkt)
+	if err == server_interface.ErrNotOwner && atomic.CompareAndSwapInt32(&tis.replaced, 0, 1) {
+		log.Printf("推流被替换: %v", tis.connPath)
+		// 在回调中, 异步关闭
+		go tis.publisher.Close()
+	}
+	return err
 }
 
 func (tis *RtspSessionPusher) onPacketRTP(m *media.Media, f format.Format, pkt *rtp.Packet) {
@@ -131,6 +160,7 @@ func (tis *RtspSessionPusher) onPacketRTP(m *media.Media, f format.Format, pkt *
 	case *format.H264:
 		tis.onH264(m, f, pkt)
 	case *format.H265:
+		tis.onH265(f, pkt)
 	case *format.Opus:
 	case *format.MPEG4Audio:
 		tis.onMPEG4Audio(m, f, pkt)
@@ -143,13 +173,11 @@ func (tis *RtspSessionPusher) onPacketRTP(m *media.Media, f format.Format, pkt *
 }
 
 var (
-	mpegTsMuxer *mpegts.Muxer
-	fpH264      *os.File
+	fpH264 *os.File
 )
 
 func (tis *RtspSessionPusher) onH264(m *media.Media, f format.Format, pkt *rtp.Packet) {
-	formatH264, ok := f.(*format.H264)
-	if !ok {
+	if _, ok := f.(*format.H264); !ok {
 		return
 	}
 
@@ -166,7 +194,7 @@ func (tis *RtspSessionPusher) onH264(m *media.Media, f format.Format, pkt *rtp.P
 		return
 	}
 
-	if true && tis.ch != nil {
+	if true {
 		for _, nalu := range nalus {
 			buf := &bytes.Buffer{}
 
@@ -179,7 +207,7 @@ func (tis *RtspSessionPusher) onH264(m *media.Media, f format.Format, pkt *rtp.P
 			buf.Write(nalu)
 
 			typ := h264.NALUType(nalu[0] & 0x1F)
-			err = tis.ch.Que.WritePacket(av.Packet{
+			err = tis.writePacket(av.Packet{
 				IsKeyFrame:      typ == h264.NALUTypeIDR,
 				Idx:             0,
 				CompositionTime: 0,
@@ -187,22 +215,12 @@ func (tis *RtspSessionPusher) onH264(m *media.Media, f format.Format, pkt *rtp.P
 				Duration:        0,
 				Data:            buf.Bytes(),
 			})
-			if err != nil {
+			if err != nil && err != server_interface.ErrNotOwner {
 				log.Println(err)
 			}
 		}
 	}
 
-	// 写ts文件
-	if false {
-		if mpegTsMuxer == nil {
-			if f, err := os.Create("out.ts"); err == nil {
-				mpegTsMuxer = mpegts.NewMuxer(f, formatH264.SafeSPS(), formatH264.SafePPS())
-			}
-		}
-		_ = mpegTsMuxer.Encode(nalus, pts)
-	}
-
 	// 写h264文件
 	if false {
 		if fpH264 == nil {
@@ -240,6 +258,52 @@ func (tis *RtspSessionPusher) onH264(m *media.Media, f format.Format, pkt *rtp.P
 	}
 }
 
+// onH265 一个access unit写成一个包, nalu前加长度
+func (tis *RtspSessionPusher) onH265(f format.Format, pkt *rtp.Packet) {
+	decoder, ok := tis.multiDecoders[f].(*rtph265.Decoder)
+	if !ok {
+		return
+	}
+
+	nalus, pts, err := decoder.DecodeUntilMarker(pkt)
+	if err != nil {
+		if err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
+			log.Printf("ERR: %v", err)
+		}
+		return
+	}
+
+	var (
+		data       []byte
+		isKeyFrame bool
+	)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		typ := h265.NALUType((nalu[0] >> 1) & 0x3f)
+		if typ >= h265.NALUType_BLA_W_LP && typ <= h265.NALUType_CRA_NUT {
+			isKeyFrame = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	err = tis.writePacket(av.Packet{
+		IsKeyFrame: isKeyFrame,
+		Idx:        0,
+		Time:       pts,
+		Data:       data,
+	})
+	if err != nil && err != server_interface.ErrNotOwner {
+		log.Println(err)
+	}
+}
+
 var (
 	fpAAC    *os.File
 	aacMuxer *aac.Muxer
@@ -267,7 +331,7 @@ func (tis *RtspSessionPusher) onMPEG4Audio(m *media.Media, f format.Format, pkt
 
 	if true {
 		for _, nalu := range nalus {
-			err = tis.ch.Que.WritePacket(av.Packet{
+			err = tis.writePacket(av.Packet{
 				IsKeyFrame:      false,
 				Idx:             1, // 索引
 				CompositionTime: 0,
@@ -327,12 +391,7 @@ func (tis *RtspSessionPusher) onMPEG4Audio(m *media.Media, f format.Format, pkt
 }
 
 func (tis *RtspSessionPusher) Close() {
-	if tis.stream != nil {
-		_ = tis.stream.Close()
-		tis.stream = nil
-	}
-
-	tis.parent.RemoteChannel(tis.connPath)
+	tis.handle.Close()
 }
 
 func (tis *RtspSessionPusher) GetConnPath() string {
@@ -1,8 +1,10 @@
 package rtsp_server
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"net/url"
 
 	"github.com/aler9/gortsplib/v2"
 	"github.com/aler9/gortsplib/v2/pkg/base"
@@ -16,35 +18,66 @@ import (
 // ffmpeg -re -i demo.flv -c:v libx264 -c:a aac -f rtsp rtsp://127.0.0.1:554/test
 // ffplay rtsp://127.0.0.1:554/test
 
+// Option tcp始终可用, UdpRtpAddr/UdpRtcpAddr为空时不启用udp, MulticastIPRange为空时不启用组播
+type Option struct {
+	Enable      bool   `yaml:"enable"`
+	Addr        string `yaml:"addr"`          // ":554"
+	UdpRtpAddr  string `yaml:"udp_rtp_addr"`  // ":8000"
+	UdpRtcpAddr string `yaml:"udp_rtcp_addr"` // ":8001"
+
+	MulticastIPRange  string `yaml:"multicast_ip_range"` // "224.1.0.0/16"
+	MulticastRtpPort  int    `yaml:"multicast_rtp_port"`
+	MulticastRtcpPort int    `yaml:"multicast_rtcp_port"`
+}
+
 type RtspServer struct {
 	parent server_interface.ServerInterface
 	server *gortsplib.Server
 }
 
-func NewRtspServer(parent server_interface.ServerInterface, rtspPort, rtpPort, rtcpPort int) *RtspServer {
+func NewRtspServer(parent server_interface.ServerInterface, option Option) *RtspServer {
 	tis := &RtspServer{
 		parent: parent,
 		server: &gortsplib.Server{
-			Handler:           newServerHandler(parent),
-			RTSPAddress:       ":8554",
-			UDPRTPAddress:     ":8000",
-			UDPRTCPAddress:    ":8001",
-			MulticastIPRange:  "224.1.0.0/16",
-			MulticastRTPPort:  8002,
-			MulticastRTCPPort: 8003,
+			Handler:        newServerHandler(parent),
+			RTSPAddress:    option.Addr,
+			UDPRTPAddress:  option.UdpRtpAddr,
+			UDPRTCPAddress: option.UdpRtcpAddr,
 		},
 	}
 
-	tis.server.RTSPAddress = fmt.Sprintf(":%v", rtspPort)
-	tis.server.UDPRTPAddress = fmt.Sprintf(":%v", rtpPort)
-	tis.server.UDPRTCPAddress = fmt.Sprintf(":%v", rtcpPort)
+	if len(option.MulticastIPRange) > 0 {
+		tis.server.MulticastIPRange = option.MulticastIPRange
+		tis.server.MulticastRTPPort = option.MulticastRtpPort
+		tis.server.MulticastRTCPPort = option.MulticastRtcpPort
+	}
 
 	return tis
 }
 
-func (tis *RtspServer) Serve() error {
+// Start 监听, 失败时返回error
+func (tis *RtspServer) Start() error {
+	if err := tis.server.Start(); err != nil {
+		return err
+	}
+
 	log.Printf("rtsp listen: %v", tis.server.RTSPAddress)
-	return tis.server.StartAndWait()
+	return nil
+}
+
+// Shutdown 关闭监听和所有连接
+func (tis *RtspServer) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- tis.server.Close()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // This example shows how to
@@ -56,12 +89,16 @@ type serverHandler struct {
 	parent server_interface.ServerInterface
 
 	sessions *util.Map[string, *RtspSession]
+	auth     *rtspAuth
+	readers  *util.Map[string, *server_interface.StreamRequest] // 以连接地址为key, 连接上已鉴权的拉流请求, PLAY时回调on_play
 }
 
 func newServerHandler(parent server_interface.ServerInterface) *serverHandler {
 	return &serverHandler{
 		parent:   parent,
 		sessions: util.NewMap[string, *RtspSession](),
+		auth:     newRtspAuth(),
+		readers:  util.NewMap[string, *server_interface.StreamRequest](),
 	}
 }
 
@@ -73,16 +110,30 @@ func (sh *serverHandler) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
 // OnConnClose called when a connection is closed.
 func (sh *serverHandler) OnConnClose(ctx *gortsplib.ServerHandlerOnConnCloseCtx) {
 	log.Printf("conn closed (%v)", ctx.Error)
+	sh.readers.Delete(ctx.Conn.NetConn().RemoteAddr().String())
 
 	userData := ctx.Conn.UserData()
 	if userData != nil {
-		if session, ok := userData.(*RtspSession); ok {
-			session.Close()
-			sh.sessions.Delete(session.connPath)
+		switch data := userData.(type) {
+		case *RtspSession:
+			data.Close()
+			sh.deleteSession(data)
+		case *RtspSessionPusher:
+			session := data.session
+			session.RemovePusher(data, func() {
+				sh.deleteSession(session)
+			})
 		}
 	}
 }
 
+// deleteSession 从map中删除, 已被替换时不删除
+func (sh *serverHandler) deleteSession(session *RtspSession) {
+	if cur, ok := sh.sessions.Load(session.connPath); ok && cur == session {
+		sh.sessions.Delete(session.connPath)
+	}
+}
+
 // OnSessionOpen called when a session is opened.
 func (sh *serverHandler) OnSessionOpen(ctx *gortsplib.ServerHandlerOnSessionOpenCtx) {
 	log.Printf("session opened")
@@ -91,6 +142,77 @@ func (sh *serverHandler) OnSessionOpen(ctx *gortsplib.ServerHandlerOnSessionOpen
 // OnSessionClose called when a session is closed.
 func (sh *serverHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
 	log.Printf("session closed")
+
+	if data, ok := ctx.Session.UserData().(*rtspSessionData); ok {
+		sh.parent.RemoveSession(data.session.GetID())
+
+		if data.session.GetType() == server_interface.SessionPublisher {
+			sh.parent.OnUnpublish(data.req)
+		} else {
+			sh.parent.OnStop(data.req)
+		}
+	}
+}
+
+// rtspSessionData 绑定到ServerSession的userData
+type rtspSessionData struct {
+	session *server_interface.Session
+	req     *server_interface.StreamRequest
+}
+
+// newStreamRequest 生成鉴权/回调的请求
+func newStreamRequest(connPath string, query string, conn *gortsplib.ServerConn) *server_interface.StreamRequest {
+	values, _ := url.ParseQuery(query)
+	return server_interface.NewStreamRequest("rtsp", connPath, conn.NetConn().RemoteAddr().String(), values)
+}
+
+// addSession 注册会话, 在OnSessionClose中移除
+func (sh *serverHandler) addSession(typ server_interface.SessionType, req *server_interface.StreamRequest, ss *gortsplib.ServerSession) {
+	session := server_interface.NewSession(typ, "rtsp", req.ConnPath, req.RemoteAddr, func() {
+		_ = ss.Close()
+	})
+	sh.parent.AddSession(session)
+	ss.SetUserData(&rtspSessionData{
+		session: session,
+		req:     req,
+	})
+}
+
+// reject OnPlay/OnPublish返回error时的响应, 超过带宽453, 超过数量503, 没有凭证401, 否则403
+func (sh *serverHandler) reject(err error, hasCredential bool) *base.Response {
+	switch {
+	case errors.Is(err, server_interface.ErrBandwidthExceeded):
+		return &base.Response{
+			StatusCode: base.StatusNotEnoughBandwidth,
+		}
+	case errors.Is(err, server_interface.ErrLimitExceeded):
+		return &base.Response{
+			StatusCode: base.StatusServiceUnavailable,
+		}
+	case !hasCredential:
+		return sh.auth.unauthorized()
+	default:
+		return &base.Response{
+			StatusCode: base.StatusForbidden,
+		}
+	}
+}
+
+// authorizePlay 拉流鉴权, 同一连接上已经通过的路径不再检查. 只鉴权, PLAY时才回调on_play, 保证和on_stop成对
+func (sh *serverHandler) authorizePlay(connPath string, query string, conn *gortsplib.ServerConn, request *base.Request) *base.Response {
+	if req, ok := sh.readers.Load(conn.NetConn().RemoteAddr().String()); ok && req.ConnPath == connPath {
+		return nil
+	}
+
+	req := newStreamRequest(connPath, query, conn)
+	hasCredential := sh.auth.setCredential(req, request)
+	if err := sh.parent.AuthPlay(req); err != nil {
+		log.Println(err)
+		return sh.reject(err, hasCredential)
+	}
+
+	sh.readers.Store(req.RemoteAddr, req)
+	return nil
 }
 
 // OnDescribe called when receiving a DESCRIBE request.
@@ -100,27 +222,34 @@ func (sh *serverHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (
 
 	// 拉流
 
+	if res := sh.authorizePlay(connPath, ctx.Query, ctx.Conn, ctx.Request); res != nil {
+		return res, nil, nil
+	}
+
 	session, ok := sh.sessions.Load(connPath)
 	if !ok {
-		if _, ok = sh.parent.GetChannel(connPath); ok {
-			// 通过代理拉流
+		var ch *server_interface.Channel
+		if ch, ok = sh.parent.GetChannel(connPath); ok {
+			// 通过代理拉流, 每个连接一个代理
+			if old, isProxy := ctx.Conn.UserData().(*RtspSession); isProxy {
+				old.Close()
+			}
 			sess := NewRtspSession(connPath)
 
 			// 初始化失败
-			if err := sess.CreateProxy(sh.parent, ctx); err != nil {
+			if err := sess.CreateProxy(ch, ctx); err != nil {
 				log.Println(err)
+				sess.Close()
 
 				return &base.Response{
 					StatusCode: base.StatusBadGateway,
 				}, nil, nil
 			}
 
-			sh.sessions.Store(connPath, sess)
-
 			// 绑定userData
 			ctx.Conn.SetUserData(sess)
 
-			session, ok = sh.sessions.Load(connPath)
+			session = sess
 		}
 	}
 
@@ -146,21 +275,39 @@ func (sh *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (
 
 	// 推流
 
-	// 关闭已有的
-	if session, ok := sh.sessions.Load(connPath); ok {
-		session.Close()
-		sh.sessions.Delete(connPath)
+	req := newStreamRequest(connPath, ctx.Query, ctx.Conn)
+	hasCredential := sh.auth.setCredential(req, ctx.Request)
+	if err := sh.parent.OnPublish(req); err != nil {
+		log.Println(err)
+		return sh.reject(err, hasCredential), nil
 	}
 
-	// 创建新的推流
-	session := NewRtspSession(connPath)
-	session.CreatePusher(sh.parent, ctx)
+	// 创建新的推流, 已有推流时按冲突策略处理
+	pusher, err := NewRtspSessionPusher(sh.parent, ctx)
+	if err != nil {
+		log.Println(err)
+		sh.parent.OnUnpublish(req)
+		return &base.Response{
+			StatusCode: base.StatusNotAcceptable,
+		}, nil
+	}
 
 	// save the track list and the publisher
-	sh.sessions.Store(connPath, session)
+	// 重连和备用的推流加入已有的session, rtsp读者不断开
+	session, ok := sh.sessions.Load(connPath)
+	if !ok || !session.AddPusher(pusher) {
+		if ok {
+			session.Close()
+		}
+		session = NewRtspSession(connPath)
+		session.AddPusher(pusher)
+		sh.sessions.Store(connPath, session)
+	}
+	pusher.session = session
+	sh.addSession(server_interface.SessionPublisher, req, ctx.Session)
 
 	// 绑定userData
-	ctx.Conn.SetUserData(session)
+	ctx.Conn.SetUserData(pusher)
 
 	return &base.Response{
 		StatusCode: base.StatusOK,
@@ -172,7 +319,17 @@ func (sh *serverHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.
 	connPath := ctx.Path
 	log.Printf("setup request, %v", connPath)
 
-	session, ok := sh.sessions.Load(connPath)
+	// 拉流可以不经过DESCRIBE直接SETUP, 推流在ANNOUNCE时已鉴权
+	if ctx.Session.State() != gortsplib.ServerSessionStatePreRecord {
+		if res := sh.authorizePlay(connPath, ctx.Query, ctx.Conn, ctx.Request); res != nil {
+			return res, nil, nil
+		}
+	}
+
+	session, ok := ctx.Conn.UserData().(*RtspSession)
+	if !ok || session.connPath != connPath {
+		session, ok = sh.sessions.Load(connPath)
+	}
 	if !ok {
 		log.Println("not found session ", connPath)
 		return &base.Response{
@@ -192,36 +349,62 @@ func (sh *serverHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Re
 	connPath := ctx.Path
 	log.Printf("play request, %v", connPath)
 
+	// PAUSE之后再次PLAY不重复回调和注册
+	if _, ok := ctx.Session.UserData().(*rtspSessionData); !ok {
+		if res := sh.authorizePlay(connPath, ctx.Query, ctx.Conn, ctx.Request); res != nil {
+			return res, nil
+		}
+
+		// 每个会话一个请求, 在OnSessionClose中回调on_stop
+		authorized, _ := sh.readers.Load(ctx.Conn.NetConn().RemoteAddr().String())
+		req := *authorized
+		if err := sh.parent.OnPlay(&req); err != nil {
+			log.Println(err)
+			return sh.reject(err, true), nil
+		}
+		sh.addSession(server_interface.SessionPlayer, &req, ctx.Session)
+	}
+
+	if session, ok := ctx.Conn.UserData().(*RtspSession); ok && session.proxy != nil {
+		// 每次PLAY重新定位, 没有指定时回到最新
+		offset, err := playOffset(ctx.Request, ctx.Query)
+		if err != nil {
+			log.Println(err)
+			return &base.Response{
+				StatusCode: base.StatusBadRequest,
+			}, nil
+		}
+		session.proxy.sub.Seek(offset)
+		session.proxy.playing = true
+	}
+
 	return &base.Response{
 		StatusCode: base.StatusOK,
 	}, nil
 }
 
+// OnResponse called after every response. PLAY的响应之后读者才会收到stream的包, 这时开始代理
+func (sh *serverHandler) OnResponse(sc *gortsplib.ServerConn, res *base.Response) {
+	if session, ok := sc.UserData().(*RtspSession); ok && session.proxy != nil && session.proxy.playing {
+		if res.StatusCode == base.StatusOK {
+			session.proxy.Start()
+		}
+		session.proxy.playing = false
+	}
+}
+
 // OnRecord called when receiving a RECORD request.
 func (sh *serverHandler) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.Response, error) {
 	connPath := ctx.Path
 	log.Printf("record request, %v", connPath)
 
 	// if we are the publisher, route the RTP packet to all readers
-	var session *RtspSession
-	sh.sessions.Range(func(key string, value *RtspSession) bool {
-		if value.pusher == nil {
-			return true
-		}
-
-		if ctx.Session == value.pusher.publisher {
-			session = value
-			return false
-		}
-		return true
-	})
-
-	if session != nil {
+	if pusher, ok := ctx.Conn.UserData().(*RtspSessionPusher); ok && ctx.Session == pusher.publisher {
 		// called when receiving a RTP packet
-		session.pusher.publisher.OnPacketRTPAny(func(medi *media.Media, forma format.Format, pkt *rtp.Packet) {
+		pusher.publisher.OnPacketRTPAny(func(medi *media.Media, forma format.Format, pkt *rtp.Packet) {
 			// route the RTP packet to all readers
-			session.pusher.stream.WritePacketRTP(medi, pkt)
-			session.pusher.onPacketRTP(medi, forma, pkt) // 转给webrtc
+			pusher.session.writePacketRTP(pusher, medi, pkt)
+			pusher.onPacketRTP(medi, forma, pkt) // 转给webrtc
 		})
 	}
 
@@ -1,33 +1,152 @@
 package rtsp_server
 
 import (
+	"log"
+	"sync"
+
 	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/general252/live/server/server_interface"
+	"github.com/pion/rtp"
 )
 
 type RtspSession struct {
 	connPath string
 
-	pusher *RtspSessionPusher
-	proxy  *RtspSessionProxy
+	proxy *RtspSessionProxy
+
+	// 同一路径的推流(重连, 备用)共享stream, rtsp读者不断开
+	mutex     sync.Mutex
+	pushers   map[*RtspSessionPusher]bool // 推流 -> 媒体是否与stream相同
+	stream    *gortsplib.ServerStream
+	medias    media.Medias
+	rewriters []*rtpRewriter
+	writer    *RtspSessionPusher // 最后写入stream的推流
+	closed    bool
 }
 
 func NewRtspSession(connPath string) *RtspSession {
-	return &RtspSession{connPath: connPath}
+	return &RtspSession{
+		connPath: connPath,
+		pushers:  map[*RtspSessionPusher]bool{},
+	}
+}
+
+// AddPusher 添加推流, session已关闭时返回false
+func (tis *RtspSession) AddPusher(pusher *RtspSessionPusher) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed || tis.proxy != nil {
+		return false
+	}
+
+	medias := pusher.ctx.Medias
+	same := tis.stream != nil && sameMedias(tis.medias, medias)
+
+	if !same && (tis.stream == nil || !pusher.handle.IsBackup()) {
+		if tis.stream != nil {
+			log.Printf("rtsp推流媒体改变, 读者断开: %v", tis.connPath)
+			_ = tis.stream.Close()
+		}
+
+		tis.stream = gortsplib.NewServerStream(medias)
+		tis.medias = medias
+		tis.rewriters = nil
+		for _, m := range medias {
+			tis.rewriters = append(tis.rewriters, newRtpRewriter(m.Formats[0].ClockRate()))
+		}
+		tis.writer = nil
+
+		// 其他推流的媒体与新的stream不同
+		for p := range tis.pushers {
+			tis.pushers[p] = false
+		}
+		same = true
+	}
+
+	tis.pushers[pusher] = same
+	return true
+}
+
+// RemovePusher 推流断开, 没有推流时等待channel关闭(重连超时)再关闭stream
+func (tis *RtspSession) RemovePusher(pusher *RtspSessionPusher, onClose func()) {
+	pusher.Close()
+
+	tis.mutex.Lock()
+	delete(tis.pushers, pusher)
+	idle := len(tis.pushers) == 0
+	tis.mutex.Unlock()
+
+	if !idle {
+		return
+	}
+
+	go func() {
+		<-pusher.handle.GetChannel().Done()
+
+		tis.mutex.Lock()
+		if len(tis.pushers) > 0 || tis.closed {
+			tis.mutex.Unlock()
+			return
+		}
+		tis.closed = true
+		if tis.stream != nil {
+			_ = tis.stream.Close()
+		}
+		tis.mutex.Unlock()
+
+		onClose()
+	}()
 }
 
-func (tis *RtspSession) CreatePusher(parent server_interface.ServerInterface, ctx *gortsplib.ServerHandlerOnAnnounceCtx) {
-	tis.pusher = NewRtspSessionPusher(parent, ctx)
+// writePacketRTP 转发持有者的rtp包给rtsp读者, 更换推流后重写序号
+func (tis *RtspSession) writePacketRTP(pusher *RtspSessionPusher, medi *media.Media, pkt *rtp.Packet) {
+	if !pusher.IsActive() {
+		return
+	}
+
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed || !tis.pushers[pusher] {
+		return
+	}
+
+	idx := -1
+	for i, m := range pusher.ctx.Medias {
+		if m == medi {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return
+	}
+
+	if tis.writer != pusher {
+		tis.writer = pusher
+		for _, rewriter := range tis.rewriters {
+			rewriter.Reset()
+		}
+	}
+
+	out := *pkt
+	tis.rewriters[idx].Rewrite(&out)
+	tis.stream.WritePacketRTP(tis.medias[idx], &out)
 }
 
-func (tis *RtspSession) CreateProxy(parent server_interface.ServerInterface, ctx *gortsplib.ServerHandlerOnDescribeCtx) error {
-	tis.proxy = NewRtspSessionProxy(parent, ctx)
+func (tis *RtspSession) CreateProxy(ch *server_interface.Channel, ctx *gortsplib.ServerHandlerOnDescribeCtx) error {
+	tis.proxy = NewRtspSessionProxy(ch, ctx)
 	return tis.proxy.Init()
 }
 
 func (tis *RtspSession) GetStream() (*gortsplib.ServerStream, bool) {
-	if tis.pusher != nil {
-		return tis.pusher.stream, true
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.stream != nil {
+		return tis.stream, true
 	}
 	if tis.proxy != nil {
 		return tis.proxy.stream, true
@@ -36,8 +155,17 @@ func (tis *RtspSession) GetStream() (*gortsplib.ServerStream, bool) {
 }
 
 func (tis *RtspSession) Close() {
-	if tis.pusher != nil {
-		tis.pusher.Close()
+	tis.mutex.Lock()
+	tis.closed = true
+	pushers := tis.pushers
+	tis.pushers = map[*RtspSessionPusher]bool{}
+	if tis.stream != nil {
+		_ = tis.stream.Close()
+	}
+	tis.mutex.Unlock()
+
+	for pusher := range pushers {
+		pusher.Close()
 	}
 	if tis.proxy != nil {
 		tis.proxy.Close()
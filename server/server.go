@@ -1,12 +1,27 @@
 package server
 
 import (
-	"github.com/deepch/vdk/av/pubsub"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/deepch/vdk/format"
+	"github.com/general252/live/server/auth"
+	"github.com/general252/live/server/cluster"
 	"github.com/general252/live/server/http_server"
+	"github.com/general252/live/server/limit"
+	"github.com/general252/live/server/record"
+	"github.com/general252/live/server/relay"
 	"github.com/general252/live/server/rtmp_server"
 	"github.com/general252/live/server/rtsp_server"
 	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/server/slate"
+	"github.com/general252/live/server/udp_server"
+	"github.com/general252/live/server/web_hook"
 	"github.com/general252/live/util"
 )
 
@@ -14,81 +29,525 @@ func init() {
 	format.RegisterAll()
 }
 
-type Option struct {
-	RtmpPort int
-	HttpPort int
+var ErrServerClosed = errors.New("server closed")
 
-	RtspPort int
-	RtpPort  int
-	RtcpPort int
+// listener 已启动的服务, 关闭时调用
+type listener interface {
+	Shutdown(ctx context.Context) error
 }
 
 type Server struct {
 	option Option
 
 	channels *util.Map[string, *server_interface.Channel]
+	sessions *util.Map[uint64, *server_interface.Session]
 
 	rtmpServer *rtmp_server.RtmpServer
 	httpServer *http_server.HttpServer
 	rtspServer *rtsp_server.RtspServer
+	udpServer  *udp_server.UdpServer
+	puller     *relay.PullManager
+	pusher     *relay.PushManager
+	cluster    *cluster.Cluster
+	limiter    *limit.Limiter
+	recorder   *record.RecordManager
+	listeners  []listener // 已启动的服务
+	closing    int32
+
+	mutex         sync.RWMutex
+	webHook       *web_hook.WebHook
+	authenticator auth.Authenticator
+	customAuth    bool
 }
 
 func NewServer(option *Option) *Server {
 	tis := &Server{
-		option: Option{
-			RtmpPort: 1935,
-			HttpPort: 8080,
-		},
+		option:   *DefaultOption(),
 		channels: util.NewMap[string, *server_interface.Channel](),
+		sessions: util.NewMap[uint64, *server_interface.Session](),
 	}
 
 	if option != nil {
 		tis.option = *option
 	}
 
-	tis.rtmpServer = rtmp_server.NewRtmpServer(tis, tis.option.RtmpPort)
-	tis.httpServer = http_server.NewHttpServer(tis, tis.option.HttpPort)
-	tis.rtspServer = rtsp_server.NewRtspServer(tis, tis.option.RtspPort, tis.option.RtpPort, tis.option.RtcpPort)
+	tis.webHook = web_hook.NewWebHook(tis.option.WebHook)
+	tis.authenticator = auth.NewAuthenticator(tis.option.Auth)
+
+	tis.rtmpServer = rtmp_server.NewRtmpServer(tis, tis.option.Rtmp)
+	tis.httpServer = http_server.NewHttpServer(tis, tis.option.Http, tis.option.Api, tis.option.Hls, tis.option.Webrtc)
+	tis.rtspServer = rtsp_server.NewRtspServer(tis, tis.option.Rtsp)
+	tis.udpServer = udp_server.NewUdpServer(tis, tis.option.Udp)
+	tis.puller = relay.NewPullManager(tis, tis.option.Pull)
+	tis.pusher = relay.NewPushManager(tis, tis.option.Push)
+	tis.cluster = cluster.NewCluster(tis, tis.option.Cluster)
+	tis.limiter = limit.NewLimiter(tis, tis.option.Limits)
+	tis.recorder = record.NewRecordManager(tis, tis.option.Record)
 
 	return tis
 }
 
-func (tis *Server) Serve() {
+// Start 启动所有启用的服务, 监听失败时关闭已启动的服务并返回error
+func (tis *Server) Start(ctx context.Context) error {
+	type service struct {
+		name   string
+		enable bool
+		start  func() error
+		server listener
+	}
 
-	go func() {
-		_ = tis.httpServer.Serve()
-	}()
+	services := []service{
+		{name: "http", enable: tis.option.Http.Enable, start: tis.httpServer.Start, server: tis.httpServer},
+		{name: "rtmp", enable: tis.option.Rtmp.Enable, start: tis.rtmpServer.Start, server: tis.rtmpServer},
+		{name: "rtsp", enable: tis.option.Rtsp.Enable, start: tis.rtspServer.Start, server: tis.rtspServer},
+	}
+
+	for _, s := range services {
+		if !s.enable {
+			continue
+		}
+
+		err := ctx.Err()
+		if err == nil {
+			err = s.start()
+		}
+		if err != nil {
+			_ = tis.Shutdown(context.Background())
+			return fmt.Errorf("%v: %w", s.name, err)
+		}
+
+		tis.listeners = append(tis.listeners, s.server)
+	}
 
-	go func() {
-		_ = tis.rtmpServer.Serve()
-	}()
+	if err := tis.udpServer.Serve(); err != nil {
+		_ = tis.Shutdown(context.Background())
+		return fmt.Errorf("udp: %w", err)
+	}
+	tis.cluster.Start()
+	tis.limiter.Start()
+	tis.recorder.StartRetention()
 
-	go func() {
-		_ = tis.rtspServer.Serve()
-	}()
+	return nil
 }
 
+// Shutdown 拒绝新的请求, 断开所有推流/拉流, 关闭监听, 等待结束或ctx超时
+func (tis *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&tis.closing, 0, 1) {
+		return nil
+	}
+
+	// 源站下线, 边缘不再来拉流
+	tis.cluster.Close()
+	tis.limiter.Close()
+
+	// 断开客户端
+	for _, session := range tis.GetSessions() {
+		session.Close()
+	}
+	tis.udpServer.Close()
+	tis.puller.Close()
+	tis.pusher.Close()
+
+	// 关闭监听
+	var firstErr error
+	for _, l := range tis.listeners {
+		if err := l.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, ch := range tis.GetChannels() {
+		ch.Close()
+	}
+	// 写完录制的文件
+	tis.recorder.Close()
+
+	// 等待所有会话结束
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for len(tis.GetSessions()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return firstErr
+}
+
+func (tis *Server) isClosing() bool {
+	return atomic.LoadInt32(&tis.closing) == 1
+}
+
+// GetChannel 不存在时, 如果配置了上游, 拉流; 边缘从源站拉流; 否则如果配置了垫片, 创建channel循环播放
 func (tis *Server) GetChannel(connPath string) (*server_interface.Channel, bool) {
-	ch, ok := tis.channels.Load(connPath)
-	return ch, ok
+	if ch, ok := tis.channels.Load(connPath); ok {
+		return ch, true
+	}
+	if !tis.isClosing() {
+		if ch, ok := tis.puller.Start(connPath); ok {
+			return ch, true
+		}
+		if ch, ok := tis.puller.StartFrom(connPath, tis.cluster.Lookup(connPath)); ok {
+			return ch, true
+		}
+	}
+	return tis.startSlate(connPath)
+}
+
+// LookupChannel 已有的channel, 没有读者请求时使用, 例如udp输出
+func (tis *Server) LookupChannel(connPath string) (*server_interface.Channel, bool) {
+	return tis.channels.Load(connPath)
+}
+
+// SetClusterRegistry 替换集群的registry, 例如使用外部的服务发现
+func (tis *Server) SetClusterRegistry(registry cluster.Registry) {
+	tis.cluster.SetRegistry(registry)
 }
 
-func (tis *Server) CreateChannel(connPath string) (*server_interface.Channel, bool) {
+// GetPullSources 拉流转发的上游
+func (tis *Server) GetPullSources() []server_interface.PullSource {
+	return tis.puller.Sources()
+}
+
+// AddPullSource 添加或替换上游, Reload时被配置文件覆盖
+func (tis *Server) AddPullSource(source server_interface.PullSource) error {
+	return tis.puller.Add(source)
+}
+
+// RemovePullSource 删除上游, 停止使用它的拉流
+func (tis *Server) RemovePullSource(path string) bool {
+	return tis.puller.Remove(path)
+}
+
+// GetPushTargets 推流转发的目的地
+func (tis *Server) GetPushTargets() []server_interface.PushTarget {
+	return tis.pusher.Targets()
+}
+
+// AddPushTarget 添加或替换转发, 正在推流的路径立即开始, Reload时被配置文件覆盖
+func (tis *Server) AddPushTarget(target server_interface.PushTarget) error {
+	return tis.pusher.Add(target)
+}
+
+// RemovePushTarget 删除转发并停止
+func (tis *Server) RemovePushTarget(path string) bool {
+	return tis.pusher.Remove(path)
+}
+
+// GetUdpInputs udp输入
+func (tis *Server) GetUdpInputs() []server_interface.UdpInput {
+	return tis.udpServer.Inputs()
+}
+
+// AddUdpInput 添加udp输入, Reload时被配置文件覆盖
+func (tis *Server) AddUdpInput(input server_interface.UdpInput) error {
+	return tis.udpServer.AddInput(input)
+}
+
+// RemoveUdpInput 删除udp输入
+func (tis *Server) RemoveUdpInput(connPath string) bool {
+	return tis.udpServer.RemoveInput(connPath)
+}
+
+// GetUdpOutputs udp输出
+func (tis *Server) GetUdpOutputs() []server_interface.UdpOutput {
+	return tis.udpServer.Outputs()
+}
+
+// AddUdpOutput 添加udp输出, Reload时被配置文件覆盖
+func (tis *Server) AddUdpOutput(output server_interface.UdpOutput) error {
+	return tis.udpServer.AddOutput(output)
+}
+
+// RemoveUdpOutput 删除udp输出
+func (tis *Server) RemoveUdpOutput(rawURL string) bool {
+	return tis.udpServer.RemoveOutput(rawURL)
+}
+
+// StartRecord 开始录制正在推流的路径, 为空的项使用默认配置
+func (tis *Server) StartRecord(connPath string, rule server_interface.RecordRule) (server_interface.RecordInfo, error) {
 	ch, ok := tis.channels.Load(connPath)
-	if ok {
+	if !ok {
+		return server_interface.RecordInfo{}, fmt.Errorf("record: %v is not publishing", connPath)
+	}
+	return tis.recorder.StartRecord(ch, rule)
+}
+
+// StopRecord 停止录制
+func (tis *Server) StopRecord(connPath string) (server_interface.RecordInfo, bool) {
+	return tis.recorder.StopRecord(connPath)
+}
+
+// GetRecords 正在录制的状态
+func (tis *Server) GetRecords() []server_interface.RecordInfo {
+	return tis.recorder.Records()
+}
+
+func (tis *Server) GetRetention() server_interface.RetentionInfo {
+	return tis.recorder.RetentionInfo()
+}
+
+func (tis *Server) RunRetention() []server_interface.DeletedRecord {
+	return tis.recorder.RunRetention()
+}
+
+func (tis *Server) CreateChannel(connPath string) (*server_interface.ChannelHandle, error) {
+	if tis.isClosing() {
+		return nil, ErrServerClosed
+	}
+
+	policy := tis.getChannelPolicy(connPath)
+	for {
+		ch := tis.loadOrCreateChannel(connPath)
+
+		handle, err := ch.Acquire(policy)
+		if err == server_interface.ErrChannelClosed {
+			// 正在关闭, 等待从map中删除
+			<-ch.Done()
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v %w", connPath, err)
+		}
+
+		if handle.IsBackup() {
+			log.Printf("backup publisher %v generation %v", connPath, handle.GetGeneration())
+		}
+
+		// 推流断开后由垫片接替
+		tis.startSlate(connPath)
+		tis.pusher.Start(handle.GetChannel())
+		tis.recorder.Start(handle.GetChannel())
+		return handle, nil
+	}
+}
+
+// startSlate 配置了垫片时创建channel并启动, 已经启动时直接返回channel
+func (tis *Server) startSlate(connPath string) (*server_interface.Channel, bool) {
+	tis.mutex.RLock()
+	option := tis.option.Slate
+	tis.mutex.RUnlock()
+
+	filename, ok := util.MatchPath(option.Paths, connPath)
+	if !ok || tis.isClosing() {
 		return nil, false
 	}
 
-	ch = &server_interface.Channel{}
-	ch.Que = pubsub.NewQueue()
-	tis.channels.Store(connPath, ch)
+	for {
+		ch := tis.loadOrCreateChannel(connPath)
 
-	return ch, true
+		s, err := slate.NewSlate(ch, filename, option.IdleTimeout)
+		if err == server_interface.ErrChannelClosed {
+			<-ch.Done()
+			continue
+		}
+		if err == server_interface.ErrChannelExist {
+			return ch, true
+		}
+		if err != nil {
+			log.Println(err)
+			return nil, false
+		}
+
+		go s.Run()
+		return ch, true
+	}
 }
 
-func (tis *Server) RemoteChannel(connPath string) {
+// loadOrCreateChannel 已有的channel, 没有时创建
+func (tis *Server) loadOrCreateChannel(connPath string) *server_interface.Channel {
 	if ch, ok := tis.channels.Load(connPath); ok {
-		_ = ch.Que.Close()
+		return ch
 	}
-	tis.channels.Delete(connPath)
+	ch, _ := tis.channels.LoadOrStore(connPath, tis.newChannel(connPath))
+	return ch
+}
+
+// newChannel 按路径的配置设置gop缓存和时移
+func (tis *Server) newChannel(connPath string) *server_interface.Channel {
+	tis.mutex.RLock()
+	option := tis.option.Channel
+	tis.mutex.RUnlock()
+
+	ch := server_interface.NewChannel(connPath, tis.removeChannel)
+	ch.Que.SetOption(option.getGopCache(connPath))
+	ch.Que.SetTimeshift(option.getTimeshift(connPath))
+	return ch
+}
+
+// removeChannel channel关闭后从map中删除
+func (tis *Server) removeChannel(ch *server_interface.Channel) {
+	// 关闭的channel不会被替换, 只有它自己会删除
+	if cur, ok := tis.channels.Load(ch.GetConnPath()); ok && cur == ch {
+		tis.channels.Delete(ch.GetConnPath())
+	}
+}
+
+// getChannelPolicy 路径的推流策略, 冲突处理精确匹配优先, 然后按通配符匹配
+func (tis *Server) getChannelPolicy(connPath string) server_interface.ChannelPolicy {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+
+	option := tis.option.Channel
+	return server_interface.ChannelPolicy{
+		Conflict:        option.getConflict(connPath),
+		Grace:           option.Grace,
+		FailoverTimeout: option.FailoverTimeout,
+	}
+}
+
+func (tis *Server) GetChannels() []*server_interface.Channel {
+	var channels []*server_interface.Channel
+	tis.channels.Range(func(key string, value *server_interface.Channel) bool {
+		channels = append(channels, value)
+		return true
+	})
+	return channels
+}
+
+func (tis *Server) AddSession(session *server_interface.Session) {
+	tis.sessions.Store(session.GetID(), session)
+}
+
+func (tis *Server) RemoveSession(id uint64) {
+	tis.sessions.Delete(id)
+}
+
+func (tis *Server) GetSession(id uint64) (*server_interface.Session, bool) {
+	return tis.sessions.Load(id)
+}
+
+func (tis *Server) GetSessions() []*server_interface.Session {
+	var sessions []*server_interface.Session
+	tis.sessions.Range(func(key uint64, value *server_interface.Session) bool {
+		sessions = append(sessions, value)
+		return true
+	})
+	return sessions
+}
+
+// Reload 重新加载鉴权, 回调, udp输入输出. 监听地址不变, 已有会话不断开
+func (tis *Server) Reload(option *Option) {
+	tis.mutex.Lock()
+	tis.webHook = web_hook.NewWebHook(option.WebHook)
+	if !tis.customAuth {
+		tis.authenticator = auth.NewAuthenticator(option.Auth)
+	}
+	tis.option.WebHook = option.WebHook
+	tis.option.Auth = option.Auth
+	tis.option.Udp = option.Udp
+	tis.option.Channel = option.Channel
+	tis.option.Slate = option.Slate
+	tis.option.Pull = option.Pull
+	tis.option.Push = option.Push
+	tis.option.Limits = option.Limits
+	tis.option.Record = option.Record
+	tis.option.SlowConsumer = option.SlowConsumer
+	tis.mutex.Unlock()
+
+	tis.udpServer.Reload(option.Udp)
+	tis.puller.Reload(option.Pull)
+	tis.pusher.Reload(option.Push)
+	tis.limiter.Reload(option.Limits)
+	tis.recorder.Reload(option.Record)
+
+	// 已有channel的gop缓存和时移下一次写入时生效
+	for _, ch := range tis.GetChannels() {
+		ch.Que.SetOption(option.Channel.getGopCache(ch.GetConnPath()))
+		ch.Que.SetTimeshift(option.Channel.getTimeshift(ch.GetConnPath()))
+	}
+
+	log.Println("reload option")
+}
+
+// SetAuthenticator 替换鉴权方式, Reload时不再使用配置中的鉴权
+func (tis *Server) SetAuthenticator(authenticator auth.Authenticator) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.authenticator = authenticator
+	tis.customAuth = true
+}
+
+func (tis *Server) getWebHook() *web_hook.WebHook {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+	return tis.webHook
+}
+
+func (tis *Server) getAuthenticator() auth.Authenticator {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+	return tis.authenticator
+}
+
+func (tis *Server) OnPublish(req *server_interface.StreamRequest) error {
+	if tis.isClosing() {
+		return ErrServerClosed
+	}
+	if err := tis.getAuthenticator().AuthPublish(req); err != nil {
+		return err
+	}
+	if err := tis.limiter.CheckPublish(req); err != nil {
+		return err
+	}
+	if err := tis.getWebHook().OnPublish(req); err != nil {
+		tis.limiter.Release(req)
+		return err
+	}
+	return nil
+}
+
+func (tis *Server) AuthPlay(req *server_interface.StreamRequest) error {
+	if tis.isClosing() {
+		return ErrServerClosed
+	}
+	if err := tis.getAuthenticator().AuthPlay(req); err != nil {
+		return err
+	}
+	req.SetAuthorized()
+	return nil
+}
+
+func (tis *Server) OnPlay(req *server_interface.StreamRequest) error {
+	if tis.isClosing() {
+		return ErrServerClosed
+	}
+	if !req.IsAuthorized() {
+		if err := tis.AuthPlay(req); err != nil {
+			return err
+		}
+	}
+	if err := tis.limiter.CheckPlay(req); err != nil {
+		return err
+	}
+	if err := tis.getWebHook().OnPlay(req); err != nil {
+		tis.limiter.Release(req)
+		return err
+	}
+	return nil
+}
+
+// GetLagPolicy 拉流落后时的处理
+func (tis *Server) GetLagPolicy() server_interface.LagPolicy {
+	tis.mutex.RLock()
+	defer tis.mutex.RUnlock()
+	return tis.option.SlowConsumer
+}
+
+func (tis *Server) OnUnpublish(req *server_interface.StreamRequest) {
+	tis.limiter.Release(req)
+	tis.getWebHook().OnUnpublish(req)
+}
+
+func (tis *Server) OnStop(req *server_interface.StreamRequest) {
+	tis.limiter.Release(req)
+	tis.getWebHook().OnStop(req)
+}
+
+func (tis *Server) OnRecordDone(req *server_interface.StreamRequest, file string) {
+	tis.getWebHook().OnRecordDone(req, file)
 }
@@ -0,0 +1,561 @@
+package server_interface
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// ChannelPolicy 同一路径多个推流的处理
+type ChannelPolicy struct {
+	Conflict        ConflictPolicy
+	Grace           time.Duration // 推流断开后channel保留的时间, 期间重新推流的读者不断开
+	FailoverTimeout time.Duration // 当前推流超过这个时间没有数据, 切换到备用推流, 0 只在断开时切换
+}
+
+// Channel 一路流, 发布者通过ChannelHandle写入, 多个读者读取
+type Channel struct {
+	Que *Queue
+
+	connPath string
+	onClose  func(ch *Channel)
+	done     chan struct{}
+
+	mutex   sync.Mutex
+	policy  ChannelPolicy
+	primary *ChannelHandle   // 主推流, 断开后为nil
+	backups []*ChannelHandle // 备用推流
+	slate   *ChannelHandle   // 没有推流时的垫片, 优先级最低
+	active  *ChannelHandle   // 当前写入队列的推流, 在关键帧切换
+	closed  bool
+
+	// 推流断开后保留grace时间, 等待重连
+	idleTimer *time.Timer
+
+	// 切换推流
+	switches   int
+	lastSwitch time.Time
+
+	// 更换推流后重写时间戳, 读者看到的时间戳连续
+	rebase      bool
+	timeOffset  time.Duration
+	lastTime    time.Duration
+	lastWriteAt time.Time
+	lastKeyTime time.Duration // 最新的关键帧, 落后的读者跳到这里
+	hasKeyFrame bool
+
+	protocol    string
+	remoteAddr  string
+	startTime   time.Time
+	tracks      []TrackInfo
+	videoIdx    int
+	videoType   av.CodecType
+	bytesIn     uint64
+	packetsIn   uint64
+	inMeter     rateMeter
+	frameMeter  rateMeter
+	gopCount    int
+	gopLength   int
+	subscribers map[uint64]*Subscriber
+	pushes      []*PushStatus
+}
+
+// NewChannel onClose在channel关闭后调用
+func NewChannel(connPath string, onClose func(ch *Channel)) *Channel {
+	return &Channel{
+		Que:         NewQueue(),
+		connPath:    connPath,
+		onClose:     onClose,
+		done:        make(chan struct{}),
+		startTime:   time.Now(),
+		videoIdx:    -1,
+		subscribers: map[uint64]*Subscriber{},
+	}
+}
+
+func (tis *Channel) GetConnPath() string {
+	return tis.connPath
+}
+
+// Done channel关闭后返回
+func (tis *Channel) Done() <-chan struct{} {
+	return tis.done
+}
+
+// Acquire 注册推流, 已有推流时按policy处理
+// 没有主推流时成为主推流, 否则为备用. 主推流在关键帧时切回
+func (tis *Channel) Acquire(policy ChannelPolicy) (*ChannelHandle, error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return nil, ErrChannelClosed
+	}
+
+	tis.policy = policy
+
+	handle := newChannelHandle(tis)
+	switch {
+	case tis.primary == nil && len(tis.backups) == 0:
+		tis.primary = handle
+		if tis.active == nil && tis.lastWriteAt.IsZero() {
+			// 第一个推流, 不需要等待关键帧
+			tis.active = handle
+			tis.rebase = true
+		}
+
+	case policy.Conflict == ConflictReplace:
+		// 旧的主推流再写入时返回ErrNotOwner
+		if tis.active == tis.primary {
+			tis.active = nil
+		}
+		tis.primary = handle
+
+	case policy.Conflict == ConflictBackup:
+		if tis.primary == nil {
+			tis.primary = handle
+		} else {
+			handle.backup = true
+			tis.backups = append(tis.backups, handle)
+		}
+
+	default:
+		return nil, ErrChannelExist
+	}
+
+	// 重连
+	if tis.idleTimer != nil {
+		tis.idleTimer.Stop()
+		tis.idleTimer = nil
+	}
+
+	return handle, nil
+}
+
+// AcquireSlate 注册垫片推流, 只有一个. 不影响其他推流的冲突处理
+func (tis *Channel) AcquireSlate() (*ChannelHandle, error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.closed {
+		return nil, ErrChannelClosed
+	}
+	if tis.slate != nil {
+		return nil, ErrChannelExist
+	}
+
+	handle := newChannelHandle(tis)
+	handle.slate = true
+	tis.slate = handle
+	if tis.active == nil && tis.lastWriteAt.IsZero() {
+		tis.active = handle
+		tis.rebase = true
+	}
+
+	if tis.idleTimer != nil {
+		tis.idleTimer.Stop()
+		tis.idleTimer = nil
+	}
+
+	return handle, nil
+}
+
+// HasPublisher 是否有推流, 不包括垫片
+func (tis *Channel) HasPublisher() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return tis.primary != nil || len(tis.backups) > 0
+}
+
+// IsPublishing 有推流或推流断开等待重连, 只有垫片时返回false
+func (tis *Channel) IsPublishing() bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return !tis.closed && (tis.primary != nil || len(tis.backups) > 0 || tis.idleTimer != nil)
+}
+
+// SubscriberCount 读者数量
+func (tis *Channel) SubscriberCount() int {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return len(tis.subscribers)
+}
+
+// Close 强制关闭, 所有handle失效
+func (tis *Channel) Close() {
+	tis.mutex.Lock()
+	if tis.closed {
+		tis.mutex.Unlock()
+		return
+	}
+	tis.closed = true
+	tis.primary = nil
+	tis.backups = nil
+	tis.slate = nil
+	tis.active = nil
+	if tis.idleTimer != nil {
+		tis.idleTimer.Stop()
+		tis.idleTimer = nil
+	}
+	tis.mutex.Unlock()
+
+	_ = tis.Que.Close()
+	// 先从map中删除, 等待Done后重试的调用者不会再拿到这个channel
+	if tis.onClose != nil {
+		tis.onClose(tis)
+	}
+	close(tis.done)
+}
+
+func (tis *Channel) isActive(handle *ChannelHandle) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return tis.active == handle
+}
+
+// isRegistered 调用者持有锁
+func (tis *Channel) isRegistered(handle *ChannelHandle) bool {
+	if tis.primary == handle || tis.slate == handle {
+		return true
+	}
+	for _, backup := range tis.backups {
+		if backup == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// release handle关闭, 其他推流在关键帧时接替, 没有推流时等待重连或关闭channel
+func (tis *Channel) release(handle *ChannelHandle) {
+	tis.mutex.Lock()
+
+	if tis.primary == handle {
+		tis.primary = nil
+	}
+	if tis.slate == handle {
+		tis.slate = nil
+	}
+	for i, backup := range tis.backups {
+		if backup == handle {
+			tis.backups = append(tis.backups[:i], tis.backups[i+1:]...)
+			break
+		}
+	}
+	if tis.active == handle {
+		tis.active = nil
+	}
+
+	if tis.closed || tis.primary != nil || len(tis.backups) > 0 || tis.slate != nil {
+		tis.mutex.Unlock()
+		return
+	}
+
+	if tis.policy.Grace > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(tis.policy.Grace, func() {
+			tis.mutex.Lock()
+			expired := tis.idleTimer == timer
+			tis.mutex.Unlock()
+
+			if expired {
+				tis.Close()
+			}
+		})
+		tis.idleTimer = timer
+		tis.mutex.Unlock()
+		return
+	}
+
+	tis.mutex.Unlock()
+	tis.Close()
+}
+
+// stalled 超过FailoverTimeout没有数据, 调用者持有锁
+func (tis *Channel) stalled(handle *ChannelHandle) bool {
+	if handle == nil {
+		return true
+	}
+	timeout := tis.policy.FailoverTimeout
+	return timeout > 0 && time.Since(handle.lastPacketAt) > timeout
+}
+
+// takeOver handle的关键帧到达时是否切换到handle, 返回原因. 调用者持有锁
+func (tis *Channel) takeOver(handle *ChannelHandle) (string, bool) {
+	// 推流替换垫片
+	if tis.active != nil && tis.active == tis.slate {
+		return "publisher", true
+	}
+
+	// 主推流优先
+	if handle == tis.primary {
+		if tis.active == nil {
+			return "primary", true
+		}
+		return "primary returned", true
+	}
+
+	// 备用: 当前推流断开或超时, 并且主推流不可用
+	if !tis.stalled(tis.active) {
+		return "", false
+	}
+	if tis.primary != nil && tis.primary != tis.active && !tis.stalled(tis.primary) {
+		return "", false
+	}
+
+	// 垫片: 所有备用也不可用
+	if handle == tis.slate {
+		for _, backup := range tis.backups {
+			if backup != tis.active && !tis.stalled(backup) {
+				return "", false
+			}
+		}
+		return "no publisher", true
+	}
+
+	if tis.active == nil {
+		return "publisher closed", true
+	}
+	return "publisher timeout", true
+}
+
+// switchTo 切换当前推流, 调用者持有锁
+func (tis *Channel) switchTo(handle *ChannelHandle, reason string) {
+	var from uint64
+	if tis.active != nil {
+		from = tis.active.generation
+	}
+
+	protocol, remoteAddr, streams := handle.getPublisher()
+
+	tis.active = handle
+	tis.protocol = protocol
+	tis.remoteAddr = remoteAddr
+	tis.startTime = time.Now()
+	tis.gopCount = 0
+	tis.gopLength = 0
+	tis.rebase = true
+
+	if streams != nil {
+		tis.setTracks(streams)
+		_ = tis.Que.WriteHeader(streams)
+	}
+
+	if !tis.lastWriteAt.IsZero() {
+		tis.switches++
+		tis.lastSwitch = time.Now()
+		log.Printf("%v switch publisher %v -> %v (%v): %v", tis.connPath, from, handle.generation, remoteAddr, reason)
+	}
+}
+
+// setPublisher 记录发布者
+func (tis *Channel) setPublisher(handle *ChannelHandle, protocol string, remoteAddr string) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.active != handle {
+		return
+	}
+
+	tis.protocol = protocol
+	tis.remoteAddr = remoteAddr
+	tis.startTime = time.Now()
+}
+
+// setTracks 解析轨道信息, 调用者持有锁
+func (tis *Channel) setTracks(streams []av.CodecData) {
+	tis.tracks = tis.tracks[:0]
+	tis.videoIdx = -1
+	for i, stream := range streams {
+		tis.tracks = append(tis.tracks, NewTrackInfo(i, stream))
+		if stream.Type().IsVideo() && tis.videoIdx < 0 {
+			tis.videoIdx = i
+			tis.videoType = stream.Type()
+		}
+	}
+}
+
+// writeHeader 当前推流写入队列, 其他推流在切换时写入
+func (tis *Channel) writeHeader(handle *ChannelHandle, streams []av.CodecData) error {
+	tis.mutex.Lock()
+	if err := tis.checkOwner(handle); err != nil || tis.active != handle {
+		tis.mutex.Unlock()
+		return err
+	}
+	tis.setTracks(streams)
+	tis.mutex.Unlock()
+
+	return tis.Que.WriteHeader(streams)
+}
+
+// checkOwner 调用者持有锁, 被替换返回ErrNotOwner
+func (tis *Channel) checkOwner(handle *ChannelHandle) error {
+	if tis.closed {
+		return ErrChannelClosed
+	}
+	if !tis.isRegistered(handle) {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// writePacket 统计, 写入队列. 其他推流的数据丢弃, 在关键帧时判断是否切换
+func (tis *Channel) writePacket(handle *ChannelHandle, pkt av.Packet) error {
+	tis.mutex.Lock()
+	if err := tis.checkOwner(handle); err != nil {
+		tis.mutex.Unlock()
+		return err
+	}
+
+	handle.lastPacketAt = time.Now()
+
+	if tis.active != handle {
+		if !handle.isKeyFrame(pkt) {
+			tis.mutex.Unlock()
+			return nil
+		}
+		reason, ok := tis.takeOver(handle)
+		if !ok {
+			tis.mutex.Unlock()
+			return nil
+		}
+		tis.switchTo(handle, reason)
+	}
+
+	// 新推流的第一个包接在上一个推流之后
+	if tis.rebase {
+		tis.rebase = false
+		if !tis.lastWriteAt.IsZero() {
+			tis.timeOffset = tis.lastTime + time.Since(tis.lastWriteAt) - pkt.Time
+		}
+	}
+	pkt.Time += tis.timeOffset
+	if pkt.Time > tis.lastTime {
+		tis.lastTime = pkt.Time
+	}
+	tis.lastWriteAt = time.Now()
+
+	tis.bytesIn += uint64(len(pkt.Data))
+	tis.packetsIn++
+	tis.inMeter.Add(len(pkt.Data) * 8)
+
+	if int(pkt.Idx) == tis.videoIdx {
+		tis.frameMeter.Add(1)
+		if pkt.IsKeyFrame {
+			tis.lastKeyTime = pkt.Time
+			tis.hasKeyFrame = true
+			if tis.gopCount > 0 {
+				tis.gopLength = tis.gopCount
+			}
+			tis.gopCount = 0
+		}
+		tis.gopCount++
+	}
+	tis.mutex.Unlock()
+
+	return tis.Que.WritePacket(pkt)
+}
+
+// Subscribe 添加读者, 读取结束后需要Close
+func (tis *Channel) Subscribe(protocol string, remoteAddr string) *Subscriber {
+	sub := newSubscriber(tis, protocol, remoteAddr)
+
+	tis.mutex.Lock()
+	tis.subscribers[sub.id] = sub
+	tis.mutex.Unlock()
+
+	return sub
+}
+
+// GetSubscriber 按id查找读者
+func (tis *Channel) GetSubscriber(id uint64) (*Subscriber, bool) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	sub, ok := tis.subscribers[id]
+	return sub, ok
+}
+
+func (tis *Channel) unsubscribe(sub *Subscriber) {
+	tis.mutex.Lock()
+	delete(tis.subscribers, sub.id)
+	tis.mutex.Unlock()
+}
+
+// AddPush 添加转发状态, 转发结束后需要Close. 转发直接读取Que, 不算读者
+func (tis *Channel) AddPush(url string) *PushStatus {
+	status := &PushStatus{
+		ch:  tis,
+		url: url,
+	}
+
+	tis.mutex.Lock()
+	tis.pushes = append(tis.pushes, status)
+	tis.mutex.Unlock()
+
+	return status
+}
+
+func (tis *Channel) removePush(status *PushStatus) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	for i, s := range tis.pushes {
+		if s == status {
+			tis.pushes = append(tis.pushes[:i], tis.pushes[i+1:]...)
+			break
+		}
+	}
+}
+
+// Info 流信息
+func (tis *Channel) Info() ChannelInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	info := ChannelInfo{
+		ConnPath:   tis.connPath,
+		Protocol:   tis.protocol,
+		RemoteAddr: tis.remoteAddr,
+		StartTime:  tis.startTime,
+		Tracks:     append([]TrackInfo(nil), tis.tracks...),
+		BytesIn:    tis.bytesIn,
+		PacketsIn:  tis.packetsIn,
+		Bitrate:    tis.inMeter.Rate(),
+		FPS:        tis.frameMeter.Rate(),
+		GopLength:  tis.gopLength,
+		Backups:    len(tis.backups),
+		Idle:       tis.idleTimer != nil,
+		Switches:   tis.switches,
+		LastSwitch: tis.lastSwitch,
+	}
+	if tis.active != nil {
+		info.Generation = tis.active.generation
+	}
+
+	if tis.primary != nil {
+		info.Publishers = append(info.Publishers, tis.primary.info(tis.active))
+	}
+	for _, backup := range tis.backups {
+		info.Publishers = append(info.Publishers, backup.info(tis.active))
+	}
+	if tis.slate != nil {
+		info.Publishers = append(info.Publishers, tis.slate.info(tis.active))
+	}
+
+	for _, sub := range tis.subscribers {
+		info.Subscribers = append(info.Subscribers, sub.info(tis.lastTime))
+	}
+	for _, push := range tis.pushes {
+		info.Pushes = append(info.Pushes, push.Info())
+	}
+	info.Cache = tis.Que.Info()
+
+	return info
+}
@@ -0,0 +1,160 @@
+package server_interface
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// ConflictPolicy 同一路径已有推流时的处理
+type ConflictPolicy string
+
+const (
+	ConflictReject  ConflictPolicy = "reject"  // 拒绝新的推流
+	ConflictReplace ConflictPolicy = "replace" // 踢掉已有的推流
+	ConflictBackup  ConflictPolicy = "backup"  // 作为备用, 主推流断开或超时后接替
+)
+
+var (
+	ErrChannelExist  = errors.New("channel exist")
+	ErrChannelClosed = errors.New("channel closed")
+	ErrNotOwner      = errors.New("not channel owner")
+)
+
+var channelGeneration uint64 = 0
+
+// ChannelHandle 推流对channel的所有权, 被替换后写入返回ErrNotOwner
+// 只有当前推流的数据写入队列, 其他推流的数据丢弃, 在关键帧时切换
+type ChannelHandle struct {
+	ch         *Channel
+	generation uint64
+	backup     bool
+	slate      bool
+
+	// 由Channel的锁保护
+	lastPacketAt time.Time
+
+	mutex      sync.Mutex
+	protocol   string
+	remoteAddr string
+	streams    []av.CodecData
+	videoIdx   int
+	closed     bool
+}
+
+func newChannelHandle(ch *Channel) *ChannelHandle {
+	return &ChannelHandle{
+		ch:           ch,
+		generation:   atomic.AddUint64(&channelGeneration, 1),
+		lastPacketAt: time.Now(),
+		videoIdx:     -1,
+	}
+}
+
+func (tis *ChannelHandle) GetChannel() *Channel {
+	return tis.ch
+}
+
+// GetGeneration 每个handle唯一, 递增
+func (tis *ChannelHandle) GetGeneration() uint64 {
+	return tis.generation
+}
+
+// IsActive 是否是当前写入channel的推流
+func (tis *ChannelHandle) IsActive() bool {
+	return tis.ch.isActive(tis)
+}
+
+// IsBackup 是否是备用推流
+func (tis *ChannelHandle) IsBackup() bool {
+	return tis.backup
+}
+
+// SetPublisher 记录发布者
+func (tis *ChannelHandle) SetPublisher(protocol string, remoteAddr string) {
+	tis.mutex.Lock()
+	tis.protocol = protocol
+	tis.remoteAddr = remoteAddr
+	tis.mutex.Unlock()
+
+	tis.ch.setPublisher(tis, protocol, remoteAddr)
+}
+
+// WriteHeader 不是当前推流时只保存, 切换时写入
+func (tis *ChannelHandle) WriteHeader(streams []av.CodecData) error {
+	tis.mutex.Lock()
+	tis.streams = streams
+	tis.videoIdx = -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			tis.videoIdx = i
+			break
+		}
+	}
+	tis.mutex.Unlock()
+
+	return tis.ch.writeHeader(tis, streams)
+}
+
+// WritePacket 被替换后返回ErrNotOwner
+func (tis *ChannelHandle) WritePacket(pkt av.Packet) error {
+	return tis.ch.writePacket(tis, pkt)
+}
+
+// Close 释放所有权, 没有备用时关闭channel
+func (tis *ChannelHandle) Close() {
+	tis.mutex.Lock()
+	if tis.closed {
+		tis.mutex.Unlock()
+		return
+	}
+	tis.closed = true
+	tis.mutex.Unlock()
+
+	tis.ch.release(tis)
+}
+
+func (tis *ChannelHandle) getPublisher() (string, string, []av.CodecData) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return tis.protocol, tis.remoteAddr, tis.streams
+}
+
+// isKeyFrame 可以从这个包开始切换, 没有视频时任意包都可以
+func (tis *ChannelHandle) isKeyFrame(pkt av.Packet) bool {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.streams == nil {
+		return false
+	}
+	if tis.videoIdx < 0 {
+		return true
+	}
+	return int(pkt.Idx) == tis.videoIdx && pkt.IsKeyFrame
+}
+
+// info 调用者持有Channel的锁
+func (tis *ChannelHandle) info(active *ChannelHandle) PublisherInfo {
+	protocol, remoteAddr, _ := tis.getPublisher()
+
+	role := "primary"
+	if tis.backup {
+		role = "backup"
+	} else if tis.slate {
+		role = "slate"
+	}
+
+	return PublisherInfo{
+		Generation: tis.generation,
+		Protocol:   protocol,
+		RemoteAddr: remoteAddr,
+		Role:       role,
+		Active:     tis == active,
+		LastPacket: tis.lastPacketAt,
+	}
+}
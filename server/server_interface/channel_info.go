@@ -0,0 +1,141 @@
+package server_interface
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// TrackInfo 轨道信息
+type TrackInfo struct {
+	Index int    `json:"index"`
+	Codec string `json:"codec"`
+
+	// 视频
+	Width   int  `json:"width,omitempty"`
+	Height  int  `json:"height,omitempty"`
+	FPS     int  `json:"fps,omitempty"`
+	Profile uint `json:"profile,omitempty"`
+	Level   uint `json:"level,omitempty"`
+
+	// 音频
+	SampleRate int  `json:"sample_rate,omitempty"`
+	Channels   int  `json:"channels,omitempty"`
+	ObjectType uint `json:"object_type,omitempty"`
+}
+
+// SubscriberInfo 读者信息
+type SubscriberInfo struct {
+	ID         uint64    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartTime  time.Time `json:"start_time"`
+	BytesOut   uint64    `json:"bytes_out"`
+	PacketsOut uint64    `json:"packets_out"`
+	Bitrate    int64     `json:"bitrate"`   // bit/s
+	Lag        int64     `json:"lag"`       // 落后最新数据的时间, 毫秒
+	Dropped    uint64    `json:"dropped"`   // 落后时丢弃的帧
+	Skips      uint64    `json:"skips"`     // 落后时跳到最新关键帧的次数
+	Timeshift  int64     `json:"timeshift"` // 时移落后于最新数据的时间, 毫秒
+}
+
+// PublisherInfo 推流信息, 同一路径可以有主推流和备用推流
+type PublisherInfo struct {
+	Generation uint64    `json:"generation"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	Role       string    `json:"role"`   // primary, backup, slate
+	Active     bool      `json:"active"` // 当前写入的推流
+	LastPacket time.Time `json:"last_packet"`
+}
+
+// ChannelInfo 流信息
+type ChannelInfo struct {
+	ConnPath    string           `json:"conn_path"`
+	Protocol    string           `json:"protocol"`
+	RemoteAddr  string           `json:"remote_addr"`
+	StartTime   time.Time        `json:"start_time"`
+	Tracks      []TrackInfo      `json:"tracks"`
+	BytesIn     uint64           `json:"bytes_in"`
+	PacketsIn   uint64           `json:"packets_in"`
+	Bitrate     int64            `json:"bitrate"` // bit/s
+	FPS         int64            `json:"fps"`
+	GopLength   int              `json:"gop_length"` // 帧数
+	Generation  uint64           `json:"generation"` // 当前推流的handle
+	Backups     int              `json:"backups"`    // 备用推流数量
+	Idle        bool             `json:"idle"`       // 推流断开, 等待重连
+	Switches    int              `json:"switches"`   // 切换推流的次数
+	LastSwitch  time.Time        `json:"last_switch"`
+	Publishers  []PublisherInfo  `json:"publishers"`
+	Subscribers []SubscriberInfo `json:"subscribers"`
+	Pushes      []PushInfo       `json:"pushes,omitempty"` // 转发
+	Cache       CacheInfo        `json:"cache"`            // gop缓存和时移
+}
+
+// NewTrackInfo 从SPS/AAC config解析轨道信息
+func NewTrackInfo(index int, stream av.CodecData) TrackInfo {
+	info := TrackInfo{
+		Index: index,
+		Codec: stream.Type().String(),
+	}
+
+	switch stream := stream.(type) {
+	case h264parser.CodecData:
+		info.Width = stream.Width()
+		info.Height = stream.Height()
+		info.FPS = stream.FPS()
+		info.Profile = stream.SPSInfo.ProfileIdc
+		info.Level = stream.SPSInfo.LevelIdc
+	case h265parser.CodecData:
+		info.Width = stream.Width()
+		info.Height = stream.Height()
+		info.FPS = stream.FPS()
+		info.Profile = stream.SPSInfo.ProfileIdc
+		info.Level = stream.SPSInfo.LevelIdc
+	case aacparser.CodecData:
+		info.SampleRate = stream.SampleRate()
+		info.Channels = stream.ChannelLayout().Count()
+		info.ObjectType = stream.Config.ObjectType
+	case av.VideoCodecData:
+		info.Width = stream.Width()
+		info.Height = stream.Height()
+	case av.AudioCodecData:
+		info.SampleRate = stream.SampleRate()
+		info.Channels = stream.ChannelLayout().Count()
+	}
+
+	return info
+}
+
+// rateMeter 按秒统计速率, 调用者负责加锁
+type rateMeter struct {
+	windowStart time.Time
+	count       int64
+	rate        int64
+}
+
+func (m *rateMeter) Add(n int) {
+	now := time.Now()
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+
+	if elapsed := now.Sub(m.windowStart); elapsed >= time.Second {
+		m.rate = m.count * int64(time.Second) / int64(elapsed)
+		m.count = 0
+		m.windowStart = now
+	}
+
+	m.count += int64(n)
+}
+
+func (m *rateMeter) Rate() int64 {
+	// 长时间没有数据
+	if time.Since(m.windowStart) > 2*time.Second {
+		return 0
+	}
+	return m.rate
+}
@@ -0,0 +1,253 @@
+package server_interface
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// testPublisher 写入头后的推流
+func testPublisher(t *testing.T, ch *Channel, policy ChannelPolicy) (*ChannelHandle, error) {
+	t.Helper()
+
+	handle, err := ch.Acquire(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	video, audio := testCodecs(t)
+	if err = handle.WriteHeader([]av.CodecData{video, audio}); err != nil {
+		t.Fatal(err)
+	}
+	return handle, nil
+}
+
+// writeFrame 写入一帧视频, 返回写入队列的包数
+func writeFrame(handle *ChannelHandle, key bool) (uint64, error) {
+	before := handle.GetChannel().Info().PacketsIn
+	err := handle.WritePacket(av.Packet{Idx: 0, IsKeyFrame: key, Data: avcc(0x65, 0x88)})
+	return handle.GetChannel().Info().PacketsIn - before, err
+}
+
+func TestChannelConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict ConflictPolicy
+
+		wantErr    error
+		wantBackup bool
+		wantOldErr error // 旧推流再写入
+		wantNew    bool  // 新推流的关键帧写入队列
+	}{
+		{name: "reject", conflict: ConflictReject, wantErr: ErrChannelExist},
+		{name: "default reject", conflict: "", wantErr: ErrChannelExist},
+		{name: "replace", conflict: ConflictReplace, wantOldErr: ErrNotOwner, wantNew: true},
+		{name: "backup", conflict: ConflictBackup, wantBackup: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := ChannelPolicy{Conflict: tt.conflict}
+			ch := NewChannel("/live/test", nil)
+
+			old, err := testPublisher(t, ch, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := writeFrame(old, true); n != 1 || err != nil {
+				t.Fatalf("first publisher wrote %v: %v", n, err)
+			}
+
+			handle, err := testPublisher(t, ch, policy)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !old.IsActive() {
+					t.Fatal("rejected publisher replaced the first one")
+				}
+				return
+			}
+			if handle.IsBackup() != tt.wantBackup {
+				t.Errorf("backup %v, want %v", handle.IsBackup(), tt.wantBackup)
+			}
+
+			n, err := writeFrame(handle, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n == 1; got != tt.wantNew || handle.IsActive() != tt.wantNew {
+				t.Errorf("new publisher wrote %v active %v, want %v", n, handle.IsActive(), tt.wantNew)
+			}
+
+			_, err = writeFrame(old, true)
+			if !errors.Is(err, tt.wantOldErr) {
+				t.Errorf("old publisher err %v, want %v", err, tt.wantOldErr)
+			}
+			if old.IsActive() == tt.wantNew {
+				t.Errorf("old publisher active %v", old.IsActive())
+			}
+		})
+	}
+}
+
+func TestChannelClosed(t *testing.T) {
+	ch := NewChannel("/live/test", nil)
+	handle, err := testPublisher(t, ch, ChannelPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Close()
+	if _, err = ch.Acquire(ChannelPolicy{Conflict: ConflictReplace}); !errors.Is(err, ErrChannelClosed) {
+		t.Fatalf("acquire err %v, want %v", err, ErrChannelClosed)
+	}
+	if _, err = writeFrame(handle, true); !errors.Is(err, ErrChannelClosed) {
+		t.Fatalf("write err %v, want %v", err, ErrChannelClosed)
+	}
+}
+
+func TestChannelGrace(t *testing.T) {
+	const grace = 100 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		grace     time.Duration
+		reconnect bool
+
+		wantClosed bool
+	}{
+		{name: "no grace", wantClosed: true},
+		{name: "grace expired", grace: grace, wantClosed: true},
+		{name: "reconnect", grace: grace, reconnect: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := ChannelPolicy{Grace: tt.grace}
+			closed := make(chan struct{})
+			ch := NewChannel("/live/test", func(*Channel) { close(closed) })
+
+			handle, err := testPublisher(t, ch, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = writeFrame(handle, true)
+			handle.Close()
+
+			if tt.grace > 0 {
+				if !ch.IsPublishing() || !ch.Info().Idle {
+					t.Fatal("channel not waiting for reconnect")
+				}
+			}
+
+			if tt.reconnect {
+				handle, err = testPublisher(t, ch, policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ch.Info().Idle {
+					t.Fatal("channel idle after reconnect")
+				}
+				// 接在上一个推流之后, 从关键帧开始
+				if n, _ := writeFrame(handle, false); n != 0 {
+					t.Fatal("reconnected publisher started without a key frame")
+				}
+				if n, _ := writeFrame(handle, true); n != 1 || !handle.IsActive() {
+					t.Fatal("reconnected publisher not active")
+				}
+			}
+
+			select {
+			case <-closed:
+			case <-time.After(3 * grace):
+			}
+
+			select {
+			case <-ch.Done():
+				if !tt.wantClosed {
+					t.Fatal("channel closed")
+				}
+			default:
+				if tt.wantClosed {
+					t.Fatal("channel not closed")
+				}
+			}
+		})
+	}
+}
+
+func TestChannelFailover(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	policy := ChannelPolicy{Conflict: ConflictBackup, FailoverTimeout: timeout}
+	ch := NewChannel("/live/test", nil)
+
+	primary, err := testPublisher(t, ch, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := testPublisher(t, ch, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.IsBackup() {
+		t.Fatal("second publisher is not a backup")
+	}
+
+	steps := []struct {
+		name   string
+		handle *ChannelHandle
+		key    bool
+		sleep  time.Duration // 写入之前等待
+
+		wantWritten  uint64
+		wantActive   *ChannelHandle
+		wantSwitches int
+	}{
+		{name: "primary", handle: primary, key: true, wantWritten: 1, wantActive: primary},
+		{name: "backup ignored", handle: backup, key: true, wantActive: primary},
+		{name: "primary stalled, backup waits for key frame", handle: backup, sleep: 2 * timeout, wantActive: primary},
+		{name: "backup takes over at key frame", handle: backup, key: true, wantWritten: 1, wantActive: backup, wantSwitches: 1},
+		{name: "backup continues", handle: backup, wantWritten: 1, wantActive: backup, wantSwitches: 1},
+		{name: "primary returns, waits for key frame", handle: primary, wantActive: backup, wantSwitches: 1},
+		{name: "switch back to primary", handle: primary, key: true, wantWritten: 1, wantActive: primary, wantSwitches: 2},
+		{name: "backup ignored again", handle: backup, key: true, wantActive: primary, wantSwitches: 2},
+	}
+
+	for _, step := range steps {
+		time.Sleep(step.sleep)
+
+		n, err := writeFrame(step.handle, step.key)
+		if err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		if n != step.wantWritten {
+			t.Errorf("%v: wrote %v, want %v", step.name, n, step.wantWritten)
+		}
+		if !step.wantActive.IsActive() {
+			t.Errorf("%v: generation %v not active", step.name, step.wantActive.GetGeneration())
+		}
+		if info := ch.Info(); info.Switches != step.wantSwitches || info.Generation != step.wantActive.GetGeneration() {
+			t.Errorf("%v: switches %v generation %v, want %v %v", step.name, info.Switches, info.Generation, step.wantSwitches, step.wantActive.GetGeneration())
+		}
+	}
+
+	// 主推流断开, 备用在关键帧接替, 不需要等待超时
+	primary.Close()
+	if n, _ := writeFrame(backup, false); n != 0 {
+		t.Error("backup took over without a key frame")
+	}
+	if n, _ := writeFrame(backup, true); n != 1 || !backup.IsActive() {
+		t.Error("backup did not take over after the primary closed")
+	}
+
+	backup.Close()
+	select {
+	case <-ch.Done():
+	default:
+		t.Fatal("channel not closed after the last publisher")
+	}
+}
@@ -0,0 +1,86 @@
+package server_interface
+
+import (
+	"errors"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+// ErrSlowConsumer 读者持续落后, 断开
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// LagPolicy 读者落后于最新数据时的处理, 0 不处理
+type LagPolicy struct {
+	DropLag    time.Duration `yaml:"drop_lag"`     // 落后超过这个时间丢弃非参考帧
+	SkipLag    time.Duration `yaml:"skip_lag"`     // 落后超过这个时间跳到最新的关键帧
+	MaxLagTime time.Duration `yaml:"max_lag_time"` // 持续落后(超过drop_lag或skip_lag)这么久断开
+}
+
+// threshold 超过多少算落后
+func (tis LagPolicy) threshold() time.Duration {
+	if tis.DropLag > 0 && (tis.SkipLag <= 0 || tis.DropLag < tis.SkipLag) {
+		return tis.DropLag
+	}
+	return tis.SkipLag
+}
+
+// liveEdge 最新写入队列的位置, 读者据此计算落后多少
+type liveEdge struct {
+	time      time.Duration // 最新的包
+	keyTime   time.Duration // 最新的关键帧
+	hasKey    bool
+	videoIdx  int
+	videoType av.CodecType
+}
+
+// liveEdge 队列中最新的位置
+func (tis *Channel) liveEdge() liveEdge {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return liveEdge{
+		time:      tis.lastTime,
+		keyTime:   tis.lastKeyTime,
+		hasKey:    tis.hasKeyFrame,
+		videoIdx:  tis.videoIdx,
+		videoType: tis.videoType,
+	}
+}
+
+// isDisposable 视频帧没有被其他帧参考, 丢弃后不影响解码. h264 nal_ref_idc为0, h265 *_N类型
+func isDisposable(codecType av.CodecType, data []byte) bool {
+	nalus, _ := h264parser.SplitNALUs(data)
+
+	vcl := 0
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch codecType {
+		case av.H264:
+			typ := nalu[0] & 0x1f
+			if typ < 1 || typ > 5 {
+				continue
+			}
+			vcl++
+			if nalu[0]&0x60 != 0 {
+				return false
+			}
+		case av.H265:
+			typ := (nalu[0] >> 1) & 0x3f
+			if typ > 31 {
+				continue
+			}
+			vcl++
+			if typ > 14 || typ%2 != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return vcl > 0
+}
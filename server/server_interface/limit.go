@@ -0,0 +1,22 @@
+package server_interface
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrLimitExceeded 超过推流/拉流数量限制
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrBandwidthExceeded 超过带宽限制, errors.Is(err, ErrLimitExceeded) 同样成立
+	ErrBandwidthExceeded = fmt.Errorf("bandwidth %w", ErrLimitExceeded)
+)
+
+// RejectStatus OnPlay/OnPublish返回error时http的状态码, 超过限制503, 其他403
+func RejectStatus(err error) int {
+	if errors.Is(err, ErrLimitExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusForbidden
+}
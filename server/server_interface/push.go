@@ -0,0 +1,90 @@
+package server_interface
+
+import (
+	"sync"
+	"time"
+)
+
+// PushInfo 转发到一个目的地的状态
+type PushInfo struct {
+	URL        string    `json:"url"`
+	Connected  bool      `json:"connected"`
+	StartTime  time.Time `json:"start_time"`
+	BytesOut   uint64    `json:"bytes_out"`
+	PacketsOut uint64    `json:"packets_out"`
+	Bitrate    int64     `json:"bitrate"` // bit/s
+	Retries    int       `json:"retries"` // 重连次数
+	LastError  string    `json:"last_error,omitempty"`
+	LastErrAt  time.Time `json:"last_error_at"`
+}
+
+// PushStatus 转发状态, 转发任务更新, channel的Info中显示
+type PushStatus struct {
+	ch  *Channel
+	url string
+
+	mutex      sync.Mutex
+	connected  bool
+	startTime  time.Time
+	bytesOut   uint64
+	packetsOut uint64
+	outMeter   rateMeter
+	retries    int
+	lastError  string
+	lastErrAt  time.Time
+	closeOnce  sync.Once
+}
+
+// SetConnected 连接成功
+func (tis *PushStatus) SetConnected() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.connected = true
+	tis.startTime = time.Now()
+}
+
+// SetError 连接断开或失败, 之后重连
+func (tis *PushStatus) SetError(err error) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.connected = false
+	tis.retries++
+	tis.lastError = err.Error()
+	tis.lastErrAt = time.Now()
+}
+
+// AddPacket 统计发送的数据
+func (tis *PushStatus) AddPacket(n int) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.bytesOut += uint64(n)
+	tis.packetsOut++
+	tis.outMeter.Add(n * 8)
+}
+
+// Close 从channel中移除
+func (tis *PushStatus) Close() {
+	tis.closeOnce.Do(func() {
+		tis.ch.removePush(tis)
+	})
+}
+
+func (tis *PushStatus) Info() PushInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return PushInfo{
+		URL:        tis.url,
+		Connected:  tis.connected,
+		StartTime:  tis.startTime,
+		BytesOut:   tis.bytesOut,
+		PacketsOut: tis.packetsOut,
+		Bitrate:    tis.outMeter.Rate(),
+		Retries:    tis.retries,
+		LastError:  tis.lastError,
+		LastErrAt:  tis.lastErrAt,
+	}
+}
@@ -0,0 +1,378 @@
+package server_interface
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// GopCacheOption 每个channel缓存的数据, 新的读者从缓存中最近的关键帧开始
+type GopCacheOption struct {
+	Gops        int           `yaml:"gops"`         // 缓存的gop数量, 包括正在写入的gop, 0 不按数量限制
+	MaxDuration time.Duration `yaml:"max_duration"` // 缓存的最大时长, 0 不限制
+	MaxBytes    int           `yaml:"max_bytes"`    // 缓存的最大字节数, 0 不限制
+	LowLatency  bool          `yaml:"low_latency"`  // 新的读者等待下一个关键帧, 不发送缓存
+}
+
+// TimeshiftOption 时移缓存, 读者可以从最新数据往前Duration开始. 与gop缓存取较大的
+type TimeshiftOption struct {
+	Duration time.Duration `yaml:"duration"`  // 0 不启用
+	MaxBytes int           `yaml:"max_bytes"` // 0 不限制
+}
+
+// CacheInfo 缓存使用的内存, 包括gop缓存和时移
+type CacheInfo struct {
+	Packets  int   `json:"packets"`
+	Bytes    int   `json:"bytes"`
+	Gops     int   `json:"gops"`
+	Duration int64 `json:"duration"` // 毫秒
+}
+
+// 没有视频时缓存的时长, 没有关键帧可以对齐
+const audioOnlyCache = time.Second
+
+// Queue 一个写入者, 多个读者. 按gop缓存, 超过限制时从最早的gop开始删除
+type Queue struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	option    GopCacheOption
+	timeshift TimeshiftOption
+	streams   []av.CodecData
+	videoIdx  int
+	closed    bool
+
+	packets []av.Packet
+	headSeq int   // packets[0]的序号
+	keys    []int // 缓存中视频关键帧的序号
+	bytes   int
+}
+
+func NewQueue() *Queue {
+	tis := &Queue{
+		videoIdx: -1,
+	}
+	tis.cond = sync.NewCond(&tis.mutex)
+	return tis
+}
+
+// SetOption 修改缓存限制, 下一次写入时生效
+func (tis *Queue) SetOption(option GopCacheOption) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.option = option
+}
+
+// SetTimeshift 修改时移缓存, 下一次写入时生效
+func (tis *Queue) SetTimeshift(option TimeshiftOption) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.timeshift = option
+}
+
+func (tis *Queue) WriteHeader(streams []av.CodecData) error {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.streams = streams
+	tis.videoIdx = -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			tis.videoIdx = i
+			break
+		}
+	}
+	tis.cond.Broadcast()
+
+	return nil
+}
+
+// Close 之后读者的ReadPacket返回io.EOF
+func (tis *Queue) Close() error {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.closed = true
+	tis.cond.Broadcast()
+
+	return nil
+}
+
+func (tis *Queue) WritePacket(pkt av.Packet) error {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.isKeyFrame(pkt) {
+		tis.keys = append(tis.keys, tis.tailSeq())
+	}
+	tis.packets = append(tis.packets, pkt)
+	tis.bytes += len(pkt.Data)
+
+	tis.prune()
+	tis.cond.Broadcast()
+
+	return nil
+}
+
+// isKeyFrame 调用者持有锁
+func (tis *Queue) isKeyFrame(pkt av.Packet) bool {
+	return int(pkt.Idx) == tis.videoIdx && pkt.IsKeyFrame
+}
+
+// tailSeq 下一个写入的包的序号
+func (tis *Queue) tailSeq() int {
+	return tis.headSeq + len(tis.packets)
+}
+
+// prune 调用者持有锁. 只保留完整的gop, 超过限制时删除最早的gop, 只剩一个gop还超过时逐个删除
+func (tis *Queue) prune() {
+	// 第一个关键帧之前的包不能解码
+	if len(tis.keys) > 0 {
+		tis.popTo(tis.keys[0])
+	}
+
+	for len(tis.packets) > 1 && tis.exceeded() {
+		if len(tis.keys) > 1 {
+			tis.popTo(tis.keys[1])
+		} else {
+			tis.popTo(tis.headSeq + 1)
+		}
+	}
+}
+
+// exceeded 调用者持有锁, 同时超过gop缓存和时移的限制
+func (tis *Queue) exceeded() bool {
+	if tis.videoIdx >= 0 && len(tis.keys) == 0 {
+		// 还没有关键帧时缓存的包不能解码
+		return true
+	}
+	return tis.cacheExceeded() && tis.timeshiftExceeded()
+}
+
+// cacheExceeded 调用者持有锁
+func (tis *Queue) cacheExceeded() bool {
+	option := tis.option
+	if tis.videoIdx >= 0 && option.Gops > 0 && len(tis.keys) > option.Gops {
+		return true
+	}
+	if option.MaxBytes > 0 && tis.bytes > option.MaxBytes {
+		return true
+	}
+
+	maxDuration := option.MaxDuration
+	if tis.videoIdx < 0 && (maxDuration <= 0 || maxDuration > audioOnlyCache) {
+		maxDuration = audioOnlyCache
+	}
+	return maxDuration > 0 && tis.duration() > maxDuration
+}
+
+// timeshiftExceeded 调用者持有锁, 不启用时移时总是超过
+func (tis *Queue) timeshiftExceeded() bool {
+	option := tis.timeshift
+	if option.Duration <= 0 {
+		return true
+	}
+	if option.MaxBytes > 0 && tis.bytes > option.MaxBytes {
+		return true
+	}
+	return tis.duration() > option.Duration
+}
+
+// duration 调用者持有锁
+func (tis *Queue) duration() time.Duration {
+	if len(tis.packets) == 0 {
+		return 0
+	}
+	return tis.packets[len(tis.packets)-1].Time - tis.packets[0].Time
+}
+
+// popTo 调用者持有锁, 删除序号seq之前的包
+func (tis *Queue) popTo(seq int) {
+	for tis.headSeq < seq && len(tis.packets) > 0 {
+		tis.bytes -= len(tis.packets[0].Data)
+		tis.packets[0] = av.Packet{}
+		tis.packets = tis.packets[1:]
+		tis.headSeq++
+	}
+	for len(tis.keys) > 0 && tis.keys[0] < tis.headSeq {
+		tis.keys = tis.keys[1:]
+	}
+}
+
+// Info 缓存使用的内存
+func (tis *Queue) Info() CacheInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	return CacheInfo{
+		Packets:  len(tis.packets),
+		Bytes:    tis.bytes,
+		Gops:     len(tis.keys),
+		Duration: tis.duration().Milliseconds(),
+	}
+}
+
+// Cursor 按配置从缓存中最近的关键帧开始, 或者低延迟时等待下一个关键帧
+func (tis *Queue) Cursor() *QueueCursor {
+	tis.mutex.Lock()
+	lowLatency := tis.option.LowLatency
+	tis.mutex.Unlock()
+
+	if lowLatency {
+		return tis.NextKeyFrame()
+	}
+	return tis.LastKeyFrame()
+}
+
+// LastKeyFrame 从缓存中最近的关键帧开始, 没有时等待下一个关键帧
+func (tis *Queue) LastKeyFrame() *QueueCursor {
+	return &QueueCursor{
+		que: tis,
+		init: func() (int, bool) {
+			if len(tis.keys) > 0 {
+				return tis.keys[len(tis.keys)-1], false
+			}
+			return tis.tailSeq(), tis.videoIdx >= 0
+		},
+	}
+}
+
+// NextKeyFrame 从下一个关键帧开始
+func (tis *Queue) NextKeyFrame() *QueueCursor {
+	return &QueueCursor{
+		que: tis,
+		init: func() (int, bool) {
+			return tis.tailSeq(), tis.videoIdx >= 0
+		},
+	}
+}
+
+// Timeshift 从最新数据往前offset之前的关键帧开始, 按实时速度读取. 超过缓存时从最早的关键帧开始
+func (tis *Queue) Timeshift(offset time.Duration) *QueueCursor {
+	return &QueueCursor{
+		que:   tis,
+		paced: true,
+		init: func() (int, bool) {
+			if len(tis.keys) == 0 {
+				return tis.tailSeq(), tis.videoIdx >= 0
+			}
+
+			start := tis.keys[0]
+			if len(tis.packets) > 0 {
+				target := tis.packets[len(tis.packets)-1].Time - offset
+				for _, seq := range tis.keys {
+					if tis.packets[seq-tis.headSeq].Time > target {
+						break
+					}
+					start = seq
+				}
+			}
+			return start, false
+		},
+	}
+}
+
+// Latest 从下一个包开始, 不对齐关键帧
+func (tis *Queue) Latest() *QueueCursor {
+	return &QueueCursor{
+		que: tis,
+		init: func() (int, bool) {
+			return tis.tailSeq(), false
+		},
+	}
+}
+
+// QueueCursor 读者在队列中的位置, 实现了 av.Demuxer
+type QueueCursor struct {
+	que     *Queue
+	init    func() (int, bool) // 调用者持有锁, 返回开始的序号和是否等待关键帧
+	started bool
+	pos     int
+	waitKey bool
+
+	// 按时间戳控制读取速度
+	paced    bool
+	baseTime time.Duration
+	baseWall time.Time
+}
+
+// maxPaceWait 两个包的时间戳相差超过这个时间认为不连续, 重新计时
+const maxPaceWait = time.Second
+
+// Streams 等待写入头
+func (tis *QueueCursor) Streams() ([]av.CodecData, error) {
+	que := tis.que
+	que.mutex.Lock()
+	defer que.mutex.Unlock()
+
+	for que.streams == nil && !que.closed {
+		que.cond.Wait()
+	}
+	if que.streams == nil {
+		return nil, io.EOF
+	}
+	return que.streams, nil
+}
+
+// ReadPacket 落后于缓存时从下一个关键帧继续
+func (tis *QueueCursor) ReadPacket() (av.Packet, error) {
+	que := tis.que
+	que.mutex.Lock()
+	defer que.mutex.Unlock()
+
+	if !tis.started {
+		tis.pos, tis.waitKey = tis.init()
+		tis.started = true
+	}
+
+	for {
+		if tis.pos < que.headSeq {
+			tis.pos = que.headSeq
+			tis.waitKey = que.videoIdx >= 0
+		}
+
+		if tis.pos < que.tailSeq() {
+			pkt := que.packets[tis.pos-que.headSeq]
+			tis.pos++
+
+			if tis.waitKey {
+				if !que.isKeyFrame(pkt) {
+					continue
+				}
+				tis.waitKey = false
+			}
+			if tis.paced {
+				que.mutex.Unlock()
+				tis.pace(pkt.Time)
+				que.mutex.Lock()
+			}
+			return pkt, nil
+		}
+
+		if que.closed {
+			return av.Packet{}, io.EOF
+		}
+		que.cond.Wait()
+	}
+}
+
+// pace 等到包的时间戳对应的时刻
+func (tis *QueueCursor) pace(t time.Duration) {
+	if tis.baseWall.IsZero() {
+		tis.baseTime, tis.baseWall = t, time.Now()
+		return
+	}
+
+	wait := t - tis.baseTime - time.Since(tis.baseWall)
+	if t < tis.baseTime || wait > maxPaceWait {
+		tis.baseTime, tis.baseWall = t, time.Now()
+		return
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,158 @@
+package server_interface
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+const testFrame = 40 * time.Millisecond
+
+func testCodecs(t *testing.T) (av.CodecData, av.CodecData) {
+	t.Helper()
+
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0x20, 0xf1, 0x83, 0x19, 0x60}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		SampleRate:    44100,
+		ChannelLayout: av.CH_STEREO,
+		ObjectType:    aacparser.AOT_AAC_LC,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, audio
+}
+
+// writeVideo 写入lead个非关键帧, 然后gops个gop, 每个gop 25帧(1s), 每帧size字节
+func writeVideo(q *Queue, lead int, gops int, size int) {
+	var n int
+	for i := 0; i < lead; i++ {
+		_ = q.WritePacket(av.Packet{Idx: 0, Time: time.Duration(n) * testFrame, Data: make([]byte, size)})
+		n++
+	}
+	for i := 0; i < gops*25; i++ {
+		_ = q.WritePacket(av.Packet{Idx: 0, IsKeyFrame: i%25 == 0, Time: time.Duration(n) * testFrame, Data: make([]byte, size)})
+		n++
+	}
+}
+
+func TestQueuePrune(t *testing.T) {
+	video, audio := testCodecs(t)
+
+	tests := []struct {
+		name      string
+		option    GopCacheOption
+		timeshift TimeshiftOption
+		lead      int
+		gops      int
+		size      int
+
+		wantPackets int
+		wantGops    int
+		wantFirst   time.Duration // 缓存中第一个包的时间戳
+	}{
+		{name: "unlimited", gops: 3, size: 100, wantPackets: 75, wantGops: 3},
+		{name: "gops", option: GopCacheOption{Gops: 2}, gops: 5, size: 100, wantPackets: 50, wantGops: 2, wantFirst: 3 * time.Second},
+		{name: "max duration", option: GopCacheOption{MaxDuration: 1500 * time.Millisecond}, gops: 5, size: 100, wantPackets: 25, wantGops: 1, wantFirst: 4 * time.Second},
+		{name: "max bytes", option: GopCacheOption{MaxBytes: 6000}, gops: 5, size: 100, wantPackets: 50, wantGops: 2, wantFirst: 3 * time.Second},
+		{name: "gop larger than max bytes", option: GopCacheOption{MaxBytes: 1000}, gops: 2, size: 100, wantPackets: 1, wantGops: 0, wantFirst: 49 * testFrame},
+		{name: "before first key frame", lead: 10, gops: 1, size: 100, wantPackets: 25, wantGops: 1, wantFirst: 10 * testFrame},
+		{name: "timeshift keeps more", option: GopCacheOption{Gops: 1}, timeshift: TimeshiftOption{Duration: 3 * time.Second}, gops: 5, size: 100, wantPackets: 75, wantGops: 3, wantFirst: 2 * time.Second},
+		{name: "timeshift max bytes", option: GopCacheOption{Gops: 1}, timeshift: TimeshiftOption{Duration: time.Minute, MaxBytes: 5000}, gops: 5, size: 100, wantPackets: 50, wantGops: 2, wantFirst: 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue()
+			q.SetOption(tt.option)
+			q.SetTimeshift(tt.timeshift)
+			_ = q.WriteHeader([]av.CodecData{video, audio})
+			writeVideo(q, tt.lead, tt.gops, tt.size)
+
+			info := q.Info()
+			if info.Packets != tt.wantPackets || info.Gops != tt.wantGops {
+				t.Fatalf("got %v packets %v gops, want %v packets %v gops", info.Packets, info.Gops, tt.wantPackets, tt.wantGops)
+			}
+			if info.Bytes != tt.wantPackets*tt.size {
+				t.Fatalf("got %v bytes, want %v", info.Bytes, tt.wantPackets*tt.size)
+			}
+			if first := q.packets[0].Time; first != tt.wantFirst {
+				t.Fatalf("first packet %v, want %v", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+// TestQueueAudioOnly 没有视频时最多缓存audioOnlyCache
+func TestQueueAudioOnly(t *testing.T) {
+	_, audio := testCodecs(t)
+
+	for _, maxDuration := range []time.Duration{0, 500 * time.Millisecond, 5 * time.Second} {
+		q := NewQueue()
+		q.SetOption(GopCacheOption{MaxDuration: maxDuration})
+		_ = q.WriteHeader([]av.CodecData{audio})
+
+		frame := time.Second * 1024 / 44100
+		for i := 0; i < 200; i++ {
+			_ = q.WritePacket(av.Packet{Idx: 0, Time: time.Duration(i) * frame, Data: []byte{0x21}})
+		}
+
+		want := audioOnlyCache
+		if maxDuration > 0 && maxDuration < want {
+			want = maxDuration
+		}
+		if d := q.duration(); d > want || d < want-frame {
+			t.Fatalf("max_duration %v: cached %v, want %v", maxDuration, d, want)
+		}
+	}
+}
+
+// TestQueueCursor 读者从最近的关键帧开始, 低延迟时等待下一个关键帧
+func TestQueueCursor(t *testing.T) {
+	video, audio := testCodecs(t)
+
+	tests := []struct {
+		name       string
+		lowLatency bool
+		want       time.Duration
+	}{
+		{name: "last key frame", want: 50 * testFrame},
+		{name: "low latency", lowLatency: true, want: 76 * testFrame},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue()
+			q.SetOption(GopCacheOption{Gops: 2, LowLatency: tt.lowLatency})
+			_ = q.WriteHeader([]av.CodecData{video, audio})
+			writeVideo(q, 0, 3, 10)
+
+			// 先确定开始的位置, 再写入下一个gop. 低延迟的读者跳过之前的音频和非关键帧
+			cursor := q.Cursor()
+			q.mutex.Lock()
+			cursor.pos, cursor.waitKey = cursor.init()
+			cursor.started = true
+			q.mutex.Unlock()
+
+			_ = q.WritePacket(av.Packet{Idx: 1, Time: 75 * testFrame, Data: []byte{0x21}})
+			_ = q.WritePacket(av.Packet{Idx: 0, Time: 75 * testFrame, Data: []byte{0x41}})
+			_ = q.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: 76 * testFrame, Data: []byte{0x65}})
+
+			pkt, err := cursor.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pkt.IsKeyFrame || pkt.Time != tt.want {
+				t.Fatalf("first packet key %v at %v, want key at %v", pkt.IsKeyFrame, pkt.Time, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package server_interface
+
+import "time"
+
+// 录制格式
+const (
+	RecordFlv = "flv"
+	RecordMp4 = "mp4" // fragmented mp4, 每个gop一个moof/mdat, 异常退出时已写入的部分可以播放
+)
+
+// RecordRule 录制配置, 为空的项使用默认配置
+// File中可以使用 {path} 路径(不含开头的/), {date} 2006-01-02, {time} 150405, {seq} 分段序号(从1开始)
+type RecordRule struct {
+	File            string        `yaml:"file" json:"file"`
+	SegmentDuration time.Duration `yaml:"segment_duration" json:"segment_duration"` // 按时长分段, 在关键帧切分
+	SegmentSize     int64         `yaml:"segment_size" json:"segment_size"`         // 按大小分段, 字节
+	Format          string        `yaml:"format" json:"format"`                     // flv, mp4. 为空时按文件扩展名, 默认flv
+	Faststart       bool          `yaml:"faststart" json:"faststart"`               // mp4每个文件写完后改写为moov在前的普通mp4
+}
+
+// RecordInfo 正在录制的状态
+type RecordInfo struct {
+	ConnPath  string    `json:"conn_path"`
+	File      string    `json:"file"`     // 正在写入的文件
+	Segments  int       `json:"segments"` // 已经开始的分段数量, 包括正在写入的
+	Bytes     int64     `json:"bytes"`    // 所有分段的字节数
+	StartTime time.Time `json:"start_time"`
+	Manual    bool      `json:"manual"` // 通过API开始, 推流离开后不再自动开始
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// DeletedRecord 按保留策略删除的录制文件
+type DeletedRecord struct {
+	File     string    `json:"file"`
+	ConnPath string    `json:"conn_path,omitempty"` // 文件名模板中没有{path}时为空
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Reason   string    `json:"reason"` // max_age, path max_size, max_size, min_free
+	Time     time.Time `json:"time"`
+}
+
+// RetentionInfo 上一次清理的结果
+type RetentionInfo struct {
+	LastRun time.Time       `json:"last_run"`
+	Files   int             `json:"files"` // 清理后剩余的录制文件
+	Bytes   int64           `json:"bytes"`
+	Deleted []DeletedRecord `json:"deleted"` // 最近删除的文件
+}
@@ -0,0 +1,15 @@
+package server_interface
+
+// PullSource 拉流转发的上游
+// Path中的{name}匹配一段路径, 替换URL中的{name}, 例如 /cam/{id} -> rtsp://10.0.0.{id}/stream
+type PullSource struct {
+	Path string `yaml:"path" json:"path"`
+	URL  string `yaml:"url" json:"url"` // rtsp://, rtmp://, http(s)://(flv)
+}
+
+// PushTarget 推流转发的目的地, 有推流时转发到URLs
+// Path中的{name}匹配一段路径, 替换URL中的{name}, 例如 /live/{name} -> rtmp://a.com/app/{name}
+type PushTarget struct {
+	Path string   `yaml:"path" json:"path"`
+	URLs []string `yaml:"urls" json:"urls"` // rtmp://, rtmps://, rtsp://
+}
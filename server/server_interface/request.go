@@ -0,0 +1,128 @@
+package server_interface
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamRequest 推流/拉流请求, 用于回调和鉴权
+type StreamRequest struct {
+	Protocol   string
+	ConnPath   string
+	RemoteAddr string
+	Query      url.Values
+
+	// 客户端凭证
+	User     string // basic 用户名
+	Password string // basic 密码
+	Token    string // bearer token
+
+	digest     func(password string) bool // rtsp digest 校验
+	authorized bool                       // AuthPlay已通过, OnPlay不再鉴权
+}
+
+func NewStreamRequest(protocol string, connPath string, remoteAddr string, query url.Values) *StreamRequest {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	return &StreamRequest{
+		Protocol:   protocol,
+		ConnPath:   connPath,
+		RemoteAddr: remoteAddr,
+		Query:      query,
+	}
+}
+
+// NewHttpStreamRequest 从http请求创建, 凭证来自query和Authorization头
+func NewHttpStreamRequest(protocol string, connPath string, r *http.Request) *StreamRequest {
+	req := NewStreamRequest(protocol, connPath, r.RemoteAddr, r.URL.Query())
+
+	if user, password, ok := r.BasicAuth(); ok {
+		req.User = user
+		req.Password = password
+	}
+
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		req.Token = strings.TrimSpace(auth[7:])
+	}
+
+	return req
+}
+
+// SetDigest 设置digest校验函数, 只有知道明文密码才能校验
+func (tis *StreamRequest) SetDigest(digest func(password string) bool) {
+	tis.digest = digest
+}
+
+// SetAuthorized 鉴权通过
+func (tis *StreamRequest) SetAuthorized() {
+	tis.authorized = true
+}
+
+// IsAuthorized 是否已经鉴权通过
+func (tis *StreamRequest) IsAuthorized() bool {
+	return tis.authorized
+}
+
+// CheckPassword 客户端提供的密钥是否与password一致
+// 依次检查 query key, basic密码, bearer token, digest
+func (tis *StreamRequest) CheckPassword(password string) bool {
+	if len(password) == 0 {
+		return false
+	}
+
+	for _, key := range []string{tis.Query.Get("key"), tis.Password, tis.Token} {
+		if len(key) > 0 && subtle.ConstantTimeCompare([]byte(key), []byte(password)) == 1 {
+			return true
+		}
+	}
+
+	if tis.digest != nil {
+		return tis.digest(password)
+	}
+
+	return false
+}
+
+// GetTimeshift query中的timeshift, 从最新数据往前的时间, 如 -120s, -2m, -120(秒). 没有时返回0
+func (tis *StreamRequest) GetTimeshift() (time.Duration, error) {
+	return ParseTimeshift(tis.Query.Get("timeshift"))
+}
+
+// ParseTimeshift 解析时移, 正负号都表示往前
+func ParseTimeshift(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	offset, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timeshift %v", s)
+		}
+		offset = time.Duration(seconds * float64(time.Second))
+	}
+
+	if offset < 0 {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// GetToken 客户端提供的token: bearer token, query token, basic密码
+func (tis *StreamRequest) GetToken() string {
+	if len(tis.Token) > 0 {
+		return tis.Token
+	}
+	if token := tis.Query.Get("token"); len(token) > 0 {
+		return token
+	}
+	return tis.Password
+}
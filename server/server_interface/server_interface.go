@@ -1,15 +1,56 @@
 package server_interface
 
-import (
-	"github.com/deepch/vdk/av/pubsub"
-)
-
-type Channel struct {
-	Que *pubsub.Queue
-}
-
 type ServerInterface interface {
 	GetChannel(connPath string) (*Channel, bool)
-	CreateChannel(connPath string) (*Channel, bool)
-	RemoteChannel(connPath string)
+	// 只查找已有的channel, 不拉流, 不启动垫片
+	LookupChannel(connPath string) (*Channel, bool)
+	// 推流获取channel所有权, 结束时调用ChannelHandle.Close
+	CreateChannel(connPath string) (*ChannelHandle, error)
+	GetChannels() []*Channel
+
+	AddSession(session *Session)
+	RemoveSession(id uint64)
+	GetSession(id uint64) (*Session, bool)
+	GetSessions() []*Session
+
+	// 推流/拉流开始时调用, 返回error时拒绝. 拉流找到channel之后再调用OnPlay, 成功后必须调用OnStop
+	OnPublish(req *StreamRequest) error
+	OnPlay(req *StreamRequest) error
+	// 拉流只鉴权, 不计数不回调. 在查找channel之前调用, 避免未授权的请求触发拉流转发和垫片
+	AuthPlay(req *StreamRequest) error
+	// 推流/拉流结束时调用
+	OnUnpublish(req *StreamRequest)
+	OnStop(req *StreamRequest)
+	// 录制的一个文件写完
+	OnRecordDone(req *StreamRequest, file string)
+
+	// 拉流落后时的处理
+	GetLagPolicy() LagPolicy
+
+	// 拉流转发, 读者请求不存在的channel时从上游拉流
+	GetPullSources() []PullSource
+	AddPullSource(source PullSource) error
+	RemovePullSource(path string) bool
+
+	// 推流转发, 有推流时转发到其他服务器
+	GetPushTargets() []PushTarget
+	AddPushTarget(target PushTarget) error
+	RemovePushTarget(path string) bool
+
+	// udp ts 输入输出
+	GetUdpInputs() []UdpInput
+	AddUdpInput(input UdpInput) error
+	RemoveUdpInput(connPath string) bool
+	GetUdpOutputs() []UdpOutput
+	AddUdpOutput(output UdpOutput) error
+	RemoveUdpOutput(rawURL string) bool
+
+	// 录制, 推流时按配置自动开始或通过API开始
+	StartRecord(connPath string, rule RecordRule) (RecordInfo, error)
+	StopRecord(connPath string) (RecordInfo, bool)
+	GetRecords() []RecordInfo
+
+	// 录制文件保留策略
+	GetRetention() RetentionInfo
+	RunRetention() []DeletedRecord
 }
@@ -0,0 +1,92 @@
+package server_interface
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SessionType string
+
+const (
+	SessionPublisher SessionType = "publisher" // 推流
+	SessionPlayer    SessionType = "player"    // 拉流
+)
+
+var sessionId uint64 = 0
+
+// Session 各协议的连接会话, 用于统一查询和踢出
+type Session struct {
+	id         uint64
+	typ        SessionType
+	protocol   string
+	connPath   string
+	remoteAddr string
+	startTime  time.Time
+
+	closeFunc func()
+	closeOnce sync.Once
+}
+
+// SessionInfo 会话信息
+type SessionInfo struct {
+	ID         uint64      `json:"id"`
+	Type       SessionType `json:"type"`
+	Protocol   string      `json:"protocol"`
+	ConnPath   string      `json:"conn_path"`
+	RemoteAddr string      `json:"remote_addr"`
+	StartTime  time.Time   `json:"start_time"`
+}
+
+// NewSession closeFunc 用于断开连接
+func NewSession(typ SessionType, protocol string, connPath string, remoteAddr string, closeFunc func()) *Session {
+	return &Session{
+		id:         atomic.AddUint64(&sessionId, 1),
+		typ:        typ,
+		protocol:   protocol,
+		connPath:   connPath,
+		remoteAddr: remoteAddr,
+		startTime:  time.Now(),
+		closeFunc:  closeFunc,
+	}
+}
+
+func (tis *Session) GetID() uint64 {
+	return tis.id
+}
+
+func (tis *Session) GetType() SessionType {
+	return tis.typ
+}
+
+func (tis *Session) GetConnPath() string {
+	return tis.connPath
+}
+
+func (tis *Session) GetProtocol() string {
+	return tis.protocol
+}
+
+func (tis *Session) GetRemoteAddr() string {
+	return tis.remoteAddr
+}
+
+// Close 断开连接
+func (tis *Session) Close() {
+	tis.closeOnce.Do(func() {
+		if tis.closeFunc != nil {
+			tis.closeFunc()
+		}
+	})
+}
+
+func (tis *Session) Info() SessionInfo {
+	return SessionInfo{
+		ID:         tis.id,
+		Type:       tis.typ,
+		Protocol:   tis.protocol,
+		ConnPath:   tis.connPath,
+		RemoteAddr: tis.remoteAddr,
+		StartTime:  tis.startTime,
+	}
+}
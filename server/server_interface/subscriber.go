@@ -0,0 +1,273 @@
+package server_interface
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+var subscriberId uint64 = 0
+
+// Subscriber 一个读者, 实现了 av.Demuxer
+type Subscriber struct {
+	id         uint64
+	ch         *Channel
+	protocol   string
+	remoteAddr string
+	startTime  time.Time
+	cursor     *QueueCursor
+
+	mutex      sync.Mutex
+	bytesOut   uint64
+	packetsOut uint64
+	outMeter   rateMeter
+	closeOnce  sync.Once
+	closed     int32
+
+	// 落后处理
+	policy      LagPolicy
+	disconnect  func()        // 写入卡住超过MaxLagTime时断开连接
+	stallTimer  *time.Timer   // 从ReadPacket返回到下一次调用之间计时, 即写入一个包的时间
+	lastTime    time.Duration // 最近返回的包的时间戳
+	behindSince time.Time     // 开始落后的时间
+	gopTime     time.Duration // 正在读取的gop的关键帧
+	skipping    bool          // 跳到最新关键帧后, 丢弃关键帧之前的包
+	resync      bool          // 游标重新定位, 下一个包时记录catchUpTime
+	catchUpTime time.Duration // 定位时队列中已有的包一次性发送, 不算落后
+	dropped     uint64
+	skips       uint64
+
+	// 时移
+	seek      *time.Duration // 等待ReadPacket切换的位置, 0 回到最新
+	timeshift bool
+	delay     time.Duration // 时移时故意落后于最新数据的时间
+}
+
+func newSubscriber(ch *Channel, protocol string, remoteAddr string) *Subscriber {
+	return &Subscriber{
+		id:         atomic.AddUint64(&subscriberId, 1),
+		ch:         ch,
+		protocol:   protocol,
+		remoteAddr: remoteAddr,
+		startTime:  time.Now(),
+		cursor:     ch.Que.Cursor(),
+		resync:     true,
+	}
+}
+
+func (tis *Subscriber) GetID() uint64 {
+	return tis.id
+}
+
+func (tis *Subscriber) Streams() ([]av.CodecData, error) {
+	return tis.cursor.Streams()
+}
+
+// Seek 从最新数据往前offset开始按实时速度读取, offset为0时回到最新. 下一次ReadPacket时生效
+func (tis *Subscriber) Seek(offset time.Duration) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.seek = &offset
+}
+
+// applySeek 调用者持有锁
+func (tis *Subscriber) applySeek() {
+	if tis.seek == nil {
+		return
+	}
+
+	offset := *tis.seek
+	tis.seek = nil
+	if offset > 0 {
+		tis.cursor = tis.ch.Que.Timeshift(offset)
+	} else {
+		tis.cursor = tis.ch.Que.Cursor()
+	}
+	tis.timeshift = offset > 0
+	tis.delay = 0
+	tis.skipping = false
+	tis.resync = true
+	tis.behindSince = time.Time{}
+}
+
+// SetLagPolicy 设置落后时的处理, 在ReadPacket之前调用. disconnect用于断开写入卡住的连接, 可以为nil
+func (tis *Subscriber) SetLagPolicy(policy LagPolicy, disconnect func()) {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	tis.policy = policy
+	tis.disconnect = disconnect
+}
+
+func (tis *Subscriber) ReadPacket() (av.Packet, error) {
+	tis.stopStall()
+
+	for {
+		tis.mutex.Lock()
+		tis.applySeek()
+		cursor := tis.cursor
+		tis.mutex.Unlock()
+
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return pkt, err
+		}
+
+		// 已经被关闭
+		if atomic.LoadInt32(&tis.closed) == 1 {
+			return av.Packet{}, io.EOF
+		}
+
+		edge := tis.ch.liveEdge()
+
+		tis.mutex.Lock()
+		drop, err := tis.checkLag(pkt, edge)
+		if err == nil && !drop {
+			tis.bytesOut += uint64(len(pkt.Data))
+			tis.packetsOut++
+			tis.outMeter.Add(len(pkt.Data) * 8)
+			tis.lastTime = pkt.Time
+			tis.startStall()
+		}
+		tis.mutex.Unlock()
+
+		if err != nil {
+			return av.Packet{}, err
+		}
+		if !drop {
+			return pkt, nil
+		}
+	}
+}
+
+// startStall 调用者持有锁, 开始计时写入
+func (tis *Subscriber) startStall() {
+	if tis.policy.MaxLagTime <= 0 || tis.disconnect == nil {
+		return
+	}
+	if tis.stallTimer == nil {
+		tis.stallTimer = time.AfterFunc(tis.policy.MaxLagTime, tis.onStall)
+		return
+	}
+	tis.stallTimer.Reset(tis.policy.MaxLagTime)
+}
+
+func (tis *Subscriber) stopStall() {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	if tis.stallTimer != nil {
+		tis.stallTimer.Stop()
+	}
+}
+
+// onStall 写入一个包超过MaxLagTime, 读者不再接收数据
+func (tis *Subscriber) onStall() {
+	tis.mutex.Lock()
+	disconnect := tis.disconnect
+	tis.mutex.Unlock()
+
+	log.Printf("subscriber stalled: %v %v %v", tis.ch.GetConnPath(), tis.protocol, tis.remoteAddr)
+	disconnect()
+}
+
+// checkLag 调用者持有锁. 落后时丢弃非参考帧或跳到最新的关键帧, 持续落后返回ErrSlowConsumer
+// 时移的读者按第一个包计算故意落后的时间, 超过的部分才算落后.
+// 游标定位时队列中已有的包(gop缓存)不算落后, 否则刚开始播放就会丢帧或跳过
+func (tis *Subscriber) checkLag(pkt av.Packet, edge liveEdge) (bool, error) {
+	if tis.timeshift && tis.delay == 0 {
+		tis.delay = edge.time - pkt.Time
+	}
+	if tis.resync {
+		tis.resync = false
+		tis.catchUpTime = edge.time
+	}
+
+	lag := edge.time - pkt.Time - tis.delay
+	if !tis.timeshift && pkt.Time <= tis.catchUpTime {
+		lag = 0
+	}
+
+	isVideo := int(pkt.Idx) == edge.videoIdx
+	if isVideo && pkt.IsKeyFrame {
+		tis.gopTime = pkt.Time
+		tis.skipping = false
+	}
+	if tis.skipping {
+		return true, nil
+	}
+
+	policy := tis.policy
+	if threshold := policy.threshold(); threshold > 0 && lag > threshold {
+		if tis.behindSince.IsZero() {
+			tis.behindSince = time.Now()
+		} else if policy.MaxLagTime > 0 && time.Since(tis.behindSince) > policy.MaxLagTime {
+			return false, ErrSlowConsumer
+		}
+	} else {
+		tis.behindSince = time.Time{}
+	}
+
+	// 队列中有更新的关键帧时才跳, 否则会一直跳回当前gop
+	if policy.SkipLag > 0 && lag > policy.SkipLag && edge.hasKey && edge.keyTime > tis.gopTime {
+		if tis.timeshift {
+			tis.cursor = tis.ch.Que.Timeshift(tis.delay)
+		} else {
+			tis.cursor = tis.ch.Que.LastKeyFrame()
+		}
+		tis.skipping = true
+		tis.resync = true
+		tis.skips++
+		return true, nil
+	}
+
+	if policy.DropLag > 0 && lag > policy.DropLag && isVideo && !pkt.IsKeyFrame && isDisposable(edge.videoType, pkt.Data) {
+		tis.dropped++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Close 从channel中移除, 之后的ReadPacket返回io.EOF
+func (tis *Subscriber) Close() {
+	tis.closeOnce.Do(func() {
+		atomic.StoreInt32(&tis.closed, 1)
+		tis.ch.unsubscribe(tis)
+		tis.stopStall()
+	})
+}
+
+func (tis *Subscriber) Info() SubscriberInfo {
+	return tis.info(tis.ch.liveEdge().time)
+}
+
+// info edgeTime是channel最新的时间戳, 写入卡住时落后也会增加
+func (tis *Subscriber) info(edgeTime time.Duration) SubscriberInfo {
+	tis.mutex.Lock()
+	defer tis.mutex.Unlock()
+
+	var lag time.Duration
+	if tis.packetsOut > 0 && edgeTime > tis.lastTime+tis.delay {
+		lag = edgeTime - tis.lastTime - tis.delay
+	}
+
+	return SubscriberInfo{
+		ID:         tis.id,
+		Protocol:   tis.protocol,
+		RemoteAddr: tis.remoteAddr,
+		StartTime:  tis.startTime,
+		BytesOut:   tis.bytesOut,
+		PacketsOut: tis.packetsOut,
+		Bitrate:    tis.outMeter.Rate(),
+		Lag:        lag.Milliseconds(),
+		Dropped:    tis.dropped,
+		Skips:      tis.skips,
+		Timeshift:  tis.delay.Milliseconds(),
+	}
+}
@@ -0,0 +1,103 @@
+package server_interface
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// avcc 4字节长度前缀的nalu
+func avcc(nalu ...byte) []byte {
+	return append([]byte{0, 0, 0, byte(len(nalu))}, nalu...)
+}
+
+func TestSubscriberCheckLag(t *testing.T) {
+	var (
+		policy     = LagPolicy{DropLag: time.Second, SkipLag: 2 * time.Second, MaxLagTime: 3 * time.Second}
+		edge       = liveEdge{time: 10 * time.Second, keyTime: 9 * time.Second, hasKey: true, videoIdx: 0, videoType: av.H264}
+		disposable = av.Packet{Idx: 0, Data: avcc(0x01, 0x9a)} // nal_ref_idc 0
+		reference  = av.Packet{Idx: 0, Data: avcc(0x41, 0x9a)}
+		audio      = av.Packet{Idx: 1, Data: []byte{0x21}}
+	)
+	at := func(pkt av.Packet, t time.Duration) av.Packet {
+		pkt.Time = t
+		return pkt
+	}
+
+	tests := []struct {
+		name      string
+		resync    bool          // 刚订阅, edge之前的包都在缓存中
+		timeshift bool          // 时移读者
+		gopTime   time.Duration // 正在读取的gop
+		behind    time.Duration // 已经落后了多久, 0 没有落后
+		pkt       av.Packet
+
+		wantDrop    bool
+		wantErr     error
+		wantDropped uint64
+		wantSkips   uint64
+		wantBehind  bool
+	}{
+		{name: "caught up", pkt: at(disposable, 9900*time.Millisecond)},
+		{name: "drop disposable", pkt: at(disposable, 8500*time.Millisecond), wantDrop: true, wantDropped: 1, wantBehind: true},
+		{name: "keep reference", pkt: at(reference, 8500*time.Millisecond), wantBehind: true},
+		{name: "keep audio", pkt: at(audio, 8500*time.Millisecond), wantBehind: true},
+		{name: "skip to newer key frame", gopTime: 7 * time.Second, pkt: at(reference, 7500*time.Millisecond), wantDrop: true, wantSkips: 1, wantBehind: true},
+		{name: "no newer key frame", gopTime: 9 * time.Second, pkt: at(reference, 7500*time.Millisecond), wantBehind: true},
+		{name: "gop cache at subscribe", resync: true, gopTime: 7 * time.Second, pkt: at(disposable, 7500*time.Millisecond)},
+		{name: "behind too long", behind: 4 * time.Second, pkt: at(reference, 8500*time.Millisecond), wantErr: ErrSlowConsumer, wantBehind: true},
+		{name: "behind within max lag time", behind: 2 * time.Second, pkt: at(reference, 8500*time.Millisecond), wantBehind: true},
+		{name: "catch up resets behind", behind: 4 * time.Second, pkt: at(reference, 9500*time.Millisecond)},
+		{name: "timeshift delay", timeshift: true, pkt: at(disposable, 5*time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := newSubscriber(NewChannel("/live/test", nil), "test", "")
+			sub.policy = policy
+			sub.resync = tt.resync
+			sub.timeshift = tt.timeshift
+			sub.gopTime = tt.gopTime
+			if tt.behind > 0 {
+				sub.behindSince = time.Now().Add(-tt.behind)
+			}
+
+			drop, err := sub.checkLag(tt.pkt, edge)
+			if drop != tt.wantDrop {
+				t.Errorf("drop %v, want %v", drop, tt.wantDrop)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err %v, want %v", err, tt.wantErr)
+			}
+			if sub.dropped != tt.wantDropped {
+				t.Errorf("dropped %v, want %v", sub.dropped, tt.wantDropped)
+			}
+			if sub.skips != tt.wantSkips {
+				t.Errorf("skips %v, want %v", sub.skips, tt.wantSkips)
+			}
+			if behind := !sub.behindSince.IsZero(); behind != tt.wantBehind {
+				t.Errorf("behind %v, want %v", behind, tt.wantBehind)
+			}
+		})
+	}
+}
+
+// TestSubscriberCatchUp gop缓存中的包不丢弃, 之后写入的包按落后处理
+func TestSubscriberCatchUp(t *testing.T) {
+	sub := newSubscriber(NewChannel("/live/test", nil), "test", "")
+	sub.policy = LagPolicy{DropLag: time.Second}
+
+	edge := liveEdge{time: 10 * time.Second, keyTime: 7 * time.Second, hasKey: true, videoIdx: 0, videoType: av.H264}
+	for _, pktTime := range []time.Duration{7 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if drop, _ := sub.checkLag(av.Packet{Idx: 0, Time: pktTime, Data: avcc(0x01, 0x9a)}, edge); drop {
+			t.Fatalf("cached packet %v dropped", pktTime)
+		}
+	}
+
+	edge.time = 13 * time.Second
+	if drop, _ := sub.checkLag(av.Packet{Idx: 0, Time: 11 * time.Second, Data: avcc(0x01, 0x9a)}, edge); !drop {
+		t.Fatalf("packet written after subscribe is not dropped")
+	}
+}
@@ -0,0 +1,13 @@
+package server_interface
+
+// UdpInput udp ts 输入, 发布到ConnPath
+type UdpInput struct {
+	URL      string `yaml:"url" json:"url"`             // udp://239.0.0.1:1234
+	ConnPath string `yaml:"conn_path" json:"conn_path"` // /live
+}
+
+// UdpOutput 将ConnPath以ts推送到udp
+type UdpOutput struct {
+	ConnPath string `yaml:"conn_path" json:"conn_path"` // /live
+	URL      string `yaml:"url" json:"url"`             // udp://239.0.0.2:1234
+}
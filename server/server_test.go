@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+// TestServerLimitRelease 回调拒绝时释放限制的名额
+func TestServerLimitRelease(t *testing.T) {
+	var reject int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&reject) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	option := DefaultOption()
+	option.Limits.MaxPublishers = 1
+	option.Limits.MaxViewers = 1
+	option.WebHook.OnPublish = hook.URL
+	option.WebHook.OnPlay = hook.URL
+	s := NewServer(option)
+
+	tests := []struct {
+		name  string
+		start func(req *server_interface.StreamRequest) error
+		stop  func(req *server_interface.StreamRequest)
+	}{
+		{name: "publish", start: s.OnPublish, stop: s.OnUnpublish},
+		{name: "play", start: s.OnPlay, stop: s.OnStop},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := func() *server_interface.StreamRequest {
+				return server_interface.NewStreamRequest("rtmp", "/live/a", "127.0.0.1:1000", nil)
+			}
+
+			atomic.StoreInt32(&reject, 1)
+			if err := tt.start(request()); err == nil {
+				t.Fatal("web hook did not reject")
+			}
+
+			atomic.StoreInt32(&reject, 0)
+			req := request()
+			if err := tt.start(req); err != nil {
+				t.Fatalf("rejected request not released: %v", err)
+			}
+			if err := tt.start(request()); !errors.Is(err, server_interface.ErrLimitExceeded) {
+				t.Fatalf("err %v, want %v", err, server_interface.ErrLimitExceeded)
+			}
+
+			tt.stop(req)
+			if err := tt.start(request()); err != nil {
+				t.Fatalf("stopped request not released: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package slate
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/general252/live/server/server_interface"
+)
+
+// Option 没有推流时循环播放文件, 读者不断开
+type Option struct {
+	Paths       map[string]string `yaml:"paths"`        // connPath或通配符 -> flv/mp4文件, 编码参数最好与推流相同
+	IdleTimeout time.Duration     `yaml:"idle_timeout"` // 没有推流和读者超过这个时间停止
+}
+
+// 循环时两次之间的间隔
+const loopGap = 40 * time.Millisecond
+
+// Slate 循环读取文件写入channel, 优先级最低, 有推流时数据被丢弃
+type Slate struct {
+	handle      *server_interface.ChannelHandle
+	filename    string
+	idleTimeout time.Duration
+
+	file    *os.File
+	demuxer av.Demuxer
+}
+
+// NewSlate 注册到channel, 打开文件并写入头. channel已有垫片时返回ErrChannelExist
+func NewSlate(ch *server_interface.Channel, filename string, idleTimeout time.Duration) (*Slate, error) {
+	handle, err := ch.AcquireSlate()
+	if err != nil {
+		return nil, err
+	}
+
+	tis := &Slate{
+		handle:      handle,
+		filename:    filename,
+		idleTimeout: idleTimeout,
+	}
+
+	if err = tis.open(); err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	streams, err := tis.demuxer.Streams()
+	if err != nil {
+		tis.close()
+		handle.Close()
+		return nil, err
+	}
+
+	handle.SetPublisher("file", filename)
+	_ = handle.WriteHeader(streams)
+
+	return tis, nil
+}
+
+// open 根据扩展名选择flv或mp4
+func (tis *Slate) open() error {
+	file, err := os.Open(tis.filename)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(tis.filename)) {
+	case ".flv":
+		tis.demuxer = flv.NewDemuxer(bufio.NewReader(file))
+	case ".mp4":
+		tis.demuxer = mp4.NewDemuxer(file)
+	default:
+		_ = file.Close()
+		return fmt.Errorf("slate: unsupported file %v", tis.filename)
+	}
+
+	tis.file = file
+	return nil
+}
+
+func (tis *Slate) close() {
+	if tis.file != nil {
+		_ = tis.file.Close()
+		tis.file = nil
+	}
+}
+
+// Run 按时间循环写入, channel关闭或空闲超时后返回
+func (tis *Slate) Run() {
+	defer tis.handle.Close()
+	defer tis.close()
+
+	connPath := tis.handle.GetChannel().GetConnPath()
+	log.Printf("slate start: %v %v", connPath, tis.filename)
+	defer log.Printf("slate stop: %v", connPath)
+
+	var (
+		start    = time.Now()
+		offset   time.Duration // 每次循环累加, 时间戳连续
+		last     time.Duration
+		count    int // 本次循环的包数
+		idleFrom time.Time
+	)
+
+	for {
+		pkt, err := tis.demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) && count > 0 {
+			// 重新开始
+			tis.close()
+			if err = tis.open(); err == nil {
+				_, err = tis.demuxer.Streams()
+			}
+			if err != nil {
+				log.Printf("slate %v: %v", connPath, err)
+				return
+			}
+
+			offset = last + loopGap
+			count = 0
+			continue
+		}
+		if err != nil {
+			log.Printf("slate %v: %v", connPath, err)
+			return
+		}
+
+		pkt.Time += offset
+		if pkt.Time > last {
+			last = pkt.Time
+		}
+		count++
+
+		time.Sleep(time.Until(start.Add(pkt.Time)))
+
+		if err = tis.handle.WritePacket(pkt); err != nil {
+			return
+		}
+
+		// 没有推流和读者
+		if tis.isIdle() {
+			if idleFrom.IsZero() {
+				idleFrom = time.Now()
+			} else if time.Since(idleFrom) > tis.idleTimeout {
+				return
+			}
+		} else {
+			idleFrom = time.Time{}
+		}
+	}
+}
+
+func (tis *Slate) isIdle() bool {
+	ch := tis.handle.GetChannel()
+	return !ch.HasPublisher() && ch.SubscriberCount() == 0
+}
@@ -0,0 +1,140 @@
+package udp_server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/general252/live/format/mpegts"
+	"github.com/general252/live/server/server_interface"
+)
+
+// 超过这个时间没有收到数据, 认为推流结束
+const inputReadTimeout = 5 * time.Second
+
+// UdpInput 接收udp ts, 发布到channel
+type UdpInput struct {
+	parent   server_interface.ServerInterface
+	connPath string
+	addr     *net.UDPAddr
+	conn     *net.UDPConn
+	closed   int32
+}
+
+func NewUdpInput(parent server_interface.ServerInterface, connPath string, addr *net.UDPAddr) (*UdpInput, error) {
+	var (
+		conn *net.UDPConn
+		err  error
+	)
+
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadBuffer(4 * 1024 * 1024)
+
+	return &UdpInput{
+		parent:   parent,
+		connPath: connPath,
+		addr:     addr,
+		conn:     conn,
+	}, nil
+}
+
+func (tis *UdpInput) Run() {
+	log.Printf("udp input listen: %v -> %v", tis.addr, tis.connPath)
+	defer log.Printf("udp input close: %v", tis.connPath)
+
+	for !tis.isClosed() {
+		if err := tis.publish(); err != nil && !tis.isClosed() {
+			log.Printf("udp input %v: %v", tis.connPath, err)
+		}
+	}
+}
+
+// publish 等待数据, 发布一次推流直到超时
+func (tis *UdpInput) publish() error {
+	demuxer := mpegts.NewDemuxer(&datagramReader{
+		conn: tis.conn,
+		buf:  make([]byte, 64*1024),
+	})
+
+	streams, err := demuxer.Streams()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("推流: %v", tis.connPath)
+	defer log.Printf("推流关闭: %v", tis.connPath)
+
+	handle, err := tis.parent.CreateChannel(tis.connPath)
+	if err != nil {
+		time.Sleep(time.Second)
+		return err
+	}
+	defer handle.Close()
+
+	handle.SetPublisher("udp", tis.addr.String())
+	_ = handle.WriteHeader(streams)
+
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		if err = handle.WritePacket(pkt); err != nil {
+			if err == server_interface.ErrNotOwner {
+				// 被替换, 稍后再重新推流
+				time.Sleep(time.Second)
+			}
+			return err
+		}
+	}
+}
+
+func (tis *UdpInput) isClosed() bool {
+	return atomic.LoadInt32(&tis.closed) == 1
+}
+
+func (tis *UdpInput) Close() {
+	atomic.StoreInt32(&tis.closed, 1)
+	_ = tis.conn.Close()
+}
+
+// datagramReader 将udp数据报转为连续的流
+type datagramReader struct {
+	conn    *net.UDPConn
+	buf     []byte
+	data    []byte
+	started bool
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		// 等待第一个数据报时不超时
+		if r.started {
+			_ = r.conn.SetReadDeadline(time.Now().Add(inputReadTimeout))
+		} else {
+			_ = r.conn.SetReadDeadline(time.Time{})
+		}
+
+		n, err := r.conn.Read(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		r.data = r.buf[:n]
+		r.started = true
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
@@ -0,0 +1,142 @@
+package udp_server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/general252/live/format/mpegts"
+	"github.com/general252/live/server/server_interface"
+)
+
+// 一个udp数据报包含7个ts包
+const datagramSize = 7 * 188
+
+// UdpOutput 读取channel, 以ts推送到udp
+type UdpOutput struct {
+	parent   server_interface.ServerInterface
+	connPath string
+	addr     *net.UDPAddr
+	conn     *net.UDPConn
+	closed   int32
+}
+
+func NewUdpOutput(parent server_interface.ServerInterface, connPath string, addr *net.UDPAddr) (*UdpOutput, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetWriteBuffer(4 * 1024 * 1024)
+
+	return &UdpOutput{
+		parent:   parent,
+		connPath: connPath,
+		addr:     addr,
+		conn:     conn,
+	}, nil
+}
+
+func (tis *UdpOutput) Run() {
+	log.Printf("udp output: %v -> %v", tis.connPath, tis.addr)
+	defer log.Printf("udp output close: %v", tis.connPath)
+
+	for !tis.isClosed() {
+		// 等待推流, 不触发按需拉流和垫片
+		ch, ok := tis.parent.LookupChannel(tis.connPath)
+		if !ok {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := tis.play(ch); err != nil && !tis.isClosed() {
+			log.Printf("udp output %v: %v", tis.connPath, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// play 推送直到channel关闭
+func (tis *UdpOutput) play(ch *server_interface.Channel) error {
+	log.Printf("拉流: %v", tis.connPath)
+
+	cursor := ch.Subscribe("udp", tis.addr.String())
+	defer cursor.Close()
+
+	streams, err := cursor.Streams()
+	if err != nil {
+		return err
+	}
+
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	writer := &datagramWriter{conn: tis.conn}
+	muxer := mpegts.NewMuxer(writer)
+	if err = muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+
+	started := videoIdx < 0
+	for !tis.isClosed() {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		// 从关键帧开始
+		if !started {
+			if int(pkt.Idx) != videoIdx || !pkt.IsKeyFrame {
+				continue
+			}
+			started = true
+		}
+
+		if err = muxer.WritePacket(pkt); err != nil {
+			return err
+		}
+		if err = muxer.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tis *UdpOutput) isClosed() bool {
+	return atomic.LoadInt32(&tis.closed) == 1
+}
+
+func (tis *UdpOutput) Close() {
+	atomic.StoreInt32(&tis.closed, 1)
+	_ = tis.conn.Close()
+}
+
+// datagramWriter 将ts流按数据报大小发送
+type datagramWriter struct {
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func (w *datagramWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	n := 0
+	for len(w.buf)-n >= datagramSize {
+		if _, err := w.conn.Write(w.buf[n : n+datagramSize]); err != nil {
+			return 0, err
+		}
+		n += datagramSize
+	}
+
+	// 剩余不足一个数据报的留到下次
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+
+	return len(p), nil
+}
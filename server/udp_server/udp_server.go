@@ -0,0 +1,224 @@
+package udp_server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+
+	"github.com/general252/live/server/server_interface"
+	"github.com/general252/live/util"
+)
+
+// ffmpeg -re -i demo.flv -c:v libx264 -c:a aac -f mpegts udp://239.0.0.1:1234
+// ffplay udp://239.0.0.2:1234
+
+type Option struct {
+	Inputs  []server_interface.UdpInput  `yaml:"inputs"`
+	Outputs []server_interface.UdpOutput `yaml:"outputs"`
+}
+
+type UdpServer struct {
+	parent server_interface.ServerInterface
+
+	option Option
+
+	inputs  *util.Map[string, *UdpInput]
+	outputs *util.Map[string, *UdpOutput]
+}
+
+func NewUdpServer(parent server_interface.ServerInterface, option Option) *UdpServer {
+	return &UdpServer{
+		parent:  parent,
+		option:  option,
+		inputs:  util.NewMap[string, *UdpInput](),
+		outputs: util.NewMap[string, *UdpOutput](),
+	}
+}
+
+// Serve 启动配置的输入输出, 返回第一个错误, 例如端口被占用
+func (tis *UdpServer) Serve() error {
+	for _, option := range tis.option.Inputs {
+		if err := tis.AddInput(option); err != nil {
+			return fmt.Errorf("input %v %v: %w", option.ConnPath, option.URL, err)
+		}
+	}
+
+	for _, option := range tis.option.Outputs {
+		if err := tis.AddOutput(option); err != nil {
+			return fmt.Errorf("output %v %v: %w", option.ConnPath, option.URL, err)
+		}
+	}
+
+	return nil
+}
+
+// Reload 按新配置增删输入输出, 未变化的保持不变
+func (tis *UdpServer) Reload(option Option) {
+	var (
+		inputs  = map[string]string{}
+		outputs = map[string]string{}
+	)
+	for _, input := range option.Inputs {
+		inputs[input.ConnPath] = normalizeURL(input.URL)
+	}
+	for _, output := range option.Outputs {
+		outputs[output.URL] = output.ConnPath
+	}
+
+	for _, input := range tis.Inputs() {
+		if rawURL, ok := inputs[input.ConnPath]; !ok || rawURL != input.URL {
+			tis.RemoveInput(input.ConnPath)
+		}
+	}
+	for _, output := range tis.Outputs() {
+		if connPath, ok := outputs[output.URL]; !ok || connPath != output.ConnPath {
+			tis.RemoveOutput(output.URL)
+		}
+	}
+
+	for _, input := range option.Inputs {
+		if !tis.inputs.IsExist(input.ConnPath) {
+			if err := tis.AddInput(input); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	for _, output := range option.Outputs {
+		if !tis.outputs.IsExist(output.URL) {
+			if err := tis.AddOutput(output); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	tis.option = option
+}
+
+// Close 关闭所有输入输出
+func (tis *UdpServer) Close() {
+	for _, input := range tis.Inputs() {
+		tis.RemoveInput(input.ConnPath)
+	}
+	for _, output := range tis.Outputs() {
+		tis.RemoveOutput(output.URL)
+	}
+}
+
+// AddInput 添加udp输入
+func (tis *UdpServer) AddInput(option server_interface.UdpInput) error {
+	if tis.inputs.IsExist(option.ConnPath) {
+		return fmt.Errorf("udp input have exist %v", option.ConnPath)
+	}
+
+	addr, err := parseURL(option.URL)
+	if err != nil {
+		return err
+	}
+
+	input, err := NewUdpInput(tis.parent, option.ConnPath, addr)
+	if err != nil {
+		return err
+	}
+
+	tis.inputs.Store(option.ConnPath, input)
+	go input.Run()
+
+	return nil
+}
+
+// RemoveInput 删除udp输入
+func (tis *UdpServer) RemoveInput(connPath string) bool {
+	input, ok := tis.inputs.Load(connPath)
+	if !ok {
+		return false
+	}
+
+	tis.inputs.Delete(connPath)
+	input.Close()
+
+	return true
+}
+
+// AddOutput 添加udp输出
+func (tis *UdpServer) AddOutput(option server_interface.UdpOutput) error {
+	if tis.outputs.IsExist(option.URL) {
+		return fmt.Errorf("udp output have exist %v", option.URL)
+	}
+
+	addr, err := parseURL(option.URL)
+	if err != nil {
+		return err
+	}
+
+	output, err := NewUdpOutput(tis.parent, option.ConnPath, addr)
+	if err != nil {
+		return err
+	}
+
+	tis.outputs.Store(option.URL, output)
+	go output.Run()
+
+	return nil
+}
+
+// RemoveOutput 删除udp输出
+func (tis *UdpServer) RemoveOutput(rawURL string) bool {
+	output, ok := tis.outputs.Load(rawURL)
+	if !ok {
+		return false
+	}
+
+	tis.outputs.Delete(rawURL)
+	output.Close()
+
+	return true
+}
+
+// Inputs 当前的输入
+func (tis *UdpServer) Inputs() []server_interface.UdpInput {
+	var options []server_interface.UdpInput
+	tis.inputs.Range(func(key string, value *UdpInput) bool {
+		options = append(options, server_interface.UdpInput{
+			URL:      "udp://" + value.addr.String(),
+			ConnPath: key,
+		})
+		return true
+	})
+	return options
+}
+
+// Outputs 当前的输出
+func (tis *UdpServer) Outputs() []server_interface.UdpOutput {
+	var options []server_interface.UdpOutput
+	tis.outputs.Range(func(key string, value *UdpOutput) bool {
+		options = append(options, server_interface.UdpOutput{
+			ConnPath: value.connPath,
+			URL:      key,
+		})
+		return true
+	})
+	return options
+}
+
+func parseURL(rawURL string) (*net.UDPAddr, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported scheme %v", u.Scheme)
+	}
+
+	return net.ResolveUDPAddr("udp", u.Host)
+}
+
+// normalizeURL 与Inputs()返回的格式一致
+func normalizeURL(rawURL string) string {
+	addr, err := parseURL(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return "udp://" + addr.String()
+}
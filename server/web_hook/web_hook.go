@@ -0,0 +1,141 @@
+package web_hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/general252/live/server/server_interface"
+)
+
+type Action string
+
+const (
+	OnPublish    Action = "on_publish"
+	OnUnpublish  Action = "on_unpublish"
+	OnPlay       Action = "on_play"
+	OnStop       Action = "on_stop"
+	OnRecordDone Action = "on_record_done"
+)
+
+// Option 回调地址, 为空时不回调
+type Option struct {
+	OnPublish    string `yaml:"on_publish"`
+	OnUnpublish  string `yaml:"on_unpublish"`
+	OnPlay       string `yaml:"on_play"`
+	OnStop       string `yaml:"on_stop"`
+	OnRecordDone string `yaml:"on_record_done"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Event 回调内容
+type Event struct {
+	Action     Action            `json:"action"`
+	ConnPath   string            `json:"conn_path"`
+	Protocol   string            `json:"protocol"`
+	RemoteAddr string            `json:"remote_addr"`
+	Query      map[string]string `json:"query"`
+	File       string            `json:"file,omitempty"` // on_record_done
+	Time       int64             `json:"time"`
+}
+
+// WebHook 以json POST事件到回调地址
+// on_publish/on_play 返回非2xx时拒绝请求
+type WebHook struct {
+	option Option
+	client *http.Client
+}
+
+func NewWebHook(option Option) *WebHook {
+	if option.Timeout <= 0 {
+		option.Timeout = 3 * time.Second
+	}
+
+	return &WebHook{
+		option: option,
+		client: &http.Client{
+			Timeout: option.Timeout,
+		},
+	}
+}
+
+// NewEvent 从请求创建事件
+func NewEvent(action Action, req *server_interface.StreamRequest) *Event {
+	evt := &Event{
+		Action:     action,
+		ConnPath:   req.ConnPath,
+		Protocol:   req.Protocol,
+		RemoteAddr: req.RemoteAddr,
+		Query:      map[string]string{},
+		Time:       time.Now().Unix(),
+	}
+
+	for key := range req.Query {
+		evt.Query[key] = req.Query.Get(key)
+	}
+
+	return evt
+}
+
+func (tis *WebHook) OnPublish(req *server_interface.StreamRequest) error {
+	return tis.post(tis.option.OnPublish, NewEvent(OnPublish, req))
+}
+
+func (tis *WebHook) OnUnpublish(req *server_interface.StreamRequest) {
+	tis.notify(tis.option.OnUnpublish, NewEvent(OnUnpublish, req))
+}
+
+func (tis *WebHook) OnPlay(req *server_interface.StreamRequest) error {
+	return tis.post(tis.option.OnPlay, NewEvent(OnPlay, req))
+}
+
+func (tis *WebHook) OnStop(req *server_interface.StreamRequest) {
+	tis.notify(tis.option.OnStop, NewEvent(OnStop, req))
+}
+
+func (tis *WebHook) OnRecordDone(req *server_interface.StreamRequest, file string) {
+	evt := NewEvent(OnRecordDone, req)
+	evt.File = file
+
+	tis.notify(tis.option.OnRecordDone, evt)
+}
+
+// notify 异步回调, 不关心结果
+func (tis *WebHook) notify(hookUrl string, evt *Event) {
+	if len(hookUrl) == 0 {
+		return
+	}
+
+	go func() {
+		if err := tis.post(hookUrl, evt); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func (tis *WebHook) post(hookUrl string, evt *Event) error {
+	if len(hookUrl) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	resp, err := tis.client.Post(hookUrl, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%v %v fail. %v", evt.Action, evt.ConnPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v rejected. status %v", evt.Action, evt.ConnPath, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"context"
+	"net"
+)
+
+type connKey struct{}
+
+// WithConn 用于http.Server.ConnContext, 保存请求的底层连接
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// ConnFromContext 请求的底层连接, 用于断开写入卡住的http响应
+func ConnFromContext(ctx context.Context) (net.Conn, bool) {
+	conn, ok := ctx.Value(connKey{}).(net.Conn)
+	return conn, ok
+}
@@ -30,6 +30,12 @@ func (tis *Map[K, V]) Range(f func(key K, value V) bool) {
 	})
 }
 
+// LoadOrStore 已存在时返回已有的值和true, 否则保存value
+func (tis *Map[K, V]) LoadOrStore(key K, value V) (V, bool) {
+	v, loaded := tis.m.LoadOrStore(key, value)
+	return v.(V), loaded
+}
+
 func (tis *Map[K, V]) Load(key K) (V, bool) {
 	v, ok := tis.m.Load(key)
 	if !ok {
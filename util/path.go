@@ -0,0 +1,28 @@
+package util
+
+import (
+	"path"
+	"sort"
+)
+
+// MatchPath 按connPath查找配置, 精确匹配优先, 然后按通配符(path.Match)排序后匹配
+func MatchPath[T any](paths map[string]T, connPath string) (T, bool) {
+	if value, ok := paths[connPath]; ok {
+		return value, true
+	}
+
+	var patterns []string
+	for pattern := range paths {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, connPath); ok {
+			return paths[pattern], true
+		}
+	}
+
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// Wait 等待wg结束, ctx结束时返回ctx.Err()
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}